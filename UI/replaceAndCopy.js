@@ -29,10 +29,17 @@ let testContent = content.replace(
     console.log("Found formData object for testing replacement:", match);
     return `window.formData = {
       chatId: "testChatID",
+      threadId: "testThreadID",
+      userId: "testUserID",
       messageId: "testMessageID",
       signature: "testSignature",
       authType: "testAuthType",
-      csrfToken: "testCSRFToken"
+      operation: "testOperation",
+      domain: "testDomain",
+      issuedAt: "testIssuedAt",
+      nonce: "testNonce",
+      csrfToken: "testCSRFToken",
+      vaultEnabled: "testVaultEnabled"
     }`;
   }
 );
@@ -44,10 +51,17 @@ let templateContent = content.replace(
     console.log("Found formData object for template replacement:", match);
     return `window.formData = {
       chatId: "{{.ChatID}}",
+      threadId: "{{.ThreadID}}",
+      userId: "{{.UserID}}",
       messageId: "{{.MessageID}}",
       signature: "{{.Signature}}",
       authType: "{{.AuthType}}",
-      csrfToken: "{{.CSRFToken}}"
+      operation: "{{.Operation}}",
+      domain: "{{.Domain}}",
+      issuedAt: "{{.IssuedAt}}",
+      nonce: "{{.Nonce}}",
+      csrfToken: "{{.CSRFToken}}",
+      vaultEnabled: "{{.VaultEnabled}}"
     }`;
   }
 );
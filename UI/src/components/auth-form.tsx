@@ -11,10 +11,17 @@ declare global {
   interface Window {
     formData?: {
       chatId: string;
+      threadId?: string;
+      userId: string;
       messageId: string;
       signature: string;
       authType: string;
+      operation?: string;
+      domain?: string;
+      issuedAt: string;
+      nonce: string;
       csrfToken: string;
+      vaultEnabled?: string;
     };
   }
 }
@@ -24,16 +31,24 @@ interface FormData {
   access_token?: string;
   client_id?: string;
   client_secret?: string;
+  store_credentials?: boolean;
 }
 
 // Initialize default form data for development
 if (typeof window !== 'undefined' && !window.formData) {
   window.formData = {
     chatId: "8109655141",
+    threadId: "",
+    userId: "8109655141",
     messageId: "69",
     signature: "888831bc4e853c853b23bbb901fec502f28144bbeca43b785d813b11b249cdce",
     authType: "tenant_personal",
-    csrfToken: "fZWveaAKp3Qc2PG5DmOQW3BuRxZVfstO"
+    operation: "setup",
+    domain: "",
+    issuedAt: "1735689600",
+    nonce: "Xq3vL9pT2mKc8RwA",
+    csrfToken: "fZWveaAKp3Qc2PG5DmOQW3BuRxZVfstO",
+    vaultEnabled: "false"
   };
 }
 
@@ -47,6 +62,10 @@ export default function AuthForm() {
     if (window.formData?.authType) {
       setAuthType(window.formData.authType);
     }
+    // Links for an existing tenant are bound to its domain
+    if (window.formData?.domain) {
+      setFormData({ domain: window.formData.domain });
+    }
   }, []);
 
   const handleSubmit = async (e: React.FormEvent) => {
@@ -70,9 +89,15 @@ export default function AuthForm() {
         body: JSON.stringify({
           ...formData,
           chat_id: window.formData.chatId,
+          thread_id: window.formData.threadId,
+          user_id: window.formData.userId,
           message_id: window.formData.messageId,
           signature: window.formData.signature,
           auth_type: window.formData.authType,
+          operation: window.formData.operation,
+          target_domain: window.formData.domain,
+          issued_at: window.formData.issuedAt,
+          nonce: window.formData.nonce,
         }),
       });
 
@@ -101,6 +126,8 @@ export default function AuthForm() {
                 <Globe className="absolute left-3 top-2.5 h-5 w-5 text-muted-foreground" />
                 <Input
                   id="domain"
+                  defaultValue={window.formData?.domain}
+                  readOnly={!!window.formData?.domain}
                   placeholder="your-tenant.auth0.com"
                   className="pl-10"
                   onChange={(e) =>
@@ -142,6 +169,8 @@ export default function AuthForm() {
                 <Globe className="absolute left-3 top-2.5 h-5 w-5 text-muted-foreground" />
                 <Input
                   id="domain"
+                  defaultValue={window.formData?.domain}
+                  readOnly={!!window.formData?.domain}
                   placeholder="your-tenant.auth0.com"
                   className="pl-10"
                   onChange={(e) =>
@@ -179,6 +208,21 @@ export default function AuthForm() {
                 />
               </div>
             </div>
+            {window.formData?.vaultEnabled === 'true' && (
+              <div className="flex items-center space-x-2">
+                <input
+                  id="store_credentials"
+                  type="checkbox"
+                  className="h-4 w-4"
+                  onChange={(e) =>
+                    setFormData({ ...formData, store_credentials: e.target.checked })
+                  }
+                />
+                <Label htmlFor="store_credentials">
+                  Store these credentials encrypted, so the bot can maintain this tenant without asking again
+                </Label>
+              </div>
+            )}
           </div>
         );
 
@@ -204,7 +248,17 @@ export default function AuthForm() {
       <Card>
         <CardHeader>
           <CardTitle className="text-2xl font-bold text-center">
-            Bind your Auth0 Tenant
+            {window.formData.operation === 'disconnect'
+              ? 'Disconnect your Auth0 Tenant'
+              : window.formData.operation === 'rotate'
+                ? 'Rotate your Auth0 Tenant Secrets'
+                : window.formData.operation === 'status'
+                  ? 'Check your Auth0 Tenant Actions'
+                  : window.formData.operation === 'resync'
+                    ? 'Re-sync your Auth0 Tenant'
+                    : window.formData.operation === 'repair'
+                      ? 'Repair your Auth0 Tenant'
+                      : 'Bind your Auth0 Tenant'}
           </CardTitle>
         </CardHeader>
         <CardContent>
@@ -7,6 +7,7 @@ require (
 	github.com/go-resty/resty/v2 v2.11.0
 	github.com/joho/godotenv v1.5.1
 	github.com/stretchr/testify v1.8.3
+	go.etcd.io/bbolt v1.3.11
 	go.uber.org/zap v1.27.0
 )
 
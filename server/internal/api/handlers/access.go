@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"slices"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+)
+
+// telegramLoginMaxAge is how long after pressing a login button the auth form can be opened
+const telegramLoginMaxAge = 10 * time.Minute
+
+// notAllowedMessage answers users who may not configure the chat
+const notAllowedMessage = "Only the administrators of this chat can configure OTPus."
+
+// canConfigure reports whether a user may set up, disconnect or change the settings of tenants in a chat.
+// Users always may in their private chat with the bot, where the chat ID is their user ID. In groups only
+// chat admins and the users listed in TELEGRAM_ADMIN_USER_IDS may.
+func canConfigure(cfg *config.Config, client *telegram.Client, chatID, userID int64) (bool, error) {
+	if chatID == userID || slices.Contains(cfg.TelegramAdminUserIDs, userID) {
+		return true, nil
+	}
+
+	member, err := client.GetChatMember(chatID, userID)
+	if err != nil {
+		return false, err
+	}
+	return member.IsAdmin(), nil
+}
+
+// authFormButton opens an auth-form link. With TELEGRAM_LOGIN_URL it is a login button, so Telegram tells the
+// form which user opened it.
+func authFormButton(cfg *config.Config, text, link string) telegram.InlineKeyboardButton {
+	if cfg.TelegramLoginURL {
+		return telegram.InlineKeyboardButton{Text: text, LoginURL: &telegram.LoginURL{URL: link}}
+	}
+	return telegram.InlineKeyboardButton{Text: text, URL: link}
+}
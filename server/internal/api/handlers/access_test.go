@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testGroupID = -1001234567890
+	testUserID  = 7
+)
+
+func TestNonAdminButtonPressIsRefusedInGroups(t *testing.T) {
+	env, fake := testBotEnv(t)
+
+	botRoutes.dispatch(context.Background(), env, callbackUpdate(testGroupID, testUserID, callbackData("settings")))
+
+	answers := fake.requests("answerCallbackQuery")
+	require.Len(t, answers, 1)
+	assert.Equal(t, notAllowedMessage, answers[0].Body["text"])
+	assert.Equal(t, true, answers[0].Body["show_alert"])
+	assert.Empty(t, fake.requests("editMessageText"))
+}
+
+func TestNonAdminCommandIsRefusedInGroups(t *testing.T) {
+	env, fake := testBotEnv(t)
+
+	botRoutes.dispatch(context.Background(), env, commandUpdate(testGroupID, testUserID, "/start"))
+
+	sent := fake.requests("sendMessage")
+	require.Len(t, sent, 1)
+	assert.Equal(t, notAllowedMessage, sent[0].Body["text"])
+}
+
+func TestChatAdminMayConfigureGroups(t *testing.T) {
+	env, fake := testBotEnv(t)
+	fake.memberStatus = "administrator"
+
+	botRoutes.dispatch(context.Background(), env, commandUpdate(testGroupID, testUserID, "/start"))
+
+	sent := fake.requests("sendMessage")
+	require.Len(t, sent, 1)
+	assert.NotEqual(t, notAllowedMessage, sent[0].Body["text"])
+}
+
+func TestCanConfigure(t *testing.T) {
+	env, fake := testBotEnv(t)
+	env.Config.TelegramAdminUserIDs = []int64{99}
+
+	allowed, err := canConfigure(env.Config, env.Telegram, testUserID, testUserID)
+	require.NoError(t, err)
+	assert.True(t, allowed, "private chats")
+
+	allowed, err = canConfigure(env.Config, env.Telegram, testGroupID, 99)
+	require.NoError(t, err)
+	assert.True(t, allowed, "TELEGRAM_ADMIN_USER_IDS")
+	assert.Empty(t, fake.requests("getChatMember"))
+
+	allowed, err = canConfigure(env.Config, env.Telegram, testGroupID, testUserID)
+	require.NoError(t, err)
+	assert.False(t, allowed, "group members")
+}
@@ -1,21 +1,41 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
 	"github.com/ambravo/a0-OTPus-prime/server/internal/assets"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
+// Operations an auth-form link can authorize
+const (
+	operationSetup      = "setup"
+	operationDisconnect = "disconnect"
+	operationRotate     = "rotate"
+	operationStatus     = "status"
+	operationResync     = "resync"
+	operationRepair     = "repair"
+)
+
+// Errors shown in the auth form for links that can no longer be used
+const (
+	linkExpiredError = "This link has expired. Go back to the bot and request a new one."
+	linkUsedError    = "This link was already used. Go back to the bot and request a new one."
+)
+
 type AuthFormData struct {
 	ChatID    string
 	Signature string
@@ -25,79 +45,157 @@ type AuthFormData struct {
 
 type AuthFormRequest struct {
 	ChatID       string `json:"chat_id" binding:"required"`
+	ThreadID     string `json:"thread_id"` // Forum topic the link was requested from
+	UserID       string `json:"user_id" binding:"required"`
 	Signature    string `json:"signature" binding:"required"`
 	AuthType     string `json:"auth_type" binding:"required"`
 	Domain       string `json:"domain" binding:"required"`
 	MessageID    string `json:"message_id" binding:"required"`
+	Operation    string `json:"operation" binding:"required"`
+	TargetDomain string `json:"target_domain"` // Set when the link was issued for a specific tenant
+	IssuedAt     string `json:"issued_at" binding:"required"`
+	Nonce        string `json:"nonce" binding:"required"`
 	AccessToken  string `json:"access_token"`
 	ClientID     string `json:"client_id"`
 	ClientSecret string `json:"client_secret"`
+	// StoreCredentials is the user's consent to keep the client credentials in the vault after setup
+	StoreCredentials bool `json:"store_credentials"`
 }
 
-func RenderAuthForm(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
+// linkValues returns the auth-form link the request was submitted from as query parameters
+func (req *AuthFormRequest) linkValues() url.Values {
+	query := url.Values{}
+	query.Set("chat_id", req.ChatID)
+	query.Set("user_id", req.UserID)
+	query.Set("message_id", req.MessageID)
+	query.Set("auth_type", req.AuthType)
+	query.Set("operation", req.Operation)
+	query.Set("issued_at", req.IssuedAt)
+	query.Set("nonce", req.Nonce)
+	query.Set("signature", req.Signature)
+	if req.ThreadID != "" {
+		query.Set("thread_id", req.ThreadID)
+	}
+	if req.TargetDomain != "" {
+		query.Set("domain", req.TargetDomain)
+	}
+	return query
+}
+
+func RenderAuthForm(cfg *config.Config, st store.Store, credentials *vault.Vault, deletions *telegram.DeletionQueue,
+	logger *zap.Logger) gin.HandlerFunc {
+	telegramClient := telegram.NewClient(cfg.TelegramToken, deletions)
 	templatesFS := &assets.Assets
 
-	// Parse template at initialization
+	// Parse templates at initialization
 	tmpl, err := template.ParseFS(templatesFS, "templates/auth_form.html")
 	if err != nil {
 		logger.Fatal("Failed to parse template",
 			zap.Error(err))
 	}
+	expiredTmpl, err := template.ParseFS(templatesFS, "templates/link_expired.html")
+	if err != nil {
+		logger.Fatal("Failed to parse template",
+			zap.Error(err))
+	}
 
 	return func(c *gin.Context) {
-		chatID := c.Query("chat_id")
-		messageID := c.Query("message_id")
-		signature := c.Query("signature")
-		authType := c.Query("auth_type")
-
-		// Validate required parameters
-		if chatID == "" || signature == "" || authType == "" || messageID == "" {
-			logger.Error("Missing required parameters",
-				zap.String("chat_id", chatID),
-				zap.String("auth_type", authType))
-			c.String(http.StatusBadRequest, "Invalid request parameters")
+		link, err := parseAuthFormLink(cfg, c.Request.URL.Query())
+		if errors.Is(err, errLinkExpired) {
+			renderLinkExpired(c, expiredTmpl, telegramClient, logger, "This link has expired.")
 			return
 		}
-
-		// Validate signature
-		if !utils.ValidateHMAC(chatID, signature, cfg.HMACSecret) {
+		if errors.Is(err, errLinkSignature) {
 			logger.Error("Invalid signature for auth form",
-				zap.String("chat_id", chatID),
-				zap.String("signature", signature))
+				zap.String("chat_id", c.Query("chat_id")),
+				zap.String("signature", c.Query("signature")))
 			c.String(http.StatusUnauthorized, "Invalid request signature")
 			return
 		}
+		if err != nil {
+			logger.Error("Invalid auth form parameters",
+				zap.Error(err),
+				zap.String("chat_id", c.Query("chat_id")))
+			c.String(http.StatusBadRequest, "Invalid request parameters")
+			return
+		}
 
-		// Remove keyboard from chat
-		telegramClient := telegram.NewClient(cfg.TelegramToken)
-		chatIDInt, _ := strconv.ParseInt(chatID, 10, 64)
-		messageIDInt, _ := strconv.ParseInt(messageID, 10, 64)
-		err = telegramClient.EditMessageText(chatIDInt, messageIDInt, "Continuing in the browser...")
+		// Login buttons append the Telegram user who opened the link, it must be the one who requested it
+		if cfg.TelegramLoginURL {
+			loginUserID, err := utils.ValidateTelegramLogin(c.Request.URL.Query(), cfg.TelegramToken, telegramLoginMaxAge)
+			if err != nil || loginUserID != link.UserID {
+				logger.Error("Auth form opened by another Telegram user",
+					zap.Error(err),
+					zap.Int64("chat_id", link.ChatID),
+					zap.Int64("user_id", link.UserID),
+					zap.Int64("login_user_id", loginUserID))
+				c.String(http.StatusForbidden, "This link was requested by another Telegram user")
+				return
+			}
+		}
+
+		// The browser that opened the link first keeps its CSRF token, so reloading the form keeps working
+		csrfToken, err := c.Cookie("csrf_token")
+		if err != nil || csrfToken == "" {
+			csrfToken = utils.GenerateRandomString(32)
+		}
+
+		first, err := openAuthLink(cfg, st, link, authSession(csrfToken))
+		if errors.Is(err, errLinkUsed) {
+			renderLinkExpired(c, expiredTmpl, telegramClient, logger, "This link was already used.")
+			return
+		}
 		if err != nil {
-			logger.Info("Failed to send message",
+			logger.Error("Failed to open auth form link",
 				zap.Error(err),
-				zap.Int64("chat_id", chatIDInt),
-				zap.Int64("message_id", messageIDInt),
-			)
+				zap.Int64("chat_id", link.ChatID))
+			c.String(http.StatusInternalServerError, "Internal server error")
+			return
 		}
+		c.SetCookie("csrf_token", csrfToken, int(cfg.AuthFormLinkTTL.Seconds()), "/", "", true, true)
 
-		// Generate CSRF token
-		csrfToken := utils.GenerateRandomString(32)
-		c.SetCookie("csrf_token", csrfToken, 3600, "/", "", true, true)
+		// Remove keyboard from chat
+		if first {
+			err = telegramClient.EditMessageText(link.ChatID, link.MessageID, "Continuing in the browser...")
+			if err != nil {
+				logger.Info("Failed to send message",
+					zap.Error(err),
+					zap.Int64("chat_id", link.ChatID),
+					zap.Int64("message_id", link.MessageID),
+				)
+			}
+		}
 
 		// Prepare template data with proper JSON encoding
+		query := link.values()
 		data := struct {
 			ChatID    template.JS
+			ThreadID  template.JS
+			UserID    template.JS
 			MessageID template.JS
 			Signature template.JS
 			AuthType  template.JS
+			Operation template.JS
+			Domain    template.JS
+			IssuedAt  template.JS
+			Nonce     template.JS
 			CSRFToken template.JS
+			// Whether the form offers to store the client credentials
+			VaultEnabled template.JS
 		}{
-			ChatID:    template.JS(chatID),
-			MessageID: template.JS(messageID),
-			Signature: template.JS(signature),
-			AuthType:  template.JS(authType),
+			ChatID:    template.JS(query.Get("chat_id")),
+			ThreadID:  template.JS(query.Get("thread_id")),
+			UserID:    template.JS(query.Get("user_id")),
+			MessageID: template.JS(query.Get("message_id")),
+			Signature: template.JS(c.Query("signature")),
+			AuthType:  template.JS(link.AuthType),
+			Operation: template.JS(link.Operation),
+			Domain:    template.JS(link.Domain),
+			IssuedAt:  template.JS(query.Get("issued_at")),
+			Nonce:     template.JS(link.Nonce),
 			CSRFToken: template.JS(csrfToken),
+			VaultEnabled: template.JS(strconv.FormatBool(credentials.Enabled() &&
+				link.AuthType == "auth_client_credentials" && link.Operation == operationSetup)),
 		}
 
 		// Set security headers
@@ -117,11 +215,41 @@ func RenderAuthForm(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
 		}
 	}
 }
-func ProcessAuthForm(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
+
+// renderLinkExpired tells the user to request a new link from the bot
+func renderLinkExpired(c *gin.Context, tmpl *template.Template, telegramClient *telegram.Client, logger *zap.Logger,
+	message string) {
+	var botURL string
+	if username, err := telegramClient.Username(); err == nil {
+		botURL = "https://t.me/" + username
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusGone)
+	err := tmpl.Execute(c.Writer, struct {
+		Title   string
+		Message string
+		BotURL  string
+	}{
+		Title:   "Link expired",
+		Message: message,
+		BotURL:  botURL,
+	})
+	if err != nil {
+		logger.Error("Failed to render template",
+			zap.Error(err))
+	}
+}
+
+func ProcessAuthForm(cfg *config.Config, st store.Store, plans *PendingPlans, deviceFlows *DeviceFlows,
+	credentials *vault.Vault, deletions *telegram.DeletionQueue, logger *zap.Logger) gin.HandlerFunc {
 	auth0Client := auth0.NewAuth0Client()
-	telegramClient := telegram.NewClient(cfg.TelegramToken)
+	telegramClient := telegram.NewClient(cfg.TelegramToken, deletions)
 
 	return func(c *gin.Context) {
+		// Auth0 calls stop when the form disconnects or the server shuts down
+		ctx := c.Request.Context()
+
 		// Validate CSRF token
 		csrfToken, err := c.Cookie("csrf_token")
 		if err != nil || csrfToken != c.GetHeader("X-CSRF-Token") {
@@ -137,13 +265,35 @@ func ProcessAuthForm(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
 			return
 		}
 
-		// Validate signature
-		if !utils.ValidateHMAC(req.ChatID, req.Signature, cfg.HMACSecret) {
+		// Validate the link the form was opened from
+		link, err := parseAuthFormLink(cfg, req.linkValues())
+		if errors.Is(err, errLinkExpired) {
+			c.JSON(http.StatusGone, gin.H{"error": linkExpiredError})
+			return
+		}
+		if errors.Is(err, errLinkSignature) {
 			logger.Error("Invalid signature for auth form submission",
 				zap.String("chat_id", req.ChatID))
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid request signature"})
 			return
 		}
+		if err != nil {
+			logger.Error("Invalid auth form link",
+				zap.Error(err),
+				zap.String("chat_id", req.ChatID))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+		session := authSession(csrfToken)
+
+		// Links issued for a tenant only authorize that tenant
+		if link.Domain != "" && req.Domain != link.Domain {
+			logger.Error("Domain does not match the auth form link",
+				zap.String("domain", req.Domain),
+				zap.String("target_domain", link.Domain))
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This link is for " + link.Domain})
+			return
+		}
 
 		// Validate domain format
 		if !utils.IsValidDomain(req.Domain) {
@@ -152,20 +302,41 @@ func ProcessAuthForm(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
 			return
 		}
 
-		chatIDInt, err := strconv.ParseInt(req.ChatID, 10, 64)
+		chatIDInt := link.ChatID
+		threadIDInt := link.ThreadID
+		messageIDInt := link.MessageID
+
+		// The user may have lost their admin rights since requesting the link
+		allowed, err := canConfigure(cfg, telegramClient, chatIDInt, link.UserID)
 		if err != nil {
-			logger.Error("Invalid chat ID format", zap.Error(err))
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID format"})
+			logger.Error("Failed to check chat member",
+				zap.Error(err),
+				zap.Int64("chat_id", chatIDInt),
+				zap.Int64("user_id", link.UserID))
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": notAllowedMessage})
 			return
 		}
 
 		var accessToken string
 		var tokenResponse *auth0.TokenResponse
+		var consented *tenantCredentials
 
 		// Handle different authentication types
-		switch req.AuthType {
+		switch link.AuthType {
 		case "tenant_personal":
-			deviceCode, err := auth0Client.InitiateDeviceFlow(req.Domain)
+			if cfg.Auth0DeviceClientID == "" {
+				logger.Error("Device flow requested without AUTH0_DEVICE_CLIENT_ID")
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Device authorization is not enabled on this bot"})
+				return
+			}
+
+			if !claimAuthLink(c, cfg, st, logger, link, session) {
+				return
+			}
+
+			deviceCode, err := auth0Client.InitiateDeviceFlow(ctx, req.Domain, cfg.Auth0DeviceClientID, cfg.Auth0DeviceScopes)
 			if err != nil {
 				logger.Error("Failed to initiate device flow",
 					zap.Error(err),
@@ -183,7 +354,7 @@ Visit: ` + deviceCode.VerificationURIComplete + `
 
 This code will expire in ` + strconv.Itoa(deviceCode.ExpiresIn/60) + ` minutes.`
 
-			err = telegramClient.SendMessage(chatIDInt, message)
+			err = telegramClient.SendMessageWithOptions(chatIDInt, message, telegram.SendMessageOptions{ThreadID: threadIDInt})
 			if err != nil {
 				logger.Error("Failed to send device code info",
 					zap.Error(err),
@@ -192,8 +363,13 @@ This code will expire in ` + strconv.Itoa(deviceCode.ExpiresIn/60) + ` minutes.`
 				return
 			}
 
-			// Start polling for token
-			go pollForDeviceToken(auth0Client, cfg, logger, deviceCode, chatIDInt, req.Domain)
+			// Start polling for token, replacing a poll still running for the chat
+			pollCtx, done := deviceFlows.Start(chatIDInt)
+			go func() {
+				defer done()
+				pollForDeviceToken(pollCtx, auth0Client, telegramClient, cfg, st, plans, logger, deviceCode, chatIDInt,
+					threadIDInt, req.Domain, link.Operation)
+			}()
 
 			c.JSON(http.StatusOK, gin.H{
 				"status":  "success",
@@ -216,117 +392,232 @@ This code will expire in ` + strconv.Itoa(deviceCode.ExpiresIn/60) + ` minutes.`
 				return
 			}
 
-			tokenResponse, err = auth0Client.GetClientCredentialsToken(req.Domain, req.ClientID, req.ClientSecret)
+			tokenResponse, err = auth0Client.GetClientCredentialsToken(ctx, req.Domain, req.ClientID, req.ClientSecret)
 			if err != nil {
 				logger.Error("Failed to get client credentials token",
 					zap.Error(err),
 					zap.String("domain", req.Domain))
+				var oauthErr *auth0.OAuthError
+				if errors.As(err, &oauthErr) &&
+					(oauthErr.StatusCode == http.StatusUnauthorized || oauthErr.StatusCode == http.StatusForbidden) {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid client credentials"})
+					return
+				}
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get access token"})
 				return
 			}
 			accessToken = tokenResponse.AccessToken
 
+			// Credentials are only stored at setup, and only when the user asked for it
+			if req.StoreCredentials && link.Operation == operationSetup {
+				if !credentials.Enabled() {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Storing credentials is not enabled on this bot"})
+					return
+				}
+				consented = &tenantCredentials{ClientID: req.ClientID, ClientSecret: req.ClientSecret, UserID: link.UserID}
+			}
+
 		default:
-			logger.Error("Invalid auth type", zap.String("type", req.AuthType))
+			logger.Error("Invalid auth type", zap.String("type", link.AuthType))
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid authentication type"})
 			return
 		}
 
-		// Create or update Auth0 Action
-		err = auth0Client.EnablePhoneExtensibility(req.Domain, accessToken, chatIDInt, cfg)
-		if err != nil {
-			logger.Error("Failed to setup Auth0 action",
-				zap.Error(err),
-				zap.String("domain", req.Domain),
-				zap.Int64("chat_id", chatIDInt))
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to setup Auth0 action"})
+		// Mark the link used once the credentials worked, so a typo does not burn it
+		if !claimAuthLink(c, cfg, st, logger, link, session) {
+			return
+		}
+
+		if link.Operation != operationSetup {
+			err = completeTenantOperation(ctx, auth0Client, telegramClient, cfg, st, logger, link.Operation, req.Domain,
+				accessToken, chatIDInt, threadIDInt, messageIDInt, link.AuthType)
+			if errors.Is(err, errNotConnected) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "This tenant is not connected to the chat"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "The operation failed, check the Telegram chat for details"})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"status":  "success",
+				"message": "Operation completed successfully",
+			})
+			return
+		}
+
+		// Apply directly when confirmation is disabled. Without a plan to opt in from, email forwarding
+		// stays as the chat chose before.
+		if !cfg.SetupRequireConfirmation {
+			forwardEmail := forwardsEmail(st, req.Domain, chatIDInt)
+			err = setupTenant(ctx, auth0Client, cfg, st, logger, req.Domain, accessToken, chatIDInt, threadIDInt, link.AuthType,
+				forwardEmail)
+			if err != nil {
+				logger.Error("Failed to setup Auth0 action",
+					zap.Error(err),
+					zap.String("domain", req.Domain),
+					zap.Int64("chat_id", chatIDInt))
+				_ = telegramClient.EditMessageText(chatIDInt, messageIDInt, setupFailedMessage(err))
+				c.JSON(http.StatusInternalServerError, setupFailedResponse(err))
+				return
+			}
+			saveCredentials(credentials, logger, req.Domain, consented)
+
+			err = telegramClient.EditMessageText(chatIDInt, messageIDInt, setupCompletedMessage(req.Domain, forwardEmail))
+			if err != nil {
+				logger.Error("Failed to send success message",
+					zap.Error(err),
+					zap.Int64("chat_id", chatIDInt))
+				// Don't return error as the main setup was successful
+			}
+
+			c.JSON(http.StatusOK, gin.H{
+				"status":  "success",
+				"message": "Authentication and setup completed successfully",
+			})
 			return
 		}
 
-		// Send success message via Telegram
-		message := fmt.Sprintf(
-			"✅ Configuration completed successfully!\n\n"+
-				"Domain: %s\n"+
-				"Action: telegram-otp-action\n\n"+
-				"You will now receive OTP codes in this chat.",
-			req.Domain,
-		)
-
-		messageIDInt, _ := strconv.ParseInt(req.MessageID, 10, 64)
-		err = telegramClient.EditMessageText(chatIDInt, messageIDInt, message)
+		// Plan the changes, they are only applied once confirmed in Telegram
+		err = sendPlan(ctx, auth0Client, telegramClient, plans, req.Domain, accessToken, chatIDInt, threadIDInt, messageIDInt,
+			link.AuthType, consented)
 		if err != nil {
-			logger.Error("Failed to send success message",
+			logger.Error("Failed to plan Auth0 setup",
 				zap.Error(err),
+				zap.String("domain", req.Domain),
 				zap.Int64("chat_id", chatIDInt))
-			// Don't return error as the main setup was successful
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to plan Auth0 setup"})
+			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
 			"status":  "success",
-			"message": "Authentication and setup completed successfully",
+			"message": "Review the planned changes in Telegram and press Apply to continue",
 		})
 	}
 }
 
+// deviceFlowDefaultInterval is the polling interval when Auth0 does not return one, and the step
+// the interval grows by on slow_down, as RFC 8628 specifies
+const deviceFlowDefaultInterval = 5 * time.Second
+
+// pollForDeviceToken waits for the user to approve the device authorization, then continues the operation with
+// the token. It stops when the code expires or is denied, and when ctx is cancelled because setup was restarted.
 func pollForDeviceToken(
+	ctx context.Context,
 	client *auth0.Auth0Client,
+	telegramClient *telegram.Client,
 	cfg *config.Config,
+	st store.Store,
+	plans *PendingPlans,
 	logger *zap.Logger,
 	deviceCode *auth0.DeviceCodeResponse,
 	chatID int64,
+	threadID int64,
 	domain string,
+	operation string,
 ) {
-	telegramClient := telegram.NewClient(cfg.TelegramToken)
+	options := telegram.SendMessageOptions{ThreadID: threadID}
 	interval := time.Duration(deviceCode.Interval) * time.Second
+	if interval <= 0 {
+		interval = deviceFlowDefaultInterval
+	}
 	expiry := time.Now().Add(time.Duration(deviceCode.ExpiresIn) * time.Second)
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
-			if time.Now().After(expiry) {
-				message := "❌ Authentication process timed out. Please try again."
-				_ = telegramClient.SendMessage(chatID, message)
-				return
-			}
+		case <-ctx.Done():
+			logger.Info("Device authorization cancelled",
+				zap.String("domain", domain),
+				zap.Int64("chat_id", chatID))
+			return
+		case <-timer.C:
+		}
 
-			token, err := client.PollDeviceToken(domain, deviceCode.DeviceCode)
-			if err != nil {
-				// Check if it's just a pending authorization
-				if err == auth0.ErrAuthorizationPending {
-					continue
-				}
-				logger.Error("Failed to poll for device token",
-					zap.Error(err),
-					zap.String("domain", domain))
-				message := "❌ Authentication failed. Please try again."
-				_ = telegramClient.SendMessage(chatID, message)
-				return
-			}
+		if time.Now().After(expiry) {
+			message := "❌ Authentication process timed out. Please try again."
+			_ = telegramClient.SendMessageWithOptions(chatID, message, options)
+			return
+		}
 
-			// Successfully got token, create action
-			err = client.EnablePhoneExtensibility(domain, token.AccessToken, chatID, cfg)
-			if err != nil {
-				logger.Error("Failed to setup Auth0 action after device flow",
-					zap.Error(err),
-					zap.String("domain", domain))
-				message := "❌ Failed to setup Auth0 action. Please try again."
-				_ = telegramClient.SendMessage(chatID, message)
-				return
-			}
+		token, err := client.PollDeviceToken(ctx, domain, cfg.Auth0DeviceClientID, deviceCode.DeviceCode)
+		switch {
+		case errors.Is(err, auth0.ErrAuthorizationPending):
+			timer.Reset(interval)
+			continue
+
+		case errors.Is(err, auth0.ErrSlowDown):
+			interval += deviceFlowDefaultInterval
+			logger.Debug("Slowing down device token polling",
+				zap.Duration("interval", interval),
+				zap.String("domain", domain))
+			timer.Reset(interval)
+			continue
+
+		case errors.Is(err, auth0.ErrExpiredToken):
+			message := "❌ The device code expired before it was approved. Please run /start again."
+			_ = telegramClient.SendMessageWithOptions(chatID, message, options)
+			return
 
-			// Send success message
-			message := fmt.Sprintf(
-				"✅ Configuration completed successfully!\n\n"+
-					"Domain: %s\n"+
-					"Action: telegram-otp-action-%d\n\n"+
-					"You will now receive OTP codes in this chat.",
-				domain, chatID,
-			)
-			_ = telegramClient.SendMessage(chatID, message)
+		case errors.Is(err, auth0.ErrAccessDenied):
+			message := "❌ The authorization request was denied. Nothing was changed."
+			_ = telegramClient.SendMessageWithOptions(chatID, message, options)
 			return
+
+		case err != nil:
+			logger.Error("Failed to poll for device token",
+				zap.Error(err),
+				zap.String("domain", domain))
+			message := "❌ Authentication failed. Please try again."
+			_ = telegramClient.SendMessageWithOptions(chatID, message, options)
+			return
+		}
+
+		if operation != operationSetup {
+			_ = completeTenantOperation(ctx, client, telegramClient, cfg, st, logger, operation, domain,
+				token.AccessToken, chatID, threadID, 0, "tenant_personal")
+			return
+		}
+
+		// Successfully got token, plan the changes
+		err = sendPlan(ctx, client, telegramClient, plans, domain, token.AccessToken, chatID, threadID, 0, "tenant_personal", nil)
+		if err != nil {
+			logger.Error("Failed to plan Auth0 setup after device flow",
+				zap.Error(err),
+				zap.String("domain", domain))
+			message := "❌ Failed to read the Auth0 configuration. Please try again."
+			_ = telegramClient.SendMessageWithOptions(chatID, message, options)
 		}
+		return
+	}
+}
+
+func isValidOperation(operation string) bool {
+	switch operation {
+	case operationSetup, operationDisconnect, operationRotate, operationStatus, operationResync, operationRepair:
+		return true
+	}
+	return false
+}
+
+// claimAuthLink marks the link used and answers the request when it was used before
+func claimAuthLink(c *gin.Context, cfg *config.Config, st store.Store, logger *zap.Logger, link *authFormLink,
+	session string) bool {
+	err := useAuthLink(cfg, st, link, session)
+	if errors.Is(err, errLinkUsed) {
+		c.JSON(http.StatusGone, gin.H{"error": linkUsedError})
+		return false
+	}
+	if err != nil {
+		logger.Error("Failed to use auth form link",
+			zap.Error(err),
+			zap.Int64("chat_id", link.ChatID))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		return false
 	}
+	return true
 }
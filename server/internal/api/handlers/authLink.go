@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+)
+
+var (
+	// errLinkExpired is returned for auth-form links older than AUTH_FORM_LINK_TTL
+	errLinkExpired = errors.New("auth-form link expired")
+	// errLinkUsed is returned for auth-form links that were submitted, or opened in another browser
+	errLinkUsed = errors.New("auth-form link was already used")
+	// errLinkSignature is returned for auth-form links that were not issued by the bot
+	errLinkSignature = errors.New("invalid auth-form link signature")
+)
+
+// authFormLink is the signed content of an auth-form link
+type authFormLink struct {
+	ChatID    int64
+	ThreadID  int64 // Forum topic the link was requested from
+	UserID    int64 // User who requested the link
+	MessageID int64
+	AuthType  string
+	Operation string
+	Domain    string // Set when the link was issued for a specific tenant
+	IssuedAt  time.Time
+	Nonce     string
+}
+
+// values returns the query parameters of the link, except its signature
+func (l *authFormLink) values() url.Values {
+	query := url.Values{}
+	query.Set("chat_id", strconv.FormatInt(l.ChatID, 10))
+	query.Set("user_id", strconv.FormatInt(l.UserID, 10))
+	query.Set("message_id", strconv.FormatInt(l.MessageID, 10))
+	query.Set("auth_type", l.AuthType)
+	query.Set("operation", l.Operation)
+	query.Set("issued_at", strconv.FormatInt(l.IssuedAt.Unix(), 10))
+	query.Set("nonce", l.Nonce)
+	if l.ThreadID != 0 {
+		query.Set("thread_id", strconv.FormatInt(l.ThreadID, 10))
+	}
+	if l.Domain != "" {
+		query.Set("domain", l.Domain)
+	}
+	return query
+}
+
+// payload is the value signed into the link, its encoded query parameters in key order
+func (l *authFormLink) payload() string {
+	return "auth-form:" + l.values().Encode()
+}
+
+// expiresAt is when the link stops being accepted
+func (l *authFormLink) expiresAt(cfg *config.Config) time.Time {
+	return l.IssuedAt.Add(cfg.AuthFormLinkTTL)
+}
+
+// authFormURL builds a signed, single-use link to the auth form for a chat, user and operation. A non-zero
+// threadID is the forum topic the link was requested from, a non-empty domain restricts the link to that tenant.
+func authFormURL(cfg *config.Config, chatID, threadID, userID, messageID int64, authType string, operation string,
+	domain string) string {
+	link := &authFormLink{
+		ChatID:    chatID,
+		ThreadID:  threadID,
+		UserID:    userID,
+		MessageID: messageID,
+		AuthType:  authType,
+		Operation: operation,
+		Domain:    domain,
+		IssuedAt:  time.Now(),
+		Nonce:     utils.GenerateRandomString(16),
+	}
+
+	query := link.values()
+	query.Set("signature", utils.GenerateHMAC(link.payload(), cfg.HMACKeys.Active().Secret))
+
+	return fmt.Sprintf("%s/bot/auth-form?%s", cfg.BaseURL, query.Encode())
+}
+
+// parseAuthFormLink verifies the signature and expiry of a link's query parameters and returns its content
+func parseAuthFormLink(cfg *config.Config, query url.Values) (*authFormLink, error) {
+	link := &authFormLink{
+		AuthType:  query.Get("auth_type"),
+		Operation: query.Get("operation"),
+		Domain:    query.Get("domain"),
+		Nonce:     query.Get("nonce"),
+	}
+
+	var err error
+	if link.ChatID, err = strconv.ParseInt(query.Get("chat_id"), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid chat ID: %w", err)
+	}
+	if link.UserID, err = strconv.ParseInt(query.Get("user_id"), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid user ID: %w", err)
+	}
+	if link.MessageID, err = strconv.ParseInt(query.Get("message_id"), 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid message ID: %w", err)
+	}
+	if threadID := query.Get("thread_id"); threadID != "" {
+		if link.ThreadID, err = strconv.ParseInt(threadID, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid thread ID: %w", err)
+		}
+	}
+	issuedAt, err := strconv.ParseInt(query.Get("issued_at"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid issue time: %w", err)
+	}
+	link.IssuedAt = time.Unix(issuedAt, 0)
+
+	if link.AuthType == "" || link.Nonce == "" || !isValidOperation(link.Operation) ||
+		(link.Domain != "" && !utils.IsValidDomain(link.Domain)) {
+		return nil, errors.New("invalid link parameters")
+	}
+
+	if !utils.ValidateHMAC(link.payload(), query.Get("signature"), cfg.HMACKeys.Secrets()...) {
+		return nil, errLinkSignature
+	}
+
+	if time.Now().After(link.expiresAt(cfg)) {
+		return link, errLinkExpired
+	}
+	return link, nil
+}
+
+// authSession identifies the browser session of a CSRF token without storing the token
+func authSession(csrfToken string) string {
+	sum := sha256.Sum256([]byte(csrfToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// openAuthLink claims a link for the browser session opening it. Reloading the form in that browser keeps
+// working, any other browser gets errLinkUsed. It reports whether the link was opened for the first time.
+func openAuthLink(cfg *config.Config, st store.Store, link *authFormLink, session string) (bool, error) {
+	var first bool
+	err := st.UpdateAuthLink(link.Nonce, func(stored *store.AuthLink) error {
+		if stored.UsedAt != nil || (stored.Session != "" && stored.Session != session) {
+			return errLinkUsed
+		}
+		first = stored.Session == ""
+		stored.Session = session
+		stored.ExpiresAt = link.expiresAt(cfg)
+		return nil
+	})
+	return first, err
+}
+
+// useAuthLink marks a link as used by the browser session that opened it, so it cannot be submitted again
+func useAuthLink(cfg *config.Config, st store.Store, link *authFormLink, session string) error {
+	return st.UpdateAuthLink(link.Nonce, func(stored *store.AuthLink) error {
+		if stored.UsedAt != nil || stored.Session != session {
+			return errLinkUsed
+		}
+		now := time.Now().UTC()
+		stored.UsedAt = &now
+		stored.ExpiresAt = link.expiresAt(cfg)
+		return nil
+	})
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testAuthLink issues an auth-form link and returns its query parameters
+func testAuthLink(t *testing.T, cfg *config.Config, chatID, userID int64, authType string) url.Values {
+	link, err := url.Parse(authFormURL(cfg, chatID, 0, userID, 1, authType, operationSetup, ""))
+	require.NoError(t, err)
+	return link.Query()
+}
+
+// submitAuthForm posts the auth form opened from a link, from the browser holding csrfToken
+func submitAuthForm(t *testing.T, cfg *config.Config, st store.Store, query url.Values,
+	csrfToken string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/bot/auth-form", ProcessAuthForm(cfg, st, NewPendingPlans(time.Minute),
+		NewDeviceFlows(context.Background()), vault.New(st, false, nil), nil, zap.NewNop()))
+
+	body, err := json.Marshal(map[string]string{
+		"chat_id":    query.Get("chat_id"),
+		"user_id":    query.Get("user_id"),
+		"message_id": query.Get("message_id"),
+		"auth_type":  query.Get("auth_type"),
+		"operation":  query.Get("operation"),
+		"issued_at":  query.Get("issued_at"),
+		"nonce":      query.Get("nonce"),
+		"signature":  query.Get("signature"),
+		"domain":     "test.auth0.com",
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/bot/auth-form", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-CSRF-Token", csrfToken)
+	req.AddCookie(&http.Cookie{Name: "csrf_token", Value: csrfToken})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestParseAuthFormLink(t *testing.T) {
+	cfg := testConfig(t)
+	query := testAuthLink(t, cfg, testGroupID, testUserID, "auth_client_credentials")
+
+	link, err := parseAuthFormLink(cfg, query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(testGroupID), link.ChatID)
+	assert.Equal(t, int64(testUserID), link.UserID)
+
+	query.Set("user_id", "8")
+	_, err = parseAuthFormLink(cfg, query)
+	assert.ErrorIs(t, err, errLinkSignature)
+}
+
+func TestParseAuthFormLinkRejectsExpiredLinks(t *testing.T) {
+	cfg := testConfig(t)
+	query := testAuthLink(t, cfg, testGroupID, testUserID, "auth_client_credentials")
+
+	cfg.AuthFormLinkTTL = time.Nanosecond
+	_, err := parseAuthFormLink(cfg, query)
+	assert.ErrorIs(t, err, errLinkExpired)
+}
+
+func TestAuthLinkIsBoundToTheFirstBrowser(t *testing.T) {
+	cfg := testConfig(t)
+	st := store.NewMemoryStore()
+	link, err := parseAuthFormLink(cfg, testAuthLink(t, cfg, testGroupID, testUserID, "auth_client_credentials"))
+	require.NoError(t, err)
+
+	first, err := openAuthLink(cfg, st, link, "browser")
+	require.NoError(t, err)
+	assert.True(t, first)
+
+	first, err = openAuthLink(cfg, st, link, "browser")
+	require.NoError(t, err)
+	assert.False(t, first, "reloading the form")
+
+	_, err = openAuthLink(cfg, st, link, "other browser")
+	assert.ErrorIs(t, err, errLinkUsed)
+	assert.ErrorIs(t, useAuthLink(cfg, st, link, "other browser"), errLinkUsed)
+
+	require.NoError(t, useAuthLink(cfg, st, link, "browser"))
+	_, err = openAuthLink(cfg, st, link, "browser")
+	assert.ErrorIs(t, err, errLinkUsed, "after submitting the form")
+}
+
+func TestAuthFormRejectsExpiredLinks(t *testing.T) {
+	cfg := testConfig(t)
+	query := testAuthLink(t, cfg, testUserID, testUserID, "auth_client_credentials")
+	cfg.AuthFormLinkTTL = time.Nanosecond
+
+	recorder := submitAuthForm(t, cfg, store.NewMemoryStore(), query, "csrf")
+
+	assert.Equal(t, http.StatusGone, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), linkExpiredError)
+}
+
+func TestAuthFormRejectsReusedLinks(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Auth0DeviceClientID = "device-client"
+	st := store.NewMemoryStore()
+	query := testAuthLink(t, cfg, testUserID, testUserID, "tenant_personal")
+
+	link, err := parseAuthFormLink(cfg, query)
+	require.NoError(t, err)
+	_, err = openAuthLink(cfg, st, link, authSession("csrf"))
+	require.NoError(t, err)
+	require.NoError(t, useAuthLink(cfg, st, link, authSession("csrf")))
+
+	recorder := submitAuthForm(t, cfg, st, query, "csrf")
+
+	assert.Equal(t, http.StatusGone, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), linkUsedError)
+}
+
+func TestAuthFormRejectsLinksOpenedInAnotherBrowser(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Auth0DeviceClientID = "device-client"
+	st := store.NewMemoryStore()
+	query := testAuthLink(t, cfg, testUserID, testUserID, "tenant_personal")
+
+	link, err := parseAuthFormLink(cfg, query)
+	require.NoError(t, err)
+	_, err = openAuthLink(cfg, st, link, authSession("first browser"))
+	require.NoError(t, err)
+
+	recorder := submitAuthForm(t, cfg, st, query, "csrf")
+
+	assert.Equal(t, http.StatusGone, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), linkUsedError)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"go.uber.org/zap"
+)
+
+// callbackVersion prefixes the data of every button the bot sends. Buttons without it, or with an older
+// version, were sent by a previous deployment and their data may no longer mean the same thing.
+const callbackVersion = "v2"
+
+// callbackAnswer is shown to the user who pressed a button, as a toast or as an alert they have to dismiss.
+// An empty answer only stops the button's loading indicator.
+type callbackAnswer struct {
+	Text  string
+	Alert bool
+}
+
+var (
+	answerFailed     = callbackAnswer{Text: "❌ Something went wrong. Please try again."}
+	answerNotAllowed = callbackAnswer{Text: notAllowedMessage, Alert: true}
+	answerStale      = callbackAnswer{
+		Text:  "This button is from an older version of the bot. Please run the command again.",
+		Alert: true,
+	}
+)
+
+// callbackData builds the versioned data of a button, e.g. "v2:settings:retention:15m"
+func callbackData(action string, args ...string) string {
+	return strings.Join(append([]string{callbackVersion, action}, args...), ":")
+}
+
+// parseCallbackData splits button data into its action and the remaining arguments.
+// ok is false for data that was not built by callbackData of this version.
+func parseCallbackData(data string) (action, args string, ok bool) {
+	version, rest, found := strings.Cut(data, ":")
+	if !found || version != callbackVersion {
+		return "", "", false
+	}
+	action, args, _ = strings.Cut(rest, ":")
+	return action, args, action != ""
+}
+
+// handleAuthCallback replaces the /start, /disconnect and /rotate menus with the auth-form link for the chosen operation
+func handleAuthCallback(env *botEnv, req *botRequest) callbackAnswer {
+	action := req.Action
+	chatID, threadID, userID, messageID := req.ChatID, req.ThreadID, req.UserID, req.MessageID
+	cfg, client := env.Config, env.Telegram
+
+	var err error
+
+	switch action {
+	case "tenant_personal":
+		authURL := authFormURL(cfg, chatID, threadID, userID, messageID, action, operationSetup, "")
+
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{authFormButton(cfg, "Complete Authentication", authURL)},
+			},
+		}
+
+		err = client.EditMessageText(chatID, messageID, "Please complete your authentication using the form below:", keyboard)
+
+	case "tenant_private":
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{
+					{
+						Text:         "Ephemeral Access Token",
+						CallbackData: callbackData("auth_ephemeral"),
+					},
+				},
+				{
+					{
+						Text:         "ClientID and Client Credentials",
+						CallbackData: callbackData("auth_client_credentials"),
+					},
+				},
+			},
+		}
+
+		err = client.EditMessageText(chatID, messageID, "How would you like to authenticate?", keyboard)
+
+	case "auth_ephemeral", "auth_client_credentials":
+		authURL := authFormURL(cfg, chatID, threadID, userID, messageID, action, operationSetup, "")
+
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{authFormButton(cfg, "Complete Authentication", authURL)},
+			},
+		}
+
+		err = client.EditMessageText(chatID, messageID, "Please complete your authentication using the form below:", keyboard)
+
+	case "disconnect_auth_client_credentials":
+		authURL := authFormURL(cfg, chatID, threadID, userID, messageID, "auth_client_credentials", operationDisconnect, "")
+
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{authFormButton(cfg, "Disconnect Tenant", authURL)},
+			},
+		}
+
+		err = client.EditMessageText(chatID, messageID, "Please authenticate against the tenant to disconnect using the form below:", keyboard)
+
+	case "rotate_auth_client_credentials":
+		authURL := authFormURL(cfg, chatID, threadID, userID, messageID, "auth_client_credentials", operationRotate, "")
+
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{authFormButton(cfg, "Rotate Secrets", authURL)},
+			},
+		}
+
+		err = client.EditMessageText(chatID, messageID, "Please authenticate against the tenant to rotate using the form below:", keyboard)
+	}
+
+	if err != nil {
+		env.Logger.Error("Failed to send message",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID))
+		return answerFailed
+	}
+	return callbackAnswer{}
+}
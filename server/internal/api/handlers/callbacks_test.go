@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCallbackData(t *testing.T) {
+	action, args, ok := parseCallbackData(callbackData("settings", "retention", "15m"))
+	require.True(t, ok)
+	assert.Equal(t, "settings", action)
+	assert.Equal(t, "retention:15m", args)
+
+	for _, data := range []string{"settings", "v1:settings", "v2:", ""} {
+		_, _, ok := parseCallbackData(data)
+		assert.False(t, ok, data)
+	}
+}
+
+func TestStaleCallbacksAreAnsweredAndRemoved(t *testing.T) {
+	for _, data := range []string{"settings", "v1:settings", "v2:unknown"} {
+		t.Run(data, func(t *testing.T) {
+			env, fake := testBotEnv(t)
+
+			botRoutes.dispatch(context.Background(), env, callbackUpdate(testUserID, testUserID, data))
+
+			answers := fake.requests("answerCallbackQuery")
+			require.Len(t, answers, 1)
+			assert.Equal(t, answerStale.Text, answers[0].Body["text"])
+			assert.Equal(t, true, answers[0].Body["show_alert"])
+			assert.Len(t, fake.requests("editMessageReplyMarkup"), 1)
+		})
+	}
+}
+
+func TestCallbacksWithoutMessageAreStale(t *testing.T) {
+	env, fake := testBotEnv(t)
+	update := callbackUpdate(testUserID, testUserID, callbackData("settings"))
+	update.CallbackQuery.Message = nil
+
+	botRoutes.dispatch(context.Background(), env, update)
+
+	assert.Equal(t, []string{answerStale.Text}, fake.answers())
+}
+
+func TestAnswerNowAnswersBeforeTheHandlerFinishes(t *testing.T) {
+	env, fake := testBotEnv(t)
+	r := newBotRouter()
+	r.Callback("slow", func(env *botEnv, req *botRequest) callbackAnswer {
+		req.answerNow(env, callbackAnswer{Text: "Working on it"})
+		assert.Equal(t, []string{"Working on it"}, fake.answers())
+		return callbackAnswer{Text: "Done"}
+	})
+
+	r.dispatch(context.Background(), env, callbackUpdate(testUserID, testUserID, callbackData("slow")))
+
+	assert.Equal(t, []string{"Working on it"}, fake.answers(), "a press is answered once")
+}
+
+func TestExpiredPlanIsAnsweredRightAway(t *testing.T) {
+	env, fake := testBotEnv(t)
+
+	botRoutes.dispatch(context.Background(), env, callbackUpdate(testUserID, testUserID, callbackData("plan_apply", "gone")))
+
+	assert.Equal(t, []string{"This plan has expired."}, fake.answers())
+	edits := fake.requests("editMessageText")
+	require.Len(t, edits, 1)
+	assert.Contains(t, edits[0].Body["text"], "expired")
+}
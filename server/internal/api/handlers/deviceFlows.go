@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+// DeviceFlows tracks the device authorizations being polled, at most one per chat, so restarting setup
+// stops the previous poll
+type DeviceFlows struct {
+	mu     sync.Mutex
+	parent context.Context
+	flows  map[int64]*deviceFlow
+}
+
+type deviceFlow struct {
+	cancel context.CancelFunc
+}
+
+// NewDeviceFlows creates an empty tracker. Cancelling ctx stops every poll, e.g. at shutdown.
+func NewDeviceFlows(ctx context.Context) *DeviceFlows {
+	return &DeviceFlows{
+		parent: ctx,
+		flows:  make(map[int64]*deviceFlow),
+	}
+}
+
+// Start cancels the poll running for the chat and returns the context of a new one. done must be called
+// once the new poll ends.
+func (d *DeviceFlows) Start(chatID int64) (ctx context.Context, done func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if previous, ok := d.flows[chatID]; ok {
+		previous.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(d.parent)
+	flow := &deviceFlow{cancel: cancel}
+	d.flows[chatID] = flow
+
+	return ctx, func() {
+		cancel()
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.flows[chatID] == flow {
+			delete(d.flows, chatID)
+		}
+	}
+}
+
+// Cancel stops the poll running for the chat and reports whether there was one
+func (d *DeviceFlows) Cancel(chatID int64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	flow, ok := d.flows[chatID]
+	if ok {
+		flow.cancel()
+		delete(d.flows, chatID)
+	}
+	return ok
+}
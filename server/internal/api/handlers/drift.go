@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
+	"go.uber.org/zap"
+)
+
+// DriftReconciler periodically compares the connected tenants with the configuration setup applies, and reports
+// drift to the chat owning the tenant with a button to repair it. Reading a tenant needs a Management API token,
+// so only tenants with stored credentials are checked.
+type DriftReconciler struct {
+	cfg      *config.Config
+	store    store.Store
+	vault    *vault.Vault
+	auth0    *auth0.Auth0Client
+	telegram *telegram.Client
+	logger   *zap.Logger
+
+	// reported is the drift last reported per domain, so drift that did not change is not reported again
+	reported map[string]string
+}
+
+// NewDriftReconciler creates a reconciler checking every cfg.DriftCheckInterval
+func NewDriftReconciler(cfg *config.Config, st store.Store, credentials *vault.Vault, deletions *telegram.DeletionQueue,
+	logger *zap.Logger) *DriftReconciler {
+	return &DriftReconciler{
+		cfg:      cfg,
+		store:    st,
+		vault:    credentials,
+		auth0:    auth0.NewAuth0Client(),
+		telegram: telegram.NewClient(cfg.TelegramToken, deletions),
+		logger:   logger,
+		reported: make(map[string]string),
+	}
+}
+
+// Run checks the tenants every interval until ctx is cancelled. It returns right away when the checks are
+// disabled or no credentials can be stored.
+func (r *DriftReconciler) Run(ctx context.Context) {
+	if r.cfg.DriftCheckInterval <= 0 || !r.vault.Enabled() {
+		return
+	}
+
+	r.logger.Info("Checking tenants for drift", zap.Duration("interval", r.cfg.DriftCheckInterval))
+
+	ticker := time.NewTicker(r.cfg.DriftCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.CheckAll(ctx)
+		}
+	}
+}
+
+// CheckAll checks every registration once
+func (r *DriftReconciler) CheckAll(ctx context.Context) {
+	regs, err := r.store.ListRegistrations()
+	if err != nil {
+		r.logger.Error("Failed to list registrations", zap.Error(err))
+		return
+	}
+
+	connected := make(map[string]bool)
+	for _, reg := range regs {
+		if ctx.Err() != nil {
+			return
+		}
+		connected[reg.Domain] = true
+		r.check(ctx, reg)
+	}
+
+	// Disconnected tenants are reported again if they are connected again
+	for domain := range r.reported {
+		if !connected[domain] {
+			delete(r.reported, domain)
+		}
+	}
+}
+
+func (r *DriftReconciler) check(ctx context.Context, reg *store.Registration) {
+	if !r.vault.Has(reg.Domain) {
+		return
+	}
+
+	accessToken, err := r.vault.Token(ctx, reg.Domain)
+	if err != nil {
+		r.logger.Warn("Failed to get a token to check the tenant for drift",
+			zap.Error(err),
+			zap.String("domain", reg.Domain))
+		return
+	}
+
+	drifts, err := r.auth0.DetectPhoneDrift(ctx, reg.Domain, accessToken, reg.ForwardEmail)
+	if err != nil {
+		// A revoked token is renewed on the next check
+		if auth0.IsStatus(err, http.StatusUnauthorized) {
+			r.vault.Invalidate(reg.Domain)
+		}
+		r.logger.Warn("Failed to check the tenant for drift",
+			zap.Error(err),
+			zap.String("domain", reg.Domain))
+		return
+	}
+
+	fingerprint := driftFingerprint(drifts)
+	if fingerprint == r.reported[reg.Domain] {
+		return
+	}
+	if len(drifts) == 0 {
+		// Repaired, or changed back in the dashboard
+		delete(r.reported, reg.Domain)
+		return
+	}
+
+	r.logger.Warn("Tenant configuration drifted",
+		zap.String("domain", reg.Domain),
+		zap.Int64("chat_id", reg.ChatID),
+		zap.Int("drifts", len(drifts)))
+
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{{Text: "🛠 Repair " + tenantLabel(reg.Domain), CallbackData: tenantCallback("repair", reg)}},
+		},
+	}
+	err = r.telegram.SendMessageWithOptions(reg.ChatID, driftMessage(reg.Domain, drifts), telegram.SendMessageOptions{
+		Type:     config.MessageTypeDrift,
+		ThreadID: reg.ThreadID,
+	}, keyboard)
+	if err != nil {
+		// Not recorded as reported, so the next check tries again
+		r.logger.Error("Failed to report drift",
+			zap.Error(err),
+			zap.Int64("chat_id", reg.ChatID))
+		return
+	}
+	r.reported[reg.Domain] = fingerprint
+}
+
+// repairTenant reapplies only the parts of the setup that drifted on a tenant connected to the chat
+func repairTenant(ctx context.Context, client *auth0.Auth0Client, cfg *config.Config, st store.Store, logger *zap.Logger,
+	domain, accessToken string, chatID int64) (string, error) {
+	reg, err := connectedRegistration(st, domain, chatID)
+	if err != nil {
+		return "", err
+	}
+
+	// The tenant may have changed since the drift was reported, so it is read again
+	drifts, err := client.DetectPhoneDrift(ctx, domain, accessToken, reg.ForwardEmail)
+	if err != nil {
+		return "", err
+	}
+	if len(drifts) == 0 {
+		return fmt.Sprintf("✅ <code>%s</code> matches the OTPus configuration, there is nothing to repair.",
+			html.EscapeString(domain)), nil
+	}
+
+	actionIDs, err := client.RepairPhoneDrift(ctx, domain, accessToken, chatID, cfg, drifts)
+	if err != nil {
+		return "", err
+	}
+
+	// Recreated actions have new IDs
+	if len(actionIDs) > 0 {
+		ids := maps.Clone(reg.ActionIDs)
+		if ids == nil {
+			ids = make(map[string]string)
+		}
+		maps.Copy(ids, actionIDs)
+		saveRegistration(st, logger, domain, chatID, reg.ThreadID, reg.AuthType, ids, reg.KeyID, reg.ForwardEmail)
+	}
+
+	message := fmt.Sprintf("🛠 <b>%s</b> <code>%s</code> repaired:\n",
+		html.EscapeString(tenantLabel(domain)), html.EscapeString(domain))
+	for _, drift := range drifts {
+		message += "\n✅ " + html.EscapeString(drift.Detail)
+	}
+	return message, nil
+}
+
+// driftMessage reports the drift of a tenant to its chat
+func driftMessage(domain string, drifts []auth0.Drift) string {
+	message := fmt.Sprintf("⚠️ <b>%s</b> <code>%s</code> no longer matches the OTPus configuration, "+
+		"so OTPs may stop arriving:\n", html.EscapeString(tenantLabel(domain)), html.EscapeString(domain))
+	for _, drift := range drifts {
+		message += "\n• " + html.EscapeString(drift.Detail)
+	}
+	return message + "\n\nRepair reapplies only these parts of the configuration."
+}
+
+func driftFingerprint(drifts []auth0.Drift) string {
+	var details []string
+	for _, drift := range drifts {
+		details = append(details, drift.Kind+":"+drift.Trigger+":"+drift.Detail)
+	}
+	return strings.Join(details, "\n")
+}
@@ -1,22 +1,43 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/otp"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"html"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
 )
 
-// OTPEvent represents the incoming OTP event from Auth0
+// maxOTPWait caps the long-poll duration of the OTP pull API
+const maxOTPWait = 60 * time.Second
+
+const (
+	// maxMessageLength is the longest text Telegram accepts in a message, in UTF-16 code units
+	maxMessageLength = 4096
+	// maxRawBodyLength caps the email body shown in the raw event, the code and magic link are shown above it
+	maxRawBodyLength = 300
+)
+
+// OTPEvent represents the incoming OTP event from Auth0. Phone actions send the phone number and code,
+// the email action the email address and subject, and the code and magic link are read from the message.
 type OTPEvent struct {
 	TenantID    string                 `json:"tenant_id"`
 	Domain      string                 `json:"domain,omitempty"`
 	Code        string                 `json:"code"`
 	Message     string                 `json:"message"`
-	PhoneNumber string                 `json:"phone_number"`
+	PhoneNumber string                 `json:"phone_number,omitempty"`
+	Email       string                 `json:"email,omitempty"`
+	Subject     string                 `json:"subject,omitempty"`
+	MagicLink   string                 `json:"magic_link,omitempty"`
 	RawEvent    map[string]interface{} `json:"raw_event"`
 }
 
@@ -28,8 +49,9 @@ type TelegramMessageRequest struct {
 	DisableNotification bool   `json:"disable_notification,omitempty"`
 }
 
-func HandleOTPWebhook(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
-	telegramClient := telegram.NewClient(cfg.TelegramToken)
+func HandleOTPWebhook(cfg *config.Config, st store.Store, otps *otp.Buffer, deletions *telegram.DeletionQueue,
+	logger *zap.Logger) gin.HandlerFunc {
+	telegramClient := telegram.NewClient(cfg.TelegramToken, deletions)
 
 	return func(c *gin.Context) {
 		var event OTPEvent
@@ -59,11 +81,49 @@ func HandleOTPWebhook(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
 		}
 		chatID, _ := strconv.ParseInt(chatIDStr.(string), 10, 64)
 
+		if event.Email != "" {
+			if event.Code == "" {
+				event.Code = otp.ExtractCode(event.Message)
+			}
+			if event.MagicLink == "" {
+				event.MagicLink = otp.ExtractMagicLink(event.Message)
+			}
+		}
+
+		// Make the OTP available to the pull API, even if Telegram delivery fails
+		otps.Put(otp.Entry{
+			Domain:      domain.(string),
+			PhoneNumber: event.PhoneNumber,
+			Email:       event.Email,
+			Subject:     event.Subject,
+			Code:        event.Code,
+			MagicLink:   event.MagicLink,
+			Message:     event.Message,
+		})
+
+		// Tenants set up in a forum topic post there. Paused tenants keep feeding the pull API but stay quiet in the chat.
+		var threadID int64
+		if reg, err := st.GetRegistration(domain.(string)); err == nil && reg.ChatID == chatID {
+			if reg.Paused {
+				logger.Info("OTP not sent, tenant paused",
+					zap.String("tenant_id", event.TenantID),
+					zap.Int64("chat_id", chatID))
+				c.JSON(200, gin.H{"status": "paused"})
+				return
+			}
+			threadID = reg.ThreadID
+		}
+
 		// Prepare Telegram message
-		message := formatTelegramMessage(event)
+		settings := loadChatSettings(st, logger, chatID)
+		message := formatTelegramMessage(event, tenantLabel(domain.(string)), settings)
 
 		// Send to Telegram
-		err := telegramClient.SendMessage(chatID, message)
+		err := telegramClient.SendMessageWithOptions(chatID, message, telegram.SendMessageOptions{
+			Type:                config.MessageTypeOTP,
+			DisableNotification: settings.Silent,
+			ThreadID:            threadID,
+		})
 
 		if err != nil {
 			logger.Error("Failed to send Telegram message",
@@ -75,26 +135,216 @@ func HandleOTPWebhook(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
 
 		logger.Info("OTP message sent successfully",
 			zap.String("tenant_id", event.TenantID),
-			zap.Int64("chat_id", chatID))
+			zap.Int64("chat_id", chatID),
+			zap.Int64("thread_id", threadID))
 
 		c.JSON(200, gin.H{"status": "ok"})
 	}
 }
 
-// formatTelegramMessage creates a formatted message for Telegram
-func formatTelegramMessage(event OTPEvent) string {
+// GetLatestOTP returns the latest OTP sent to a phone number or email address, optionally long-polling until
+// one arrives
+func GetLatestOTP(otps *otp.Buffer, logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		domain := c.Query("domain")
+		recipient := c.Query("phone")
+		if recipient == "" {
+			recipient = c.Query("email")
+		}
+		if domain == "" || recipient == "" {
+			c.JSON(400, gin.H{"error": "domain and phone or email are required"})
+			return
+		}
+
+		var wait time.Duration
+		if waitStr := c.Query("wait"); waitStr != "" {
+			var err error
+			if wait, err = parseWait(waitStr); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid wait value"})
+				return
+			}
+		}
+
+		// Only consider OTPs received after "since", so callers can skip codes from earlier attempts
+		var since time.Time
+		if sinceStr := c.Query("since"); sinceStr != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339Nano, sinceStr); err != nil {
+				c.JSON(400, gin.H{"error": "Invalid since value, expected RFC3339"})
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), wait)
+		defer cancel()
+
+		entry := otps.Latest(ctx, domain, recipient, since)
+		if entry == nil {
+			logger.Debug("No OTP available",
+				zap.String("domain", domain),
+				zap.Duration("wait", wait))
+			c.JSON(404, gin.H{"error": "No OTP received"})
+			return
+		}
+
+		c.JSON(200, entry)
+	}
+}
+
+// parseWait accepts a Go duration ("30s") or a number of seconds ("30")
+func parseWait(value string) (time.Duration, error) {
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.Atoi(value)
+		if convErr != nil {
+			return 0, err
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	if wait < 0 {
+		return 0, fmt.Errorf("negative wait")
+	}
+	if wait > maxOTPWait {
+		wait = maxOTPWait
+	}
+	return wait, nil
+}
+
+// formatTelegramMessage creates a formatted message for Telegram using the chat's template and settings.
+// The tenant label tells OTPs of several tenants sharing a chat apart.
+func formatTelegramMessage(event OTPEvent, label string, settings *store.ChatSettings) string {
+	if event.Email != "" {
+		return formatEmailMessage(event, label, settings)
+	}
+
 	jsonData, _ := json.MarshalIndent(event, "", "  ")
-	return fmt.Sprintf(
-		""+
-			"Domain: <code>%s</code>\n\n"+
-			"Recipent: <code>%s</code>\n"+
+	rawEvent := string(jsonData)
+	phoneNumber := event.PhoneNumber
+	message := event.Message
+
+	// The number also appears in the raw event, and sometimes in the message
+	if settings.MaskPhone && phoneNumber != "" {
+		masked := maskPhoneNumber(phoneNumber)
+		rawEvent = strings.ReplaceAll(rawEvent, phoneNumber, masked)
+		message = strings.ReplaceAll(message, phoneNumber, masked)
+		phoneNumber = masked
+	}
+	code, domain := html.EscapeString(event.Code), html.EscapeString(event.Domain)
+	phoneNumber, message = html.EscapeString(phoneNumber), html.EscapeString(message)
+
+	var text string
+	switch settings.Template {
+	case templateCode:
+		text = fmt.Sprintf("<b><code>%s</code></b>", code)
+	case templateCompact:
+		text = fmt.Sprintf(
 			"Code: <b><code>%s</code></b>\n"+
-			"Message: <code>%s</code>\n\n"+
-			"<blockquote expandable>\n<b>All details:</b>\n\n👇👇👇\n\n%s</blockquote>",
-		event.Domain,
-		event.PhoneNumber,
-		event.Code,
-		event.Message,
-		jsonData,
-	)
+				"<code>%s</code> · <code>%s</code>",
+			code,
+			phoneNumber,
+			domain,
+		)
+	default:
+		text = fmt.Sprintf(
+			""+
+				"Domain: <code>%s</code>\n\n"+
+				"Recipent: <code>%s</code>\n"+
+				"Code: <b><code>%s</code></b>\n"+
+				"Message: <code>%s</code>",
+			domain,
+			phoneNumber,
+			code,
+			message,
+		)
+	}
+
+	return withLabelAndRawEvent(text, label, html.EscapeString(rawEvent), settings)
+}
+
+// formatEmailMessage formats a forwarded email. The code and magic link are read from the message, and the
+// message itself is only part of the raw event, since emails are longer than SMS.
+func formatEmailMessage(event OTPEvent, label string, settings *store.ChatSettings) string {
+	raw := event
+	raw.Message = truncate(raw.Message, maxRawBodyLength)
+	jsonData, _ := json.MarshalIndent(raw, "", "  ")
+	rawEvent := html.EscapeString(string(jsonData))
+
+	code := "(none)"
+	if event.Code != "" {
+		code = fmt.Sprintf("<b><code>%s</code></b>", html.EscapeString(event.Code))
+	}
+	var link string
+	if event.MagicLink != "" {
+		link = fmt.Sprintf("<a href=\"%s\">🔗 Magic link</a>", html.EscapeString(event.MagicLink))
+	}
+
+	var text string
+	switch settings.Template {
+	case templateCode:
+		text = code
+		if event.Code == "" && link != "" {
+			text = link
+		}
+	case templateCompact:
+		text = fmt.Sprintf(
+			"Code: %s\n"+
+				"<code>%s</code> · <code>%s</code>",
+			code,
+			html.EscapeString(event.Email),
+			html.EscapeString(event.Domain),
+		)
+		if link != "" {
+			text += "\n" + link
+		}
+	default:
+		text = fmt.Sprintf(
+			""+
+				"Domain: <code>%s</code>\n\n"+
+				"Subject: <b>%s</b>\n"+
+				"Recipient: <code>%s</code>\n"+
+				"Code: %s",
+			html.EscapeString(event.Domain),
+			html.EscapeString(event.Subject),
+			html.EscapeString(event.Email),
+			code,
+		)
+		if link != "" {
+			text += "\nMagic link: " + link
+		}
+	}
+
+	return withLabelAndRawEvent(text, label, rawEvent, settings)
+}
+
+// withLabelAndRawEvent adds the tenant label and, unless the chat hides it, the raw event to an OTP message.
+// The raw event is left out when it would make the message too long for Telegram.
+func withLabelAndRawEvent(text, label, rawEvent string, settings *store.ChatSettings) string {
+	text = fmt.Sprintf("🏷 <b>%s</b>\n", html.EscapeString(label)) + text
+
+	if settings.HideRawEvent {
+		return text
+	}
+	withRawEvent := text + fmt.Sprintf("\n\n<blockquote expandable>\n<b>All details:</b>\n\n👇👇👇\n\n%s</blockquote>", rawEvent)
+	if len(utf16.Encode([]rune(withRawEvent))) > maxMessageLength {
+		return text
+	}
+	return withRawEvent
+}
+
+// truncate shortens s to at most n runes, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
+
+// maskPhoneNumber hides all but the country prefix and the last digits of a phone number
+func maskPhoneNumber(phoneNumber string) string {
+	runes := []rune(phoneNumber)
+	if len(runes) <= 6 {
+		return strings.Repeat("•", len(runes))
+	}
+	return string(runes[:3]) + strings.Repeat("•", len(runes)-6) + string(runes[len(runes)-3:])
 }
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatEmailMessageFitsInTelegram(t *testing.T) {
+	event := OTPEvent{
+		Domain:    "test.auth0.com",
+		Email:     "user@example.com",
+		Subject:   "Verify your email",
+		Code:      "123456",
+		MagicLink: "https://test.auth0.com/passwordless/verify?code=123456",
+		Message:   "Your code is 123456. " + strings.Repeat("Lorem ipsum dolor sit amet. ", 500),
+	}
+
+	message := formatTelegramMessage(event, "test", &store.ChatSettings{})
+	assert.LessOrEqual(t, len(utf16.Encode([]rune(message))), maxMessageLength)
+	assert.Contains(t, message, "<code>123456</code>")
+	assert.Contains(t, message, "All details", "the body is shortened in the raw event")
+
+	// A raw event too long to fit is left out, the code and link still reach the chat
+	event.RawEvent = map[string]interface{}{"user": strings.Repeat("x", 2*maxMessageLength)}
+	message = formatTelegramMessage(event, "test", &store.ChatSettings{})
+	assert.LessOrEqual(t, len(utf16.Encode([]rune(message))), maxMessageLength)
+	assert.Contains(t, message, "<code>123456</code>")
+	assert.Contains(t, message, "Magic link")
+	assert.NotContains(t, message, "All details")
+}
+
+func TestFormatPhoneMessageEscapesHTML(t *testing.T) {
+	event := OTPEvent{
+		Domain:      "test.auth0.com",
+		PhoneNumber: "+15551234567",
+		Code:        "<123&456>",
+		Message:     "Your code is <123&456> for +15551234567",
+		RawEvent:    map[string]interface{}{"user": "<b>Tom & Jerry</b>"},
+	}
+
+	for _, template := range []string{templateFull, templateCompact, templateCode} {
+		message := formatTelegramMessage(event, "test", &store.ChatSettings{Template: template, MaskPhone: true})
+		assert.Contains(t, message, "&lt;123&amp;456&gt;", template)
+		assert.NotContains(t, message, "<123", template)
+		assert.NotContains(t, message, "<b>Tom", template)
+		assert.NotContains(t, message, "+15551234567", template)
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+)
+
+// PendingPlan is a setup plan waiting for the chat to press "Apply"
+type PendingPlan struct {
+	ID          string
+	ChatID      int64
+	ThreadID    int64
+	Domain      string
+	AuthType    string
+	AccessToken string
+	Credentials *tenantCredentials // Stored once applied, nil without the user's consent
+	Plan        *auth0.Plan
+	ExpiresAt   time.Time
+}
+
+// PendingPlans keeps the plans sent to Telegram in memory, so management tokens never reach the disk
+type PendingPlans struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	plans map[string]*PendingPlan
+}
+
+// NewPendingPlans creates a holder whose plans can be applied for ttl
+func NewPendingPlans(ttl time.Duration) *PendingPlans {
+	return &PendingPlans{
+		ttl:   ttl,
+		plans: make(map[string]*PendingPlan),
+	}
+}
+
+// Add stores a plan and returns its ID
+func (p *PendingPlans) Add(plan *PendingPlan) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for id, pending := range p.plans {
+		if now.After(pending.ExpiresAt) {
+			delete(p.plans, id)
+		}
+	}
+
+	plan.ID = utils.GenerateRandomString(16)
+	plan.ExpiresAt = now.Add(p.ttl)
+	p.plans[plan.ID] = plan
+	return plan.ID
+}
+
+// Take removes and returns a plan, if it exists, belongs to the chat and has not expired
+func (p *PendingPlans) Take(id string, chatID int64) (*PendingPlan, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	plan, ok := p.plans[id]
+	if !ok || plan.ChatID != chatID {
+		return nil, false
+	}
+	delete(p.plans, id)
+
+	if time.Now().After(plan.ExpiresAt) {
+		return nil, false
+	}
+	return plan, true
+}
+
+// formatPlan renders a plan as a Telegram HTML message
+func formatPlan(plan *auth0.Plan) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "📋 Planned changes for <code>%s</code>\n\n", html.EscapeString(plan.Domain))
+
+	writeOperations(&b, plan.Operations, 1)
+
+	switch {
+	case plan.EmailUnavailable != "":
+		fmt.Fprintf(&b, "\n📧 Email forwarding is not available: %s.\n", html.EscapeString(plan.EmailUnavailable))
+	case canForwardEmail(plan):
+		b.WriteString("\n📧 <b>Optional email forwarding</b>, only with <b>Apply with email forwarding</b>:\n")
+		writeOperations(&b, plan.EmailOperations, len(plan.Operations)+1)
+		b.WriteString("⚠️ Every email the tenant sends, not only codes and magic links, is then posted to this chat.\n")
+		if auth0.LosesEmailCredentials(plan.EmailProvider) {
+			fmt.Fprintf(&b, "⚠️ The current <b>%s</b> email provider is replaced. Auth0 never returns its credentials, "+
+				"so disconnecting cannot restore it: it is disabled and its credentials have to be entered again "+
+				"in the Auth0 dashboard.\n", html.EscapeString(plan.EmailProvider.Name))
+		}
+	}
+
+	b.WriteString("\nNothing has been changed yet. Press <b>Apply</b> to configure the tenant.")
+	return b.String()
+}
+
+// writeOperations lists operations, numbered from first
+func writeOperations(b *strings.Builder, operations []auth0.PlannedOperation, first int) {
+	for i, operation := range operations {
+		fmt.Fprintf(b, "%d. <b>%s</b> <code>%s</code>\n%s\n",
+			first+i, operation.Method, html.EscapeString(operation.Path), html.EscapeString(operation.Description))
+		if len(operation.Changes) == 0 && operation.Kind != "deploy" {
+			b.WriteString("   <i>no change</i>\n")
+		}
+		for _, change := range operation.Changes {
+			fmt.Fprintf(b, "   %s: <s>%s</s> → %s\n",
+				html.EscapeString(change.Field), html.EscapeString(orNone(change.From)), html.EscapeString(change.To))
+		}
+	}
+}
+
+// canForwardEmail reports whether the user can opt into email forwarding when applying a plan
+func canForwardEmail(plan *auth0.Plan) bool {
+	return plan.EmailUnavailable == "" && len(plan.EmailOperations) > 0
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
+
+// planKeyboard asks to apply or cancel a plan, offering email forwarding as a separate choice
+func planKeyboard(planID string, emailForwarding bool) *telegram.ReplyMarkup {
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{
+				{
+					Text:         "Apply",
+					CallbackData: callbackData("plan_apply", planID),
+				},
+				{
+					Text:         "Cancel",
+					CallbackData: callbackData("plan_cancel", planID),
+				},
+			},
+		},
+	}
+	if emailForwarding {
+		keyboard.InlineKeyboard = append(keyboard.InlineKeyboard, []telegram.InlineKeyboardButton{{
+			Text:         "📧 Apply with email forwarding",
+			CallbackData: callbackData("plan_email", planID),
+		}})
+	}
+	return keyboard
+}
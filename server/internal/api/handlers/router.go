@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
+	"go.uber.org/zap"
+)
+
+// botEnv holds the dependencies bot handlers share
+type botEnv struct {
+	Config      *config.Config
+	Store       store.Store
+	Plans       *PendingPlans
+	DeviceFlows *DeviceFlows
+	Vault       *vault.Vault
+	Auth0       *auth0.Auth0Client
+	Telegram    *telegram.Client
+	Logger      *zap.Logger
+}
+
+// botRequest is a command or a button press being handled
+type botRequest struct {
+	ctx context.Context
+
+	ChatID    int64
+	ThreadID  int64 // Forum topic replies go to
+	UserID    int64 // Zero for messages sent on behalf of a chat
+	MessageID int64 // The command message, or the message carrying the pressed button
+
+	Message *TelegramMessage
+	Query   *TelegramCallbackQuery // Nil for commands
+
+	Command string // Command without its slash, e.g. "start"
+	Action  string // Callback action, e.g. "settings"
+	Args    string // Text after the command, or callback data after the action
+
+	answered bool // Set once the button press was answered, see answerNow
+}
+
+// Context is cancelled when the server shuts down
+func (r *botRequest) Context() context.Context {
+	return r.ctx
+}
+
+// isCallback reports whether the request is a button press
+func (r *botRequest) isCallback() bool {
+	return r.Query != nil
+}
+
+// answerNow answers the button press before work that can outlast the few seconds Telegram waits for the answer,
+// e.g. calls to the Management API. The handler then reports its result by editing the message, as the answer
+// it returns is dropped.
+func (r *botRequest) answerNow(env *botEnv, answer callbackAnswer) {
+	if !r.isCallback() || r.answered {
+		return
+	}
+	r.answered = true
+	answerCallbackQuery(env, r.Query, answer)
+}
+
+// name identifies the command or callback action in logs
+func (r *botRequest) name() string {
+	if r.isCallback() {
+		return "callback:" + r.Action
+	}
+	return "/" + r.Command
+}
+
+// botHandler handles a request. For button presses the answer is shown to the user as a toast or alert,
+// for commands a non-empty answer is sent to the chat as a reply.
+type botHandler func(env *botEnv, req *botRequest) callbackAnswer
+
+// botMiddleware wraps a handler, e.g. to check permissions before calling it
+type botMiddleware func(next botHandler) botHandler
+
+type botCommand struct {
+	Name        string
+	Description string
+	Handler     botHandler
+}
+
+// botRouter routes commands by name and button presses by the action of their callback data
+type botRouter struct {
+	commands   []*botCommand
+	help       *botCommand
+	callbacks  map[string]botHandler
+	fallback   botHandler
+	middleware []botMiddleware
+}
+
+func newBotRouter() *botRouter {
+	r := &botRouter{
+		callbacks: map[string]botHandler{},
+		fallback:  handleStaleCallback,
+	}
+	r.help = &botCommand{Name: "help", Description: "Show the available commands", Handler: r.handleHelp}
+	return r
+}
+
+// Use adds middleware that wraps every handler, in the order it is added
+func (r *botRouter) Use(middleware ...botMiddleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Command registers a command, published in the bot's command menu and /help in registration order
+func (r *botRouter) Command(name, description string, handler botHandler) {
+	r.commands = append(r.commands, &botCommand{Name: name, Description: description, Handler: handler})
+}
+
+// Callback registers the handler for buttons whose callback data has the given action
+func (r *botRouter) Callback(action string, handler botHandler) {
+	r.callbacks[action] = handler
+}
+
+// Fallback sets the handler for buttons whose data is unversioned or has no registered action
+func (r *botRouter) Fallback(handler botHandler) {
+	r.fallback = handler
+}
+
+// Commands returns the command menu published to Telegram
+func (r *botRouter) Commands() []telegram.BotCommand {
+	var commands []telegram.BotCommand
+	for _, command := range r.allCommands() {
+		commands = append(commands, telegram.BotCommand{Command: command.Name, Description: command.Description})
+	}
+	return commands
+}
+
+// allCommands returns the registered commands followed by the generated /help
+func (r *botRouter) allCommands() []*botCommand {
+	return append(slices.Clip(r.commands), r.help)
+}
+
+func (r *botRouter) command(name string) *botCommand {
+	for _, command := range r.allCommands() {
+		if command.Name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+func (r *botRouter) run(env *botEnv, req *botRequest, handler botHandler) callbackAnswer {
+	for i := len(r.middleware) - 1; i >= 0; i-- {
+		handler = r.middleware[i](handler)
+	}
+	return handler(env, req)
+}
+
+// dispatch routes an update to its handler, whether it arrived through the webhook or polling
+func (r *botRouter) dispatch(ctx context.Context, env *botEnv, update *TelegramUpdate) {
+	if update.CallbackQuery != nil {
+		r.handleCallbackQuery(ctx, env, update.CallbackQuery)
+		return
+	}
+
+	if update.Message != nil {
+		if update.Message.MigrateToChatID != 0 {
+			migrateChat(update.Message.Chat.ID, update.Message.MigrateToChatID, env.Store, env.Telegram, env.Logger)
+			return
+		}
+		r.handleMessage(ctx, env, update.Message)
+	}
+}
+
+func (r *botRouter) handleMessage(ctx context.Context, env *botEnv, message *TelegramMessage) {
+	// Commands in groups are addressed as /command@BotName
+	username, err := env.Telegram.Username()
+	if err != nil {
+		env.Logger.Warn("Failed to read the bot username", zap.Error(err))
+	}
+	name, args, ok := telegram.ParseCommand(message.Text, username)
+	if !ok {
+		return
+	}
+
+	command := r.command(strings.TrimPrefix(name, "/"))
+	if command == nil {
+		return
+	}
+
+	req := &botRequest{
+		ctx:       ctx,
+		ChatID:    message.Chat.ID,
+		ThreadID:  topicID(message),
+		MessageID: message.MessageID,
+		Message:   message,
+		Command:   command.Name,
+		Args:      args,
+	}
+	if message.From != nil {
+		req.UserID = message.From.ID
+	}
+
+	if answer := r.run(env, req, command.Handler); answer.Text != "" {
+		sendReply(env, req, answer.Text, nil)
+	}
+}
+
+// handleCallbackQuery routes a button press to its handler and always answers the query,
+// so the button never keeps spinning in the user's client
+func (r *botRouter) handleCallbackQuery(ctx context.Context, env *botEnv, query *TelegramCallbackQuery) {
+	// Telegram omits the message when it is too old to be edited
+	if query.Message == nil {
+		answerCallbackQuery(env, query, answerStale)
+		return
+	}
+
+	req := &botRequest{
+		ctx:       ctx,
+		ChatID:    query.Message.Chat.ID,
+		ThreadID:  topicID(query.Message),
+		UserID:    query.From.ID,
+		MessageID: query.Message.MessageID,
+		Message:   query.Message,
+		Query:     query,
+	}
+
+	handler := r.fallback
+	if action, args, ok := parseCallbackData(query.Data); ok {
+		req.Action, req.Args = action, args
+		if registered, found := r.callbacks[action]; found {
+			handler = registered
+		}
+	}
+	answer := r.run(env, req, handler)
+	if !req.answered {
+		answerCallbackQuery(env, query, answer)
+	}
+}
+
+// answerCallbackQuery shows the answer to the user who pressed a button and stops its loading indicator
+func answerCallbackQuery(env *botEnv, query *TelegramCallbackQuery, answer callbackAnswer) {
+	if err := env.Telegram.AnswerCallbackQuery(query.ID, answer.Text, answer.Alert); err != nil {
+		env.Logger.Error("Failed to answer callback query",
+			zap.Error(err),
+			zap.Int64("user_id", query.From.ID))
+	}
+}
+
+// handleHelp lists the commands, or describes the command given as argument
+func (r *botRouter) handleHelp(env *botEnv, req *botRequest) callbackAnswer {
+	if name := strings.TrimPrefix(req.Args, "/"); name != "" {
+		if command := r.command(name); command != nil {
+			return callbackAnswer{Text: fmt.Sprintf("/%s: %s", command.Name, html.EscapeString(command.Description))}
+		}
+		return callbackAnswer{Text: fmt.Sprintf("Unknown command <code>%s</code>. Send /help for the list of commands.",
+			html.EscapeString(name))}
+	}
+
+	text := "🤖 <b>OTPus commands</b>\n"
+	for _, command := range r.allCommands() {
+		text += fmt.Sprintf("\n/%s: %s", command.Name, html.EscapeString(command.Description))
+	}
+	return callbackAnswer{Text: text}
+}
+
+// handleStaleCallback answers buttons whose data was not built by this version of the bot and removes
+// them from the message, so they are not pressed again
+func handleStaleCallback(env *botEnv, req *botRequest) callbackAnswer {
+	env.Logger.Info("Stale callback data",
+		zap.Int64("chat_id", req.ChatID),
+		zap.String("data", req.Query.Data))
+
+	if err := env.Telegram.EditMessageReplyMarkup(req.ChatID, req.MessageID, nil); err != nil {
+		env.Logger.Warn("Failed to remove stale buttons",
+			zap.Error(err),
+			zap.Int64("chat_id", req.ChatID))
+	}
+	return answerStale
+}
+
+// recoverPanics turns a panicking handler into a failed answer, so one update cannot crash the server
+func recoverPanics(next botHandler) botHandler {
+	return func(env *botEnv, req *botRequest) (answer callbackAnswer) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				env.Logger.Error("Bot handler panicked",
+					zap.Any("panic", recovered),
+					zap.String("handler", req.name()),
+					zap.Int64("chat_id", req.ChatID),
+					zap.ByteString("stack", debug.Stack()))
+				answer = answerFailed
+			}
+		}()
+		return next(env, req)
+	}
+}
+
+// logRequests logs every command and button press with how long it took to handle
+func logRequests(next botHandler) botHandler {
+	return func(env *botEnv, req *botRequest) callbackAnswer {
+		start := time.Now()
+		answer := next(env, req)
+		env.Logger.Info("Handled bot request",
+			zap.String("handler", req.name()),
+			zap.Int64("chat_id", req.ChatID),
+			zap.Int64("user_id", req.UserID),
+			zap.Duration("duration", time.Since(start)))
+		return answer
+	}
+}
+
+// requireAdmin only runs the handler for users who may configure the chat, see canConfigure
+func requireAdmin(next botHandler) botHandler {
+	return func(env *botEnv, req *botRequest) callbackAnswer {
+		var allowed bool
+		if req.isCallback() {
+			// Buttons can be pressed by any member of a group
+			var err error
+			allowed, err = canConfigure(env.Config, env.Telegram, req.ChatID, req.UserID)
+			if err != nil {
+				env.Logger.Error("Failed to check chat member",
+					zap.Error(err),
+					zap.Int64("chat_id", req.ChatID),
+					zap.Int64("user_id", req.UserID))
+			}
+		} else {
+			allowed = messageFromAdmin(req.Message, env.Config, env.Telegram, env.Logger)
+		}
+
+		if !allowed {
+			env.Logger.Warn("Request from a user who may not configure the chat",
+				zap.String("handler", req.name()),
+				zap.Int64("chat_id", req.ChatID),
+				zap.Int64("user_id", req.UserID))
+			return answerNotAllowed
+		}
+		return next(env, req)
+	}
+}
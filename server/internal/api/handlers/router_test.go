@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// telegramCall is a Bot API request received by fakeTelegram
+type telegramCall struct {
+	Method string
+	Body   map[string]interface{}
+}
+
+// fakeTelegram is a Bot API server that records the requests of the bot
+type fakeTelegram struct {
+	mu           sync.Mutex
+	calls        []telegramCall
+	memberStatus string // Status getChatMember returns for every user
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call := telegramCall{Method: path.Base(r.URL.Path)}
+	_ = json.NewDecoder(r.Body).Decode(&call.Body)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	status := f.memberStatus
+	f.mu.Unlock()
+
+	var result interface{} = true
+	switch call.Method {
+	case "getMe":
+		result = map[string]interface{}{"id": 1, "is_bot": true, "username": "OTPusBot"}
+	case "getChatMember":
+		result = map[string]interface{}{"status": status, "user": map[string]interface{}{"id": call.Body["user_id"]}}
+	case "sendMessage", "editMessageText":
+		result = map[string]interface{}{"message_id": 1, "chat": map[string]interface{}{"id": call.Body["chat_id"]}}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
+
+// requests returns the recorded requests to a Bot API method
+func (f *fakeTelegram) requests(method string) []telegramCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var calls []telegramCall
+	for _, call := range f.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// answers returns the texts the bot answered button presses with
+func (f *fakeTelegram) answers() []string {
+	var texts []string
+	for _, call := range f.requests("answerCallbackQuery") {
+		text, _ := call.Body["text"].(string)
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func testConfig(t *testing.T) *config.Config {
+	keyring, err := utils.NewKeyring([]utils.HMACKey{{ID: config.DefaultHMACKeyID, Secret: "s3cr3t"}},
+		config.DefaultHMACKeyID)
+	require.NoError(t, err)
+
+	return &config.Config{
+		BaseURL:         "https://otpus.example.com",
+		HMACKeys:        keyring,
+		AuthFormLinkTTL: 10 * time.Minute,
+	}
+}
+
+// testBotEnv returns handler dependencies backed by a memory store and a fake Telegram server
+func testBotEnv(t *testing.T) (*botEnv, *fakeTelegram) {
+	fake := &fakeTelegram{memberStatus: "member"}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	st := store.NewMemoryStore()
+	env := &botEnv{
+		Config:   testConfig(t),
+		Store:    st,
+		Plans:    NewPendingPlans(time.Minute),
+		Vault:    vault.New(st, false, nil),
+		Telegram: telegram.NewClientWithURL(server.URL, "token", nil),
+		Logger:   zap.NewNop(),
+	}
+	return env, fake
+}
+
+func commandUpdate(chatID, userID int64, text string) *TelegramUpdate {
+	return &TelegramUpdate{Message: &TelegramMessage{
+		MessageID: 10,
+		From:      &TelegramUser{ID: userID},
+		Chat:      &TelegramChat{ID: chatID},
+		Text:      text,
+	}}
+}
+
+func callbackUpdate(chatID, userID int64, data string) *TelegramUpdate {
+	return &TelegramUpdate{CallbackQuery: &TelegramCallbackQuery{
+		ID:      "query",
+		From:    &TelegramUser{ID: userID},
+		Message: &TelegramMessage{MessageID: 20, Chat: &TelegramChat{ID: chatID}},
+		Data:    data,
+	}}
+}
+
+func TestRouterRepliesToCommands(t *testing.T) {
+	env, fake := testBotEnv(t)
+
+	botRoutes.dispatch(context.Background(), env, commandUpdate(42, 42, "/help@OTPusBot"))
+
+	sent := fake.requests("sendMessage")
+	require.Len(t, sent, 1)
+	assert.Contains(t, sent[0].Body["text"], "/start")
+}
+
+func TestRouterIgnoresCommandsForOtherBots(t *testing.T) {
+	env, fake := testBotEnv(t)
+
+	botRoutes.dispatch(context.Background(), env, commandUpdate(42, 42, "/help@OtherBot"))
+
+	assert.Empty(t, fake.requests("sendMessage"))
+}
+
+func TestRouterRecoversPanickingHandlers(t *testing.T) {
+	env, fake := testBotEnv(t)
+	r := newBotRouter()
+	r.Use(recoverPanics)
+	r.Callback("boom", func(*botEnv, *botRequest) callbackAnswer { panic("boom") })
+
+	r.dispatch(context.Background(), env, callbackUpdate(42, 42, callbackData("boom")))
+
+	assert.Equal(t, []string{answerFailed.Text}, fake.answers())
+}
+
+func TestRouterRunsMiddlewareInOrder(t *testing.T) {
+	env, _ := testBotEnv(t)
+	var calls []string
+	trace := func(name string) botMiddleware {
+		return func(next botHandler) botHandler {
+			return func(env *botEnv, req *botRequest) callbackAnswer {
+				calls = append(calls, name)
+				return next(env, req)
+			}
+		}
+	}
+
+	r := newBotRouter()
+	r.Use(trace("first"), trace("second"))
+	r.Command("ping", "Ping", func(*botEnv, *botRequest) callbackAnswer {
+		calls = append(calls, "handler")
+		return callbackAnswer{}
+	})
+
+	r.dispatch(context.Background(), env, commandUpdate(42, 42, "/ping"))
+
+	assert.Equal(t, []string{"first", "second", "handler"}, calls)
+}
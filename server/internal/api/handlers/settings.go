@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"go.uber.org/zap"
+)
+
+// Templates for OTP messages, templateFull when a chat did not choose one
+const (
+	templateFull    = "full"
+	templateCompact = "compact"
+	templateCode    = "code"
+)
+
+var messageTemplates = []struct {
+	Name  string
+	Label string
+}{
+	{Name: templateFull, Label: "Full"},
+	{Name: templateCompact, Label: "Compact"},
+	{Name: templateCode, Label: "Code only"},
+}
+
+// retentionOptions are the message retentions offered in /settings. Telegram only lets bots delete
+// messages younger than 48 hours, so longer retentions would not be honored.
+var retentionOptions = []struct {
+	Value string
+	Label string
+}{
+	{Value: "1m", Label: "1 minute"},
+	{Value: "5m", Label: "5 minutes"},
+	{Value: "15m", Label: "15 minutes"},
+	{Value: "1h", Label: "1 hour"},
+	{Value: "24h", Label: "1 day"},
+	{Value: "0s", Label: "Keep messages"},
+}
+
+// ChatRetention returns the retention chats chose in /settings, for the message deletion queue
+func ChatRetention(st store.Store) func(chatID int64) (time.Duration, bool) {
+	return func(chatID int64) (time.Duration, bool) {
+		settings, err := st.GetChatSettings(chatID)
+		if err != nil || settings.Retention == nil {
+			return 0, false
+		}
+		return *settings.Retention, true
+	}
+}
+
+// loadChatSettings returns the settings of a chat, or the defaults when it has none
+func loadChatSettings(st store.Store, logger *zap.Logger, chatID int64) *store.ChatSettings {
+	settings, err := st.GetChatSettings(chatID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			logger.Error("Failed to read chat settings",
+				zap.Error(err),
+				zap.Int64("chat_id", chatID))
+		}
+		return &store.ChatSettings{ChatID: chatID}
+	}
+	return settings
+}
+
+// handleSettingsCommand sends the /settings menu
+func handleSettingsCommand(env *botEnv, req *botRequest) callbackAnswer {
+	settings := loadChatSettings(env.Store, env.Logger, req.ChatID)
+
+	sendReply(env, req, formatSettings(settings), settingsKeyboard(settings))
+	return callbackAnswer{}
+}
+
+// handleSettingsCallback applies a /settings button and edits the menu in place.
+// The data is the setting followed by its value for settings with a submenu, e.g. "retention:15m".
+func handleSettingsCallback(env *botEnv, req *botRequest) callbackAnswer {
+	chatID, messageID := req.ChatID, req.MessageID
+	st, client, logger := env.Store, env.Telegram, env.Logger
+
+	setting, value, _ := strings.Cut(req.Args, ":")
+	settings := loadChatSettings(st, logger, chatID)
+
+	// Changed settings are confirmed with a toast, opening a submenu needs no answer text
+	answer := callbackAnswer{Text: "✅ Saved"}
+	var err error
+	switch setting {
+	case "retention":
+		if value == "" {
+			err = client.EditMessageText(chatID, messageID, "How long should messages stay in this chat?", retentionKeyboard())
+			answer = callbackAnswer{}
+			break
+		}
+
+		if value == "default" {
+			settings.Retention = nil
+		} else {
+			retention, parseErr := time.ParseDuration(value)
+			if parseErr != nil {
+				logger.Error("Invalid retention setting", zap.String("value", value))
+				return answerStale
+			}
+			settings.Retention = &retention
+		}
+		err = saveSettings(settings, messageID, st, client)
+
+	case "template":
+		if value == "" {
+			err = client.EditMessageText(chatID, messageID, "Which message template should OTPs use?", templateKeyboard())
+			answer = callbackAnswer{}
+			break
+		}
+
+		if !isValidTemplate(value) {
+			logger.Error("Invalid template setting", zap.String("value", value))
+			return answerStale
+		}
+		settings.Template = value
+		err = saveSettings(settings, messageID, st, client)
+
+	case "raw":
+		settings.HideRawEvent = !settings.HideRawEvent
+		err = saveSettings(settings, messageID, st, client)
+
+	case "mask":
+		settings.MaskPhone = !settings.MaskPhone
+		err = saveSettings(settings, messageID, st, client)
+
+	case "silent":
+		settings.Silent = !settings.Silent
+		err = saveSettings(settings, messageID, st, client)
+
+	case "menu":
+		err = client.EditMessageText(chatID, messageID, formatSettings(settings), settingsKeyboard(settings))
+		answer = callbackAnswer{}
+
+	case "close":
+		err = client.EditMessageText(chatID, messageID, formatSettings(settings))
+		answer = callbackAnswer{}
+
+	default:
+		return answerStale
+	}
+
+	if err != nil {
+		logger.Error("Failed to update settings",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID))
+		return answerFailed
+	}
+	return answer
+}
+
+// saveSettings stores the settings and shows the updated menu
+func saveSettings(settings *store.ChatSettings, messageID int64, st store.Store, client *telegram.Client) error {
+	if err := st.SaveChatSettings(settings); err != nil {
+		return fmt.Errorf("failed to save chat settings: %w", err)
+	}
+	return client.EditMessageText(settings.ChatID, messageID, formatSettings(settings), settingsKeyboard(settings))
+}
+
+func formatSettings(settings *store.ChatSettings) string {
+	rawEvent := "shown"
+	if settings.HideRawEvent {
+		rawEvent = "hidden"
+	}
+	phoneNumbers := "visible"
+	if settings.MaskPhone {
+		phoneNumbers = "masked"
+	}
+	notifications := "with sound"
+	if settings.Silent {
+		notifications = "silent"
+	}
+
+	return fmt.Sprintf(
+		"⚙️ <b>Chat settings</b>\n\n"+
+			"Message retention: %s\n"+
+			"Raw event: %s\n"+
+			"Phone numbers: %s\n"+
+			"Notifications: %s\n"+
+			"Template: %s",
+		retentionLabel(settings.Retention),
+		rawEvent,
+		phoneNumbers,
+		notifications,
+		templateLabel(settings.Template),
+	)
+}
+
+func settingsKeyboard(settings *store.ChatSettings) *telegram.ReplyMarkup {
+	rawEvent := "Hide raw event"
+	if settings.HideRawEvent {
+		rawEvent = "Show raw event"
+	}
+	phoneNumbers := "Mask phone numbers"
+	if settings.MaskPhone {
+		phoneNumbers = "Show phone numbers"
+	}
+	notifications := "Silent notifications"
+	if settings.Silent {
+		notifications = "Notifications with sound"
+	}
+
+	return &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{{Text: "🗑 Message retention", CallbackData: callbackData("settings", "retention")}},
+			{{Text: rawEvent, CallbackData: callbackData("settings", "raw")}},
+			{{Text: phoneNumbers, CallbackData: callbackData("settings", "mask")}},
+			{{Text: notifications, CallbackData: callbackData("settings", "silent")}},
+			{{Text: "📝 Message template", CallbackData: callbackData("settings", "template")}},
+			{{Text: "Done", CallbackData: callbackData("settings", "close")}},
+		},
+	}
+}
+
+func retentionKeyboard() *telegram.ReplyMarkup {
+	var keyboard [][]telegram.InlineKeyboardButton
+	for _, option := range retentionOptions {
+		keyboard = append(keyboard, []telegram.InlineKeyboardButton{
+			{Text: option.Label, CallbackData: callbackData("settings", "retention", option.Value)},
+		})
+	}
+	keyboard = append(keyboard,
+		[]telegram.InlineKeyboardButton{{Text: "Server default", CallbackData: callbackData("settings", "retention", "default")}},
+		[]telegram.InlineKeyboardButton{{Text: "« Back", CallbackData: callbackData("settings", "menu")}},
+	)
+	return &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+func templateKeyboard() *telegram.ReplyMarkup {
+	var keyboard [][]telegram.InlineKeyboardButton
+	for _, tmpl := range messageTemplates {
+		keyboard = append(keyboard, []telegram.InlineKeyboardButton{
+			{Text: tmpl.Label, CallbackData: callbackData("settings", "template", tmpl.Name)},
+		})
+	}
+	keyboard = append(keyboard, []telegram.InlineKeyboardButton{{Text: "« Back", CallbackData: callbackData("settings", "menu")}})
+	return &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+func retentionLabel(retention *time.Duration) string {
+	if retention == nil {
+		return "server default"
+	}
+	for _, option := range retentionOptions {
+		if value, err := time.ParseDuration(option.Value); err == nil && value == *retention {
+			return strings.ToLower(option.Label)
+		}
+	}
+	return retention.String()
+}
+
+func templateLabel(name string) string {
+	for _, tmpl := range messageTemplates {
+		if tmpl.Name == name {
+			return tmpl.Label
+		}
+	}
+	return "Full"
+}
+
+func isValidTemplate(name string) bool {
+	for _, tmpl := range messageTemplates {
+		if tmpl.Name == name {
+			return true
+		}
+	}
+	return false
+}
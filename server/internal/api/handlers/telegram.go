@@ -1,14 +1,58 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
-	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
+	"sync"
+	"time"
 )
 
+// TelegramAllowedUpdates are the update types the bot handles
+var TelegramAllowedUpdates = []string{"message", "callback_query"}
+
+// botRoutes are the commands and buttons the bot handles
+var botRoutes = newBotRoutes()
+
+// TelegramCommands is the command menu published to Telegram
+var TelegramCommands = botRoutes.Commands()
+
+// newBotRoutes registers the bot's commands and button actions. Every command and button configures the chat,
+// so all of them but /help require a chat admin.
+func newBotRoutes() *botRouter {
+	r := newBotRouter()
+	r.Use(recoverPanics, logRequests)
+
+	r.Command("start", "Connect an Auth0 tenant to this chat", requireAdmin(handleStartCommand))
+	r.Command("disconnect", "Remove the OTPus configuration from a tenant", requireAdmin(handleDisconnectCommand))
+	r.Command("rotate", "Update the tenant actions to the active signing key", requireAdmin(handleRotateCommand))
+	r.Command("settings", "Choose how OTP messages are shown in this chat", requireAdmin(handleSettingsCommand))
+	r.Command("tenants", "List the connected tenants and manage them", requireAdmin(handleTenantsCommand))
+
+	r.Callback("settings", requireAdmin(handleSettingsCallback))
+	r.Callback("tenant", requireAdmin(handleTenantCallback))
+	r.Callback("plan_apply", requireAdmin(handlePlanCallback))
+	r.Callback("plan_email", requireAdmin(handlePlanCallback))
+	r.Callback("plan_cancel", requireAdmin(handlePlanCallback))
+	for _, action := range []string{"tenant_personal", "tenant_private", "auth_ephemeral", "auth_client_credentials",
+		"disconnect_auth_client_credentials", "rotate_auth_client_credentials"} {
+		r.Callback(action, requireAdmin(handleAuthCallback))
+	}
+	r.Fallback(requireAdmin(handleStaleCallback))
+
+	return r
+}
+
+// telegramPollTimeout is how long a getUpdates request waits for new updates
+const telegramPollTimeout = 30 * time.Second
+
 type TelegramUpdate struct {
 	UpdateID      int64                  `json:"update_id"`
 	Message       *TelegramMessage       `json:"message"`
@@ -16,11 +60,15 @@ type TelegramUpdate struct {
 }
 
 type TelegramMessage struct {
-	MessageID int64            `json:"message_id"`
-	From      *TelegramUser    `json:"from"`
-	Chat      *TelegramChat    `json:"chat"`
-	Text      string           `json:"text"`
-	ReplyTo   *TelegramMessage `json:"reply_to_message"`
+	MessageID       int64            `json:"message_id"`
+	MessageThreadID int64            `json:"message_thread_id"`
+	IsTopicMessage  bool             `json:"is_topic_message"`
+	From            *TelegramUser    `json:"from"`
+	Chat            *TelegramChat    `json:"chat"`
+	Text            string           `json:"text"`
+	ReplyTo         *TelegramMessage `json:"reply_to_message"`
+	SenderChat      *TelegramChat    `json:"sender_chat"`
+	MigrateToChatID int64            `json:"migrate_to_chat_id"`
 }
 
 type TelegramCallbackQuery struct {
@@ -37,8 +85,10 @@ type TelegramUser struct {
 }
 
 type TelegramChat struct {
-	ID   int64  `json:"id"`
-	Type string `json:"type"`
+	ID      int64  `json:"id"`
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	IsForum bool   `json:"is_forum"`
 }
 
 type TelegramReplyMarkup struct {
@@ -58,8 +108,20 @@ type TelegramInlineButton struct {
 	URL          string `json:"url,omitempty"`
 }
 
-func HandleTelegramUpdates(cfg *config.Config, logger *zap.Logger) gin.HandlerFunc {
-	telegramClient := telegram.NewClient(cfg.TelegramToken)
+// HandleTelegramUpdates receives updates on the webhook. Handlers keep running after the webhook is answered,
+// until ctx is cancelled at shutdown.
+func HandleTelegramUpdates(ctx context.Context, cfg *config.Config, st store.Store, plans *PendingPlans,
+	deviceFlows *DeviceFlows, credentials *vault.Vault, deletions *telegram.DeletionQueue, logger *zap.Logger) gin.HandlerFunc {
+	env := &botEnv{
+		Config:      cfg,
+		Store:       st,
+		Plans:       plans,
+		DeviceFlows: deviceFlows,
+		Vault:       credentials,
+		Auth0:       auth0.NewAuth0Client(),
+		Telegram:    telegram.NewClient(cfg.TelegramToken, deletions),
+		Logger:      logger,
+	}
 
 	return func(c *gin.Context) {
 		var update TelegramUpdate
@@ -73,123 +135,278 @@ func HandleTelegramUpdates(cfg *config.Config, logger *zap.Logger) gin.HandlerFu
 		c.Status(200)
 
 		// Handle updates in a goroutine
+		go botRoutes.dispatch(ctx, env, &update)
+	}
+}
+
+// PollTelegramUpdates receives updates through getUpdates long-polling instead of the webhook, for bots
+// that are not reachable from the internet. It returns once ctx is cancelled and the running handlers finish.
+func PollTelegramUpdates(ctx context.Context, cfg *config.Config, st store.Store, plans *PendingPlans,
+	deviceFlows *DeviceFlows, credentials *vault.Vault, deletions *telegram.DeletionQueue, logger *zap.Logger) error {
+	telegramClient := telegram.NewClient(cfg.TelegramToken, deletions)
+	env := &botEnv{
+		Config:      cfg,
+		Store:       st,
+		Plans:       plans,
+		DeviceFlows: deviceFlows,
+		Vault:       credentials,
+		Auth0:       auth0.NewAuth0Client(),
+		Telegram:    telegramClient,
+		Logger:      logger,
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	logger.Info("Polling Telegram for updates")
+
+	return telegramClient.PollUpdates(ctx, telegramPollTimeout, TelegramAllowedUpdates, func(raw json.RawMessage) {
+		var update TelegramUpdate
+		if err := json.Unmarshal(raw, &update); err != nil {
+			logger.Error("Failed to parse telegram update", zap.Error(err))
+			return
+		}
+
+		wg.Add(1)
 		go func() {
-			if update.CallbackQuery != nil {
-				handleCallbackQuery(update.CallbackQuery, cfg, telegramClient, logger)
-				return
-			}
-
-			if update.Message != nil {
-				handleMessage(update.Message, cfg, telegramClient, logger)
-				return
-			}
+			defer wg.Done()
+			botRoutes.dispatch(ctx, env, &update)
 		}()
+	})
+}
+
+// topicID returns the forum topic a message belongs to. Outside forums message_thread_id refers to reply
+// threads, which messages cannot be sent to.
+func topicID(message *TelegramMessage) int64 {
+	if !message.IsTopicMessage {
+		return 0
 	}
+	return message.MessageThreadID
 }
 
-// TODO: Re-enable personal and ephemeral auth
-func handleMessage(message *TelegramMessage, cfg *config.Config, client *telegram.Client, logger *zap.Logger) {
-	if message.Text == "/start" {
-		keyboard := &telegram.ReplyMarkup{
-			InlineKeyboard: [][]telegram.InlineKeyboardButton{
-				{
-					{
-						Text:         "Personal Public Tenant",
-						CallbackData: "auth_client_credentials", //TODO: "tenant_personal",
-					},
-				},
-				{
-					{
-						Text:         "Private Demo Tenant",
-						CallbackData: "auth_client_credentials", //TODO: "tenant_private",
-					},
-				},
-			},
+// messageFromAdmin reports whether a message was sent by a user who may configure the chat. Anonymous group
+// admins send messages on behalf of the group itself.
+func messageFromAdmin(message *TelegramMessage, cfg *config.Config, client *telegram.Client, logger *zap.Logger) bool {
+	if message.SenderChat != nil {
+		return message.SenderChat.ID == message.Chat.ID
+	}
+	if message.From == nil {
+		return false
+	}
+
+	allowed, err := canConfigure(cfg, client, message.Chat.ID, message.From.ID)
+	if err != nil {
+		logger.Error("Failed to check chat member",
+			zap.Error(err),
+			zap.Int64("chat_id", message.Chat.ID),
+			zap.Int64("user_id", message.From.ID))
+	}
+	return allowed
+}
+
+// migrateChat moves the tenants and settings of a group that was upgraded to a supergroup, which changes its ID
+func migrateChat(oldChatID, newChatID int64, st store.Store, client *telegram.Client, logger *zap.Logger) {
+	logger.Info("Chat migrated to supergroup",
+		zap.Int64("chat_id", oldChatID),
+		zap.Int64("new_chat_id", newChatID))
+
+	regs, err := st.ListRegistrationsByChat(oldChatID)
+	if err != nil {
+		logger.Error("Failed to list registrations",
+			zap.Error(err),
+			zap.Int64("chat_id", oldChatID))
+	}
+	for _, reg := range regs {
+		reg.ChatID = newChatID
+		if err := st.SaveRegistration(reg); err != nil {
+			logger.Error("Failed to migrate registration",
+				zap.Error(err),
+				zap.String("domain", reg.Domain),
+				zap.Int64("chat_id", newChatID))
 		}
+	}
 
-		err := client.SendMessage(message.Chat.ID, "Which kind of instance do you want to connect?", keyboard)
-		if err != nil {
-			logger.Error("Failed to send message",
+	if settings, err := st.GetChatSettings(oldChatID); err == nil {
+		settings.ChatID = newChatID
+		if err := st.SaveChatSettings(settings); err != nil {
+			logger.Error("Failed to migrate chat settings",
 				zap.Error(err),
-				zap.Int64("chat_id", message.Chat.ID))
+				zap.Int64("chat_id", newChatID))
 		}
 	}
+
+	if len(regs) == 0 {
+		return
+	}
+
+	// The tenant actions still send the old chat ID until they are set up again
+	err = client.SendMessage(newChatID, "This group was upgraded to a supergroup. "+
+		"Use 🔄 Re-sync in /tenants for each tenant so its OTPs keep arriving here.")
+	if err != nil {
+		logger.Error("Failed to send message",
+			zap.Error(err),
+			zap.Int64("chat_id", newChatID))
+	}
 }
 
-func handleCallbackQuery(query *TelegramCallbackQuery, cfg *config.Config, client *telegram.Client, logger *zap.Logger) {
-	chatID := query.Message.Chat.ID
-	messageID := query.Message.MessageID
+// TODO: Re-enable ephemeral auth
+func handleStartCommand(env *botEnv, req *botRequest) callbackAnswer {
+	text := "Which kind of instance do you want to connect?"
+	// Restarting setup abandons a device authorization that was not approved yet
+	if env.DeviceFlows.Cancel(req.ChatID) {
+		text = "The pending device authorization was cancelled.\n\n" + text
+	}
 
-	switch query.Data {
-	case "tenant_personal":
-		signature := utils.GenerateHMAC(fmt.Sprintf("%d", chatID), cfg.HMACSecret)
-		authURL := fmt.Sprintf("%s/bot/auth-form?chat_id=%d&signature=%s&auth_type=tenant_personal&messageID=%d",
-			cfg.BaseURL, chatID, signature, messageID)
+	// Personal tenants authorize through the device flow when a device client is configured
+	personalAuth := "auth_client_credentials"
+	if env.Config.Auth0DeviceClientID != "" {
+		personalAuth = "tenant_personal"
+	}
 
-		keyboard := &telegram.ReplyMarkup{
-			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{
 				{
-					{
-						Text: "Complete Authentication",
-						URL:  authURL,
-					},
+					Text:         "Personal Public Tenant",
+					CallbackData: callbackData(personalAuth),
 				},
 			},
-		}
+			{
+				{
+					Text:         "Private Demo Tenant",
+					CallbackData: callbackData("auth_client_credentials"), //TODO: "tenant_private",
+				},
+			},
+		},
+	}
 
-		err := client.EditMessageText(chatID, messageID, "Please complete your authentication using the form below:", keyboard)
-		if err != nil {
-			logger.Error("Failed to send message",
-				zap.Error(err),
-				zap.Int64("chat_id", chatID))
+	sendReply(env, req, text, keyboard)
+	return callbackAnswer{}
+}
+
+func handleDisconnectCommand(env *botEnv, req *botRequest) callbackAnswer {
+	text := "This will remove the OTPus actions from your tenant and revert its phone and email settings."
+	regs, err := env.Store.ListRegistrationsByChat(req.ChatID)
+	if err != nil {
+		env.Logger.Error("Failed to list registrations",
+			zap.Error(err),
+			zap.Int64("chat_id", req.ChatID))
+	}
+	if len(regs) > 0 {
+		text += "\n\nTenants connected to this chat:"
+		for _, reg := range regs {
+			text += fmt.Sprintf("\n• <code>%s</code>", reg.Domain)
 		}
+	}
 
-	case "tenant_private":
-		keyboard := &telegram.ReplyMarkup{
-			InlineKeyboard: [][]telegram.InlineKeyboardButton{
-				{
-					{
-						Text:         "Ephemeral Access Token",
-						CallbackData: "auth_ephemeral",
-					},
-				},
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{
 				{
-					{
-						Text:         "ClientID and Client Credentials",
-						CallbackData: "auth_client_credentials",
-					},
+					Text:         "ClientID and Client Credentials",
+					CallbackData: callbackData("disconnect_auth_client_credentials"),
 				},
 			},
-		}
+		},
+	}
 
-		err := client.EditMessageText(chatID, messageID, "How would you like to authenticate?", keyboard)
-		if err != nil {
-			logger.Error("Failed to send message",
-				zap.Error(err),
-				zap.Int64("chat_id", chatID))
-		}
+	sendReply(env, req, text, keyboard)
+	return callbackAnswer{}
+}
 
-	case "auth_ephemeral", "auth_client_credentials":
-		signature := utils.GenerateHMAC(fmt.Sprintf("%d", chatID), cfg.HMACSecret)
-		authURL := fmt.Sprintf("%s/bot/auth-form?chat_id=%d&signature=%s&auth_type=%s&message_id=%d",
-			cfg.BaseURL, chatID, signature, query.Data, messageID)
+func handleRotateCommand(env *botEnv, req *botRequest) callbackAnswer {
+	regs, err := env.Store.ListRegistrationsByChat(req.ChatID)
+	if err != nil {
+		env.Logger.Error("Failed to list registrations",
+			zap.Error(err),
+			zap.Int64("chat_id", req.ChatID))
+	}
+	if len(regs) == 0 {
+		return callbackAnswer{Text: "No tenants are connected to this chat."}
+	}
 
-		keyboard := &telegram.ReplyMarkup{
-			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+	activeKeyID := env.Config.HMACKeys.Active().ID
+	text := fmt.Sprintf("This will update the OTPus action secrets to the active key <code>%s</code>. "+
+		"Authenticate once per tenant.\n\nTenants connected to this chat:", activeKeyID)
+	for _, reg := range regs {
+		status := "✅"
+		if registrationKeyID(reg) != activeKeyID {
+			status = "⚠️"
+		}
+		text += fmt.Sprintf("\n%s <code>%s</code> (key %s)", status, reg.Domain, registrationKeyID(reg))
+	}
+
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{
 				{
-					{
-						Text: "Complete Authentication",
-						URL:  authURL,
-					},
+					Text:         "ClientID and Client Credentials",
+					CallbackData: callbackData("rotate_auth_client_credentials"),
 				},
 			},
+		},
+	}
+
+	sendReply(env, req, text, keyboard)
+	return callbackAnswer{}
+}
+
+// sendReply sends a message to the chat of a command. Replies go to the forum topic the command was sent in.
+func sendReply(env *botEnv, req *botRequest, text string, keyboard *telegram.ReplyMarkup) {
+	err := env.Telegram.SendMessageWithOptions(req.ChatID, text, telegram.SendMessageOptions{ThreadID: req.ThreadID}, keyboard)
+	if err != nil {
+		env.Logger.Error("Failed to send message",
+			zap.Error(err),
+			zap.Int64("chat_id", req.ChatID))
+	}
+}
+
+// handlePlanCallback applies, with or without email forwarding, or cancels the pending plan whose ID follows the action
+func handlePlanCallback(env *botEnv, req *botRequest) callbackAnswer {
+	ctx, chatID, messageID, planID := req.Context(), req.ChatID, req.MessageID, req.Args
+	cfg, st, plans, client, logger := env.Config, env.Store, env.Plans, env.Telegram, env.Logger
+
+	var answer callbackAnswer
+	var err error
+
+	switch req.Action {
+	case "plan_apply", "plan_email":
+		pending, ok := plans.Take(planID, chatID)
+		if !ok {
+			err = client.EditMessageText(chatID, messageID, "⌛ This plan has expired. Please run /start again.")
+			answer = callbackAnswer{Text: "This plan has expired.", Alert: true}
+			break
 		}
 
-		err := client.EditMessageText(chatID, messageID, "Please complete your authentication using the form below:", keyboard)
+		req.answerNow(env, callbackAnswer{Text: "⚙️ Applying the plan"})
+		_ = client.EditMessageText(chatID, messageID, "⚙️ Applying the planned changes...")
+
+		forwardEmail := req.Action == "plan_email"
+		err = setupTenant(ctx, env.Auth0, cfg, st, logger, pending.Domain, pending.AccessToken, chatID, pending.ThreadID,
+			pending.AuthType, forwardEmail)
 		if err != nil {
-			logger.Error("Failed to send message",
+			logger.Error("Failed to setup Auth0 action",
 				zap.Error(err),
+				zap.String("domain", pending.Domain),
 				zap.Int64("chat_id", chatID))
+			err = client.EditMessageText(chatID, messageID, setupFailedMessage(err))
+			break
 		}
+		saveCredentials(env.Vault, logger, pending.Domain, pending.Credentials)
+
+		err = client.EditMessageText(chatID, messageID, setupCompletedMessage(pending.Domain, forwardEmail))
+
+	case "plan_cancel":
+		plans.Take(planID, chatID)
+		err = client.EditMessageText(chatID, messageID, "Setup cancelled. Nothing was changed.")
+		answer = callbackAnswer{Text: "Setup cancelled"}
+	}
+
+	if err != nil {
+		logger.Error("Failed to send message",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID))
+		return answerFailed
 	}
+	return answer
 }
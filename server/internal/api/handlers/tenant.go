@@ -0,0 +1,527 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// errNotConnected is returned when an operation targets a tenant that is not connected to the chat
+var errNotConnected = errors.New("tenant is not connected to this chat")
+
+// tenantCredentials are the client credentials a user agreed to store at setup
+type tenantCredentials struct {
+	ClientID     string
+	ClientSecret string
+	UserID       int64 // Telegram user who consented
+}
+
+// setupTenant snapshots the tenant on its first setup, configures it and records the registration.
+// OTPs are posted to the forum topic threadID, or to the chat itself when it is zero. Emails are only
+// forwarded when the user opted in, and setting a tenant up again without it stops forwarding them.
+func setupTenant(ctx context.Context, client *auth0.Auth0Client, cfg *config.Config, st store.Store, logger *zap.Logger,
+	domain, accessToken string, chatID, threadID int64, authType string, forwardEmail bool) error {
+	if err := snapshotTenant(ctx, client, st, logger, domain, accessToken, forwardEmail); err != nil {
+		return err
+	}
+	if !forwardEmail && forwardsEmail(st, domain, chatID) {
+		if err := stopEmailForwarding(ctx, client, st, domain, accessToken); err != nil {
+			return err
+		}
+	}
+
+	actionIDs, err := client.EnablePhoneExtensibility(ctx, domain, accessToken, chatID, cfg, forwardEmail)
+	if err != nil {
+		return err
+	}
+
+	saveRegistration(st, logger, domain, chatID, threadID, authType, actionIDs, cfg.HMACKeys.Active().ID, forwardEmail)
+	return nil
+}
+
+// forwardsEmail reports whether a tenant connected to the chat opted into email forwarding
+func forwardsEmail(st store.Store, domain string, chatID int64) bool {
+	reg, err := connectedRegistration(st, domain, chatID)
+	return err == nil && reg.ForwardEmail
+}
+
+// stopEmailForwarding reverts the email configuration of a tenant that is set up again without email forwarding,
+// and removes it from the snapshot so a later disconnect leaves the email provider alone
+func stopEmailForwarding(ctx context.Context, client *auth0.Auth0Client, st store.Store,
+	domain, accessToken string) error {
+	snapshot, err := loadSnapshot(st, domain)
+	if err != nil {
+		return err
+	}
+
+	if err := client.DisableEmailForwarding(ctx, domain, accessToken, snapshot); err != nil {
+		return fmt.Errorf("failed to disable email forwarding: %w", err)
+	}
+	if snapshot == nil {
+		return nil
+	}
+	return saveSnapshot(st, domain, snapshot)
+}
+
+// sendPlan computes the setup plan for a tenant and asks the chat to apply or cancel it.
+// The plan replaces messageID when set, otherwise it is sent as a new message.
+// Credentials are stored once the plan is applied, nil when the user did not consent.
+func sendPlan(ctx context.Context, client *auth0.Auth0Client, telegramClient *telegram.Client, plans *PendingPlans,
+	domain, accessToken string, chatID, threadID, messageID int64, authType string, credentials *tenantCredentials) error {
+	plan, err := client.PlanPhoneExtensibility(ctx, domain, accessToken)
+	if err != nil {
+		return err
+	}
+
+	planID := plans.Add(&PendingPlan{
+		ChatID:      chatID,
+		ThreadID:    threadID,
+		Domain:      domain,
+		AuthType:    authType,
+		AccessToken: accessToken,
+		Credentials: credentials,
+		Plan:        plan,
+	})
+
+	keyboard := planKeyboard(planID, canForwardEmail(plan))
+	if messageID != 0 {
+		return telegramClient.EditMessageText(chatID, messageID, formatPlan(plan), keyboard)
+	}
+	return telegramClient.SendMessageWithOptions(chatID, formatPlan(plan), telegram.SendMessageOptions{ThreadID: threadID},
+		keyboard)
+}
+
+// disconnectTenant reverts a tenant connected to the chat to its snapshot and forgets it. It returns the message
+// for the chat.
+func disconnectTenant(ctx context.Context, client *auth0.Auth0Client, st store.Store, logger *zap.Logger,
+	domain, accessToken string, chatID int64) (string, error) {
+	reg, err := connectedRegistration(st, domain, chatID)
+	if err != nil {
+		return "", err
+	}
+
+	snapshot, err := loadSnapshot(st, domain)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		logger.Warn("No snapshot for tenant, resetting phone settings to defaults", zap.String("domain", domain))
+	}
+
+	// Tenants set up before email forwarding became opt-in only have the email configuration in their snapshot
+	forwardEmail := reg.ForwardEmail || (snapshot != nil && snapshot.EmailCaptured)
+	if err := client.DisablePhoneExtensibility(ctx, domain, accessToken, snapshot, forwardEmail); err != nil {
+		return "", err
+	}
+
+	deleteRegistration(st, logger, domain)
+	if err := st.DeleteSnapshot(domain); err != nil {
+		logger.Error("Failed to delete snapshot",
+			zap.Error(err),
+			zap.String("domain", domain))
+	}
+	// The vault reads credentials from the store, so deleting them also stops token renewal
+	if err := st.DeleteCredential(domain); err != nil {
+		logger.Error("Failed to delete stored credentials",
+			zap.Error(err),
+			zap.String("domain", domain))
+	}
+
+	var disabledProvider string
+	if snapshot != nil && snapshot.EmailCaptured && auth0.LosesEmailCredentials(snapshot.EmailProvider) {
+		disabledProvider = snapshot.EmailProvider.Name
+	}
+	return disconnectedMessage(domain, disabledProvider), nil
+}
+
+// saveCredentials stores the credentials of a tenant set up with the user's consent. Setting a tenant up
+// again without consent forgets the credentials stored before.
+func saveCredentials(credentials *vault.Vault, logger *zap.Logger, domain string, consented *tenantCredentials) {
+	var err error
+	if consented != nil {
+		err = credentials.Save(domain, consented.ClientID, consented.ClientSecret, consented.UserID)
+	} else if credentials.Has(domain) {
+		err = credentials.Forget(domain)
+	}
+	if err != nil {
+		logger.Error("Failed to update stored credentials",
+			zap.Error(err),
+			zap.String("domain", domain))
+	}
+}
+
+// completeTenantOperation runs an auth-form operation on a tenant connected to the chat and reports the result.
+// The report replaces messageID when set, otherwise it is sent as a new message to the forum topic threadID.
+func completeTenantOperation(ctx context.Context, client *auth0.Auth0Client, telegramClient *telegram.Client,
+	cfg *config.Config, st store.Store, logger *zap.Logger, operation, domain, accessToken string,
+	chatID, threadID, messageID int64, authType string) error {
+	var message string
+	var err error
+
+	switch operation {
+	case operationDisconnect:
+		message, err = disconnectTenant(ctx, client, st, logger, domain, accessToken, chatID)
+	case operationRotate:
+		if err = rotateTenant(ctx, client, cfg, st, logger, domain, accessToken, chatID); err == nil {
+			message = rotatedMessage(domain, cfg.HMACKeys.Active().ID)
+		}
+	case operationStatus:
+		message, err = tenantStatusMessage(ctx, client, st, domain, accessToken, chatID)
+	case operationRepair:
+		message, err = repairTenant(ctx, client, cfg, st, logger, domain, accessToken, chatID)
+	case operationResync:
+		var forwardEmail bool
+		if forwardEmail, err = resyncTenant(ctx, client, cfg, st, logger, domain, accessToken, chatID, authType); err == nil {
+			message = setupCompletedMessage(domain, forwardEmail)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", operation)
+	}
+
+	if err != nil {
+		logger.Error("Tenant operation failed",
+			zap.Error(err),
+			zap.String("operation", operation),
+			zap.String("domain", domain),
+			zap.Int64("chat_id", chatID))
+		message = operationFailedMessage(operation, err)
+	}
+
+	var sendErr error
+	if messageID != 0 {
+		sendErr = telegramClient.EditMessageText(chatID, messageID, message)
+	} else {
+		sendErr = telegramClient.SendMessageWithOptions(chatID, message, telegram.SendMessageOptions{ThreadID: threadID})
+	}
+	if sendErr != nil {
+		logger.Error("Failed to send operation result",
+			zap.Error(sendErr),
+			zap.Int64("chat_id", chatID))
+	}
+
+	return err
+}
+
+// connectedRegistration returns the registration of a tenant connected to the chat, or errNotConnected
+func connectedRegistration(st store.Store, domain string, chatID int64) (*store.Registration, error) {
+	reg, err := st.GetRegistration(domain)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && reg.ChatID != chatID) {
+		return nil, errNotConnected
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registration: %w", err)
+	}
+	return reg, nil
+}
+
+// resyncTenant applies the setup again to a connected tenant, restoring actions, bindings and settings that drifted.
+// The tenant keeps posting to its forum topic and its email forwarding choice, which is returned.
+func resyncTenant(ctx context.Context, client *auth0.Auth0Client, cfg *config.Config, st store.Store, logger *zap.Logger,
+	domain, accessToken string, chatID int64, authType string) (bool, error) {
+	reg, err := connectedRegistration(st, domain, chatID)
+	if err != nil {
+		return false, err
+	}
+	return reg.ForwardEmail, setupTenant(ctx, client, cfg, st, logger, domain, accessToken, chatID, reg.ThreadID, authType,
+		reg.ForwardEmail)
+}
+
+// tenantStatusMessage reads the live state of the phone and email actions of a connected tenant
+func tenantStatusMessage(ctx context.Context, client *auth0.Auth0Client, st store.Store, domain, accessToken string,
+	chatID int64) (string, error) {
+	reg, err := connectedRegistration(st, domain, chatID)
+	if err != nil {
+		return "", err
+	}
+
+	statuses, err := client.GetPhoneActionsStatus(ctx, domain, accessToken, reg.ForwardEmail)
+	if err != nil {
+		return "", err
+	}
+
+	message := fmt.Sprintf("🔍 <b>%s</b> <code>%s</code>\n", html.EscapeString(tenantLabel(reg.Domain)), html.EscapeString(reg.Domain))
+	for _, status := range statuses {
+		icon := "✅"
+		if !actionReady(status) {
+			icon = "⚠️"
+		}
+
+		deployed := "not deployed"
+		if status.DeployedVersion > 0 {
+			deployed = fmt.Sprintf("version %d deployed", status.DeployedVersion)
+		}
+		bound := "bound"
+		if !status.Bound {
+			bound = "not bound"
+		}
+
+		message += fmt.Sprintf("\n%s %s\n<code>%s</code>: %s, %s, %s\n",
+			icon, html.EscapeString(status.Name), status.Trigger, status.Status, deployed, bound)
+	}
+	return message, nil
+}
+
+// actionReady reports whether an action is built, deployed and bound to its trigger
+func actionReady(status auth0.ActionStatus) bool {
+	return status.Status == "built" && status.DeployedVersion > 0 && status.Bound
+}
+
+// operationFailedMessage tells the chat an operation failed
+func operationFailedMessage(operation string, err error) string {
+	if errors.Is(err, errNotConnected) {
+		return "❌ This tenant is not connected to this chat."
+	}
+
+	var buildErr *auth0.ActionBuildError
+	if operation != operationResync && errors.As(err, &buildErr) {
+		return actionBuildFailedMessage(buildErr)
+	}
+
+	switch operation {
+	case operationDisconnect:
+		return "❌ Failed to disconnect the Auth0 tenant. Please try again."
+	case operationRotate:
+		return "❌ Failed to rotate the action secrets. Please try again."
+	case operationStatus:
+		return "❌ Failed to read the action status. Please try again."
+	case operationRepair:
+		return "❌ Failed to repair the tenant. Please try again."
+	case operationResync:
+		return setupFailedMessage(err)
+	}
+	return "❌ The operation failed. Please try again."
+}
+
+// rotateTenant re-pushes the action secrets of a tenant connected to the chat under the active HMAC key
+func rotateTenant(ctx context.Context, client *auth0.Auth0Client, cfg *config.Config, st store.Store, logger *zap.Logger,
+	domain, accessToken string, chatID int64) error {
+	reg, err := connectedRegistration(st, domain, chatID)
+	if err != nil {
+		return err
+	}
+
+	if err := client.RotatePhoneActionSecrets(ctx, domain, accessToken, chatID, cfg); err != nil {
+		return err
+	}
+
+	saveRegistration(st, logger, domain, chatID, reg.ThreadID, reg.AuthType, reg.ActionIDs, cfg.HMACKeys.Active().ID,
+		reg.ForwardEmail)
+	return nil
+}
+
+// snapshotTenant captures the phone configuration before the first change. An existing snapshot is kept,
+// since the current configuration already contains the bot's own changes, and only completed with the email
+// configuration when the tenant opts into email forwarding.
+func snapshotTenant(ctx context.Context, client *auth0.Auth0Client, st store.Store, logger *zap.Logger,
+	domain, accessToken string, forwardEmail bool) error {
+	snapshot, err := loadSnapshot(st, domain)
+	if err != nil {
+		return err
+	}
+
+	captured := snapshot == nil
+	if snapshot == nil {
+		if snapshot, err = client.CapturePhoneSnapshot(ctx, domain, accessToken); err != nil {
+			return fmt.Errorf("failed to capture phone configuration: %w", err)
+		}
+	}
+	if forwardEmail {
+		completed, err := client.CaptureEmailConfiguration(ctx, domain, accessToken, snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to capture email configuration: %w", err)
+		}
+		captured = captured || completed
+	}
+
+	if !captured {
+		logger.Debug("Snapshot already exists", zap.String("domain", domain))
+		return nil
+	}
+	return saveSnapshot(st, domain, snapshot)
+}
+
+// saveSnapshot stores the snapshot of a tenant
+func saveSnapshot(st store.Store, domain string, snapshot *auth0.PhoneSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	if err := st.SaveSnapshot(&store.Snapshot{Domain: domain, Data: data}); err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	return nil
+}
+
+// loadSnapshot returns the stored snapshot for a domain, or nil if there is none
+func loadSnapshot(st store.Store, domain string) (*auth0.PhoneSnapshot, error) {
+	stored, err := st.GetSnapshot(domain)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	var snapshot auth0.PhoneSnapshot
+	if err := json.Unmarshal(stored.Data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// saveRegistration records a successful setup. Failures are only logged, as Auth0 is already configured.
+func saveRegistration(st store.Store, logger *zap.Logger, domain string, chatID, threadID int64, authType string,
+	actionIDs map[string]string, keyID string, forwardEmail bool) {
+	reg := &store.Registration{
+		Domain:       domain,
+		ChatID:       chatID,
+		ThreadID:     threadID,
+		AuthType:     authType,
+		ActionIDs:    actionIDs,
+		KeyID:        keyID,
+		ForwardEmail: forwardEmail,
+	}
+	// Setting up a tenant again keeps it paused
+	if existing, err := st.GetRegistration(domain); err == nil && existing.ChatID == chatID {
+		reg.Paused = existing.Paused
+	}
+
+	err := st.SaveRegistration(reg)
+	if err != nil {
+		logger.Error("Failed to save registration",
+			zap.Error(err),
+			zap.String("domain", domain),
+			zap.Int64("chat_id", chatID))
+	}
+}
+
+// deleteRegistration forgets a disconnected tenant. Failures are only logged, as Auth0 is already reverted.
+func deleteRegistration(st store.Store, logger *zap.Logger, domain string) {
+	if err := st.DeleteRegistration(domain); err != nil {
+		logger.Error("Failed to delete registration",
+			zap.Error(err),
+			zap.String("domain", domain))
+	}
+}
+
+func setupCompletedMessage(domain string, forwardEmail bool) string {
+	received := "OTP codes"
+	if forwardEmail {
+		received = "OTP codes, emails and magic links"
+	}
+	return fmt.Sprintf(
+		"✅ Configuration completed successfully!\n\n"+
+			"Domain: %s\n\n"+
+			"You will now receive %s in this chat.",
+		domain, received,
+	)
+}
+
+// setupFailedMessage tells the chat which setup step failed and whether the tenant was rolled back
+func setupFailedMessage(err error) string {
+	stepErr, ok := auth0.AsStepError(err)
+	if !ok {
+		return "❌ Failed to setup Auth0 action. Please try again."
+	}
+
+	message := fmt.Sprintf("❌ Setup failed at step: <b>%s</b>\n\n<code>%s</code>\n\n",
+		html.EscapeString(stepErr.Step), html.EscapeString(stepErr.Err.Error()))
+	var buildErr *auth0.ActionBuildError
+	if errors.As(stepErr.Err, &buildErr) {
+		message = actionBuildFailedMessage(buildErr) + "\n\n"
+	}
+	if stepErr.RolledBack() {
+		return message + "All changes were rolled back. Please try again."
+	}
+	return message + "⚠️ Some changes could not be rolled back, please check the tenant actions, bindings, phone and email settings."
+}
+
+// actionBuildFailedMessage lists the errors Auth0 reported while building an action
+func actionBuildFailedMessage(buildErr *auth0.ActionBuildError) string {
+	message := fmt.Sprintf("❌ Auth0 could not build the action <b>%s</b>.", html.EscapeString(buildErr.Action))
+	for _, actionErr := range buildErr.Errors {
+		message += fmt.Sprintf("\n<code>%s</code>", html.EscapeString(actionErr.Message))
+	}
+	return message
+}
+
+// setupFailedResponse is the auth form JSON body for a failed setup
+func setupFailedResponse(err error) gin.H {
+	stepErr, ok := auth0.AsStepError(err)
+	if !ok {
+		return gin.H{"error": "Failed to setup Auth0 action"}
+	}
+
+	var rollbackErrors []string
+	for _, rollbackErr := range stepErr.RollbackErrors {
+		rollbackErrors = append(rollbackErrors, rollbackErr.Error())
+	}
+
+	response := gin.H{
+		"error":           fmt.Sprintf("Setup failed at step: %s", stepErr.Step),
+		"failed_step":     stepErr.Step,
+		"rolled_back":     stepErr.RolledBack(),
+		"rollback_errors": rollbackErrors,
+	}
+
+	var buildErr *auth0.ActionBuildError
+	if errors.As(stepErr.Err, &buildErr) {
+		var buildErrors []string
+		for _, actionErr := range buildErr.Errors {
+			buildErrors = append(buildErrors, actionErr.Message)
+		}
+		response["build_errors"] = buildErrors
+	}
+	return response
+}
+
+func rotatedMessage(domain, keyID string) string {
+	return fmt.Sprintf(
+		"🔑 Action secrets rotated successfully!\n\n"+
+			"Domain: %s\n"+
+			"Key: %s",
+		domain, keyID,
+	)
+}
+
+// tenantLabel is the short name OTP messages and listings use for a tenant, the first label of its domain
+func tenantLabel(domain string) string {
+	label, _, _ := strings.Cut(domain, ".")
+	return label
+}
+
+// registrationKeyID is the HMAC key a registration's actions sign with
+func registrationKeyID(reg *store.Registration) string {
+	if reg.KeyID == "" {
+		return config.DefaultHMACKeyID
+	}
+	return reg.KeyID
+}
+
+// disconnectedMessage confirms a disconnect. disabledProvider names the email provider that was disabled
+// instead of restored, since Auth0 never returns its credentials.
+func disconnectedMessage(domain, disabledProvider string) string {
+	message := fmt.Sprintf(
+		"🔌 Tenant disconnected successfully!\n\n"+
+			"Domain: %s\n\n"+
+			"The OTPus actions were removed and the phone and email settings reverted.",
+		domain,
+	)
+	if disabledProvider != "" {
+		message += fmt.Sprintf("\n\n⚠️ The %s email provider could not be restored and is disabled, "+
+			"enter its credentials again in the Auth0 dashboard to enable it.", html.EscapeString(disabledProvider))
+	}
+	return message
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisconnectOnlyActsOnTenantsOfTheChat(t *testing.T) {
+	env, fake := testBotEnv(t)
+	reg := &store.Registration{Domain: "other.auth0.com", ChatID: testGroupID}
+	require.NoError(t, env.Store.SaveRegistration(reg))
+	require.NoError(t, env.Store.SaveCredential(&store.Credential{Domain: reg.Domain, ClientID: "id", ClientSecret: "secret"}))
+
+	// A /disconnect link completed from the user's private chat for another chat's tenant
+	err := completeTenantOperation(context.Background(), nil, env.Telegram, env.Config, env.Store, env.Logger,
+		operationDisconnect, reg.Domain, "token", testUserID, 0, 0, "tenant_personal")
+
+	assert.ErrorIs(t, err, errNotConnected)
+	sent := fake.requests("sendMessage")
+	require.Len(t, sent, 1)
+	assert.Equal(t, "❌ This tenant is not connected to this chat.", sent[0].Body["text"])
+
+	_, err = env.Store.GetRegistration(reg.Domain)
+	assert.NoError(t, err, "the registration is kept")
+	_, err = env.Store.GetCredential(reg.Domain)
+	assert.NoError(t, err, "the credentials are kept")
+}
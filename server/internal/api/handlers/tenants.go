@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"go.uber.org/zap"
+)
+
+// authTypeLabels are the readable names of the auth types recorded at setup
+var authTypeLabels = map[string]string{
+	"auth_client_credentials": "Client credentials",
+	"auth_ephemeral":          "Access token",
+	"tenant_personal":         "Device flow",
+}
+
+// handleTenantsCommand sends the /tenants listing
+func handleTenantsCommand(env *botEnv, req *botRequest) callbackAnswer {
+	text, keyboard := formatTenants(req.Context(), env, req.ChatID)
+
+	sendReply(env, req, text, keyboard)
+	return callbackAnswer{}
+}
+
+// handleTenantCallback handles the /tenants buttons. The data is the action followed by the tenant
+// reference, e.g. "pause:1a2b3c4d". Operations needing Auth0 access use the stored credentials of the tenant,
+// or continue in the auth form.
+func handleTenantCallback(env *botEnv, req *botRequest) callbackAnswer {
+	chatID, messageID := req.ChatID, req.MessageID
+	st, client, logger := env.Store, env.Telegram, env.Logger
+
+	action, ref, _ := strings.Cut(req.Args, ":")
+
+	var answer callbackAnswer
+	var err error
+	if action == "list" {
+		text, keyboard := formatTenants(req.Context(), env, chatID)
+		err = client.EditMessageText(chatID, messageID, text, keyboard)
+	} else {
+		reg := findTenant(st, logger, chatID, ref)
+		if reg == nil {
+			text, keyboard := formatTenants(req.Context(), env, chatID)
+			err = client.EditMessageText(chatID, messageID, text, keyboard)
+			answer = callbackAnswer{Text: "This tenant is no longer connected to this chat.", Alert: true}
+		} else {
+			answer, err = runTenantAction(env, req, action, reg)
+		}
+	}
+
+	if err != nil {
+		logger.Error("Failed to handle tenant action",
+			zap.Error(err),
+			zap.String("action", action),
+			zap.Int64("chat_id", chatID))
+		return answerFailed
+	}
+	return answer
+}
+
+func runTenantAction(env *botEnv, req *botRequest, action string, reg *store.Registration) (callbackAnswer, error) {
+	chatID, messageID := req.ChatID, req.MessageID
+	st, client := env.Store, env.Telegram
+
+	var operation, verb string
+	switch action {
+	case "pause", "resume":
+		reg.Paused = action == "pause"
+		if err := st.SaveRegistration(reg); err != nil {
+			return callbackAnswer{}, fmt.Errorf("failed to save registration: %w", err)
+		}
+		text, keyboard := formatTenants(req.Context(), env, chatID)
+		answer := callbackAnswer{Text: "▶️ " + tenantLabel(reg.Domain) + " resumed"}
+		if reg.Paused {
+			answer = callbackAnswer{Text: "⏸ " + tenantLabel(reg.Domain) + " paused"}
+		}
+		return answer, client.EditMessageText(chatID, messageID, text, keyboard)
+	case "forget":
+		if err := env.Vault.Forget(reg.Domain); err != nil {
+			return callbackAnswer{}, err
+		}
+		text, keyboard := formatTenants(req.Context(), env, chatID)
+		answer := callbackAnswer{Text: "🔑 Credentials of " + tenantLabel(reg.Domain) + " deleted"}
+		return answer, client.EditMessageText(chatID, messageID, text, keyboard)
+	case "status":
+		operation, verb = operationStatus, "check the action status of"
+	case "resync":
+		operation, verb = operationResync, "re-sync"
+	case "repair":
+		operation, verb = operationRepair, "repair"
+	case "disconnect", "disconnect_confirm":
+		operation, verb = operationDisconnect, "disconnect"
+	default:
+		return answerStale, nil
+	}
+
+	if !env.Vault.Has(reg.Domain) {
+		return tenantAuthForm(env, req, reg, operation, verb, "")
+	}
+
+	// Without the auth form as a last step, disconnecting asks for confirmation
+	if action == "disconnect" {
+		keyboard := &telegram.ReplyMarkup{
+			InlineKeyboard: [][]telegram.InlineKeyboardButton{
+				{{Text: "🔌 Disconnect", CallbackData: tenantCallback("disconnect_confirm", reg)}},
+				{{Text: "« Back", CallbackData: callbackData("tenant", "list")}},
+			},
+		}
+		text := fmt.Sprintf("Disconnect <code>%s</code>? Its actions are deleted and its phone and email settings restored.",
+			html.EscapeString(reg.Domain))
+		return callbackAnswer{}, client.EditMessageText(chatID, messageID, text, keyboard)
+	}
+
+	return runWithStoredCredentials(env, req, reg, operation, verb)
+}
+
+// runWithStoredCredentials runs an operation with a token obtained from the stored credentials of the tenant.
+// The result replaces the /tenants message. Credentials Auth0 no longer accepts send the user to the auth form.
+func runWithStoredCredentials(env *botEnv, req *botRequest, reg *store.Registration,
+	operation, verb string) (callbackAnswer, error) {
+	ctx, chatID, threadID, messageID := req.Context(), req.ChatID, req.ThreadID, req.MessageID
+	req.answerNow(env, callbackAnswer{Text: "⏳ Working on " + tenantLabel(reg.Domain)})
+
+	accessToken, err := env.Vault.Token(ctx, reg.Domain)
+	if err != nil {
+		env.Logger.Warn("Failed to get a token from the stored credentials",
+			zap.Error(err),
+			zap.String("domain", reg.Domain))
+		return tenantAuthForm(env, req, reg, operation, verb,
+			"⚠️ The stored credentials of this tenant were not accepted by Auth0.\n\n")
+	}
+
+	_ = env.Telegram.EditMessageText(chatID, messageID,
+		fmt.Sprintf("⏳ Working on <code>%s</code>...", html.EscapeString(reg.Domain)))
+
+	err = completeTenantOperation(ctx, env.Auth0, env.Telegram, env.Config, env.Store, env.Logger, operation, reg.Domain,
+		accessToken, chatID, threadID, messageID, reg.AuthType)
+	// A revoked token is renewed on the next use, the failure itself is reported in the message
+	if auth0.IsStatus(err, http.StatusUnauthorized) {
+		env.Vault.Invalidate(reg.Domain)
+	}
+	return callbackAnswer{}, nil
+}
+
+// tenantAuthForm replaces the /tenants message with the auth-form link for an operation on the tenant
+func tenantAuthForm(env *botEnv, req *botRequest, reg *store.Registration,
+	operation, verb, notice string) (callbackAnswer, error) {
+	cfg := env.Config
+	authURL := authFormURL(cfg, req.ChatID, req.ThreadID, req.UserID, req.MessageID, "auth_client_credentials", operation,
+		reg.Domain)
+
+	keyboard := &telegram.ReplyMarkup{
+		InlineKeyboard: [][]telegram.InlineKeyboardButton{
+			{authFormButton(cfg, "Complete Authentication", authURL)},
+			{{Text: "« Back", CallbackData: callbackData("tenant", "list")}},
+		},
+	}
+
+	text := notice + fmt.Sprintf("Please authenticate against <code>%s</code> to %s it using the form below:",
+		html.EscapeString(reg.Domain), verb)
+	return callbackAnswer{}, env.Telegram.EditMessageText(req.ChatID, req.MessageID, text, keyboard)
+}
+
+// formatTenants lists the tenants connected to a chat with a row of actions for each. The action status is read
+// live from the tenants whose client credentials are stored.
+func formatTenants(ctx context.Context, env *botEnv, chatID int64) (string, *telegram.ReplyMarkup) {
+	credentials := env.Vault
+	regs, err := env.Store.ListRegistrationsByChat(chatID)
+	if err != nil {
+		env.Logger.Error("Failed to list registrations",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID))
+	}
+	if len(regs) == 0 {
+		return "No tenants are connected to this chat. Use /start to connect one.", nil
+	}
+
+	text := "🏢 <b>Tenants connected to this chat</b>\n"
+	var keyboard [][]telegram.InlineKeyboardButton
+	for _, reg := range regs {
+		state := "▶️ Active"
+		pauseButton := telegram.InlineKeyboardButton{Text: "⏸ Pause", CallbackData: tenantCallback("pause", reg)}
+		if reg.Paused {
+			state = "⏸ Paused"
+			pauseButton = telegram.InlineKeyboardButton{Text: "▶️ Resume", CallbackData: tenantCallback("resume", reg)}
+		}
+
+		authType := authTypeLabels[reg.AuthType]
+		if authType == "" {
+			authType = reg.AuthType
+		}
+
+		stored := credentials.Has(reg.Domain)
+		if stored {
+			authType += " 🔑 stored"
+		}
+
+		text += fmt.Sprintf("\n<b>%s</b> <code>%s</code>\nSet up %s · %s · %s\nActions: %s\n",
+			html.EscapeString(tenantLabel(reg.Domain)),
+			html.EscapeString(reg.Domain),
+			reg.CreatedAt.Format("2006-01-02 15:04 MST"),
+			authType,
+			state,
+			liveActionStatus(ctx, env, reg),
+		)
+
+		keyboard = append(keyboard,
+			[]telegram.InlineKeyboardButton{
+				{Text: "🔍 " + tenantLabel(reg.Domain) + " action status", CallbackData: tenantCallback("status", reg)},
+			},
+			[]telegram.InlineKeyboardButton{
+				{Text: "🔄 Re-sync", CallbackData: tenantCallback("resync", reg)},
+				pauseButton,
+				{Text: "🔌 Disconnect", CallbackData: tenantCallback("disconnect", reg)},
+			},
+		)
+		if stored {
+			keyboard = append(keyboard, []telegram.InlineKeyboardButton{
+				{Text: "🔑 Forget " + tenantLabel(reg.Domain) + " credentials", CallbackData: tenantCallback("forget", reg)},
+			})
+		}
+	}
+	text += "\nReading the action status, re-syncing and disconnecting need a Management API token, " +
+		"so they continue in the auth form"
+	if credentials.Enabled() {
+		text += " unless the tenant's client credentials are stored"
+	}
+	text += "."
+
+	return text, &telegram.ReplyMarkup{InlineKeyboard: keyboard}
+}
+
+// liveActionStatus summarizes the action status of a tenant for the /tenants listing. It needs the stored
+// client credentials of the tenant, otherwise the status is unavailable.
+func liveActionStatus(ctx context.Context, env *botEnv, reg *store.Registration) string {
+	if !env.Vault.Has(reg.Domain) {
+		return "status unavailable"
+	}
+
+	accessToken, err := env.Vault.Token(ctx, reg.Domain)
+	if err == nil {
+		var statuses []auth0.ActionStatus
+		if statuses, err = env.Auth0.GetPhoneActionsStatus(ctx, reg.Domain, accessToken, reg.ForwardEmail); err == nil {
+			return summarizeActionStatus(statuses)
+		}
+	}
+
+	env.Logger.Warn("Failed to read the action status",
+		zap.Error(err),
+		zap.String("domain", reg.Domain))
+	// A revoked token is renewed on the next use
+	if auth0.IsStatus(err, http.StatusUnauthorized) {
+		env.Vault.Invalidate(reg.Domain)
+	}
+	return "status unavailable"
+}
+
+// summarizeActionStatus tells whether all actions of a tenant are ready, or how many need attention
+func summarizeActionStatus(statuses []auth0.ActionStatus) string {
+	var notReady int
+	for _, status := range statuses {
+		if !actionReady(status) {
+			notReady++
+		}
+	}
+	if notReady == 0 {
+		return "✅ deployed"
+	}
+	return fmt.Sprintf("⚠️ %d of %d need attention", notReady, len(statuses))
+}
+
+// tenantCallback builds the callback data of a tenant button. Domains can exceed the 64 bytes Telegram allows
+// for callback data, so the tenant is referenced by a short hash of its domain.
+func tenantCallback(action string, reg *store.Registration) string {
+	return callbackData("tenant", action, tenantRef(reg.Domain))
+}
+
+func tenantRef(domain string) string {
+	sum := sha256.Sum256([]byte(domain))
+	return hex.EncodeToString(sum[:4])
+}
+
+// findTenant resolves a tenant reference among the tenants connected to the chat
+func findTenant(st store.Store, logger *zap.Logger, chatID int64, ref string) *store.Registration {
+	regs, err := st.ListRegistrationsByChat(chatID)
+	if err != nil {
+		logger.Error("Failed to list registrations",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID))
+		return nil
+	}
+	for _, reg := range regs {
+		if tenantRef(reg.Domain) == ref {
+			return reg
+		}
+	}
+	return nil
+}
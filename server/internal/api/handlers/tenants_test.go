@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantButtonsOnlyActOnTenantsOfTheChat(t *testing.T) {
+	env, fake := testBotEnv(t)
+	reg := &store.Registration{Domain: "other.auth0.com", ChatID: testGroupID}
+	require.NoError(t, env.Store.SaveRegistration(reg))
+
+	// The reference of another chat's tenant, pressed in the user's private chat
+	botRoutes.dispatch(context.Background(), env, callbackUpdate(testUserID, testUserID, tenantCallback("pause", reg)))
+
+	assert.Equal(t, []string{"This tenant is no longer connected to this chat."}, fake.answers())
+	stored, err := env.Store.GetRegistration(reg.Domain)
+	require.NoError(t, err)
+	assert.False(t, stored.Paused)
+}
+
+func TestTenantButtonsActOnTenantsOfTheChat(t *testing.T) {
+	env, fake := testBotEnv(t)
+	reg := &store.Registration{Domain: "mine.auth0.com", ChatID: testUserID}
+	require.NoError(t, env.Store.SaveRegistration(reg))
+
+	botRoutes.dispatch(context.Background(), env, callbackUpdate(testUserID, testUserID, tenantCallback("pause", reg)))
+
+	assert.Equal(t, []string{"⏸ mine paused"}, fake.answers())
+	stored, err := env.Store.GetRegistration(reg.Domain)
+	require.NoError(t, err)
+	assert.True(t, stored.Paused)
+}
+
+func TestFindTenant(t *testing.T) {
+	env, _ := testBotEnv(t)
+	require.NoError(t, env.Store.SaveRegistration(&store.Registration{Domain: "a.auth0.com", ChatID: 1}))
+	require.NoError(t, env.Store.SaveRegistration(&store.Registration{Domain: "b.auth0.com", ChatID: 2}))
+
+	reg := findTenant(env.Store, env.Logger, 1, tenantRef("a.auth0.com"))
+	require.NotNil(t, reg)
+	assert.Equal(t, "a.auth0.com", reg.Domain)
+
+	assert.Nil(t, findTenant(env.Store, env.Logger, 1, tenantRef("b.auth0.com")))
+	assert.Nil(t, findTenant(env.Store, env.Logger, 1, "unknown"))
+}
+
+func TestTenantsShowTheActionStatusOnlyWithStoredCredentials(t *testing.T) {
+	env, fake := testBotEnv(t)
+	require.NoError(t, env.Store.SaveRegistration(&store.Registration{Domain: "mine.auth0.com", ChatID: testUserID}))
+
+	botRoutes.dispatch(context.Background(), env, commandUpdate(testUserID, testUserID, "/tenants"))
+
+	sent := fake.requests("sendMessage")
+	require.Len(t, sent, 1)
+	assert.Contains(t, sent[0].Body["text"], "Actions: status unavailable")
+}
+
+func TestSummarizeActionStatus(t *testing.T) {
+	ready := auth0.ActionStatus{Status: "built", DeployedVersion: 2, Bound: true}
+	assert.Equal(t, "✅ deployed", summarizeActionStatus([]auth0.ActionStatus{ready, ready}))
+
+	unbound := auth0.ActionStatus{Status: "built", DeployedVersion: 1}
+	missing := auth0.ActionStatus{Status: "missing"}
+	assert.Equal(t, "⚠️ 2 of 3 need attention", summarizeActionStatus([]auth0.ActionStatus{ready, unbound, missing}))
+}
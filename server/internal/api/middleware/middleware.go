@@ -2,12 +2,15 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -107,7 +110,17 @@ func ValidateTelegramSecret(expectedToken string) gin.HandlerFunc {
 		c.Next()
 	}
 }
-func ValidateHMACToken(secret string) gin.HandlerFunc {
+func ValidateBearerToken(expectedToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if expectedToken == "" || !hmac.Equal([]byte(token), []byte(expectedToken)) {
+			c.AbortWithStatus(401)
+			return
+		}
+		c.Next()
+	}
+}
+func ValidateHMACToken(keys *utils.Keyring) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		logger, _ := zap.NewProduction()
 		defer logger.Sync()
@@ -138,22 +151,125 @@ func ValidateHMACToken(secret string) gin.HandlerFunc {
 			return
 		}
 
-		// Get domain from request
+		// Get chat ID from request
 		chatID := c.GetHeader("x-chat_id")
-		if domain == "" {
-			logger.Error("Missing x-auth0-domain header")
+		if chatID == "" {
+			logger.Error("Missing x-chat_id header")
 			c.AbortWithStatus(401)
 			return
 		}
 
-		// Validate the token
+		// Validate the token against every non-retired key
 		tokenValue := fmt.Sprintf("%s:%s", domain, chatID)
-		expectedToken := utils.GenerateAuth0DomainToken(tokenValue, secret)
-		if token != expectedToken {
+		valid := false
+		for _, secret := range keys.Secrets() {
+			if hmac.Equal([]byte(token), []byte(utils.GenerateAuth0DomainToken(tokenValue, secret))) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
 			logger.Error("Invalid HMAC token")
-			logger.Debug("Invalid HMAC token",
-				zap.String("expected", expectedToken),
-				zap.String("received", token))
+			c.AbortWithStatus(401)
+			return
+		}
+
+		// Store validated domain in context for later use
+		c.Set("auth0_domain", domain)
+		c.Set("chat_id", chatID)
+		c.Next()
+	}
+}
+
+// ValidateWebhookSignature authenticates Auth0 Action requests. Signed (v2) requests must carry a timestamp within
+// maxSkew and a nonce that was not used before. Requests with a static v1 bearer token are only accepted when allowV1 is set.
+// The X-OTPus-Key-Id header names the key the request was signed with, without it every non-retired key is tried.
+func ValidateWebhookSignature(keys *utils.Keyring, maxSkew time.Duration, nonces *utils.NonceCache, allowV1 bool) gin.HandlerFunc {
+	validateV1 := ValidateHMACToken(keys)
+
+	return func(c *gin.Context) {
+		logger, _ := zap.NewProduction()
+		defer logger.Sync()
+
+		signature := c.GetHeader("X-OTPus-Signature")
+		if signature == "" {
+			if !allowV1 {
+				logger.Error("Unsigned webhook request rejected, v1 tokens are disabled")
+				c.AbortWithStatus(401)
+				return
+			}
+			validateV1(c)
+			return
+		}
+
+		version, signature, _ := strings.Cut(signature, "=")
+		timestamp := c.GetHeader("X-OTPus-Timestamp")
+		nonce := c.GetHeader("X-OTPus-Nonce")
+		domain := c.GetHeader("x-auth0-domain")
+		chatID := c.GetHeader("x-chat_id")
+		if version != "v2" || timestamp == "" || nonce == "" || domain == "" || chatID == "" {
+			logger.Error("Invalid webhook signature headers")
+			c.AbortWithStatus(401)
+			return
+		}
+
+		// Reject requests outside the skew window, the nonce cache only covers that window
+		unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			logger.Error("Invalid webhook timestamp", zap.String("timestamp", timestamp))
+			c.AbortWithStatus(401)
+			return
+		}
+		if skew := time.Since(time.Unix(unixTime, 0)); skew > maxSkew || skew < -maxSkew {
+			logger.Error("Webhook timestamp outside the allowed window", zap.Duration("skew", skew))
+			c.AbortWithStatus(401)
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		// Restore the request body for further processing
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		secrets := keys.Secrets()
+		if keyID := c.GetHeader("X-OTPus-Key-Id"); keyID != "" {
+			key, ok := keys.Key(keyID)
+			if !ok {
+				logger.Error("Webhook signed with an unknown or retired key",
+					zap.String("domain", domain),
+					zap.String("key_id", keyID))
+				c.AbortWithStatus(401)
+				return
+			}
+			secrets = []string{key.Secret}
+		}
+
+		valid := false
+		for _, secret := range secrets {
+			key := utils.DeriveWebhookKey(domain, chatID, secret)
+			if utils.ValidateWebhookSignature(timestamp, nonce, body, signature, key) {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			logger.Error("Invalid webhook signature", zap.String("domain", domain))
+			c.AbortWithStatus(401)
+			return
+		}
+
+		// Only record the nonce of authentic requests, so forged ones cannot burn it
+		if err := nonces.Use(nonce); err != nil {
+			// A cache full of live nonces cannot tell replays apart, so requests are refused until nonces expire
+			if errors.Is(err, utils.ErrNonceCacheFull) {
+				logger.Error("Webhook request rejected, the nonce cache is full", zap.String("domain", domain))
+				c.AbortWithStatus(503)
+				return
+			}
+			logger.Error("Replayed webhook request rejected", zap.String("domain", domain))
 			c.AbortWithStatus(401)
 			return
 		}
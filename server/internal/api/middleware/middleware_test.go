@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testDomain = "test.auth0.com"
+	testChatID = "42"
+	testSecret = "s3cr3t"
+	testBody   = `{"code":"123456"}`
+)
+
+// webhookRouter serves a route protected by ValidateWebhookSignature that answers 200
+func webhookRouter(t *testing.T, allowV1 bool) *gin.Engine {
+	return webhookRouterWithNonces(t, allowV1, utils.NewNonceCache(time.Minute, 100))
+}
+
+func webhookRouterWithNonces(t *testing.T, allowV1 bool, nonces *utils.NonceCache) *gin.Engine {
+	keys, err := utils.NewKeyring([]utils.HMACKey{{ID: "default", Secret: testSecret}}, "default")
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth0/OTPs", ValidateWebhookSignature(keys, time.Minute, nonces, allowV1),
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+	return router
+}
+
+// signedRequest builds a v2 request as the Auth0 Actions send it
+func signedRequest(timestamp time.Time, nonce, secret string) *http.Request {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+	key := utils.DeriveWebhookKey(testDomain, testChatID, secret)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth0/OTPs", strings.NewReader(testBody))
+	req.Header.Set("X-OTPus-Signature", "v2="+utils.SignWebhookPayload(unix, nonce, []byte(testBody), key))
+	req.Header.Set("X-OTPus-Timestamp", unix)
+	req.Header.Set("X-OTPus-Nonce", nonce)
+	req.Header.Set("x-auth0-domain", testDomain)
+	req.Header.Set("x-chat_id", testChatID)
+	return req
+}
+
+// v1Request builds a request carrying the static bearer token of actions deployed before v2 signatures
+func v1Request() *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/auth0/OTPs", strings.NewReader(testBody))
+	req.Header.Set("Authorization", "Bearer "+utils.GenerateAuth0DomainToken(testDomain+":"+testChatID, testSecret))
+	req.Header.Set("x-auth0-domain", testDomain)
+	req.Header.Set("x-chat_id", testChatID)
+	return req
+}
+
+func serve(router *gin.Engine, req *http.Request) int {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestWebhookSignatureAcceptsSignedRequests(t *testing.T) {
+	router := webhookRouter(t, false)
+
+	assert.Equal(t, http.StatusOK, serve(router, signedRequest(time.Now(), "nonce", testSecret)))
+}
+
+func TestWebhookSignatureRejectsBadSignatures(t *testing.T) {
+	router := webhookRouter(t, false)
+
+	assert.Equal(t, http.StatusUnauthorized, serve(router, signedRequest(time.Now(), "nonce", "other")))
+
+	req := signedRequest(time.Now(), "nonce", testSecret)
+	req.Header.Set("x-chat_id", "43")
+	assert.Equal(t, http.StatusUnauthorized, serve(router, req), "signed for another chat")
+}
+
+func TestWebhookSignatureRejectsStaleTimestamps(t *testing.T) {
+	router := webhookRouter(t, false)
+
+	assert.Equal(t, http.StatusUnauthorized, serve(router, signedRequest(time.Now().Add(-2*time.Minute), "old", testSecret)))
+	assert.Equal(t, http.StatusUnauthorized, serve(router, signedRequest(time.Now().Add(2*time.Minute), "future", testSecret)))
+}
+
+func TestWebhookSignatureRejectsReplayedNonces(t *testing.T) {
+	router := webhookRouter(t, false)
+	now := time.Now()
+
+	assert.Equal(t, http.StatusOK, serve(router, signedRequest(now, "nonce", testSecret)))
+	assert.Equal(t, http.StatusUnauthorized, serve(router, signedRequest(now, "nonce", testSecret)))
+}
+
+func TestWebhookSignatureFailsClosedWhenTheNonceCacheIsFull(t *testing.T) {
+	router := webhookRouterWithNonces(t, false, utils.NewNonceCache(time.Minute, 1))
+	now := time.Now()
+
+	assert.Equal(t, http.StatusOK, serve(router, signedRequest(now, "first", testSecret)))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(router, signedRequest(now, "second", testSecret)))
+	assert.Equal(t, http.StatusUnauthorized, serve(router, signedRequest(now, "first", testSecret)))
+}
+
+func TestWebhookSignatureRejectsUnknownKeyIDs(t *testing.T) {
+	router := webhookRouter(t, false)
+
+	req := signedRequest(time.Now(), "nonce", testSecret)
+	req.Header.Set("X-OTPus-Key-Id", "retired")
+	assert.Equal(t, http.StatusUnauthorized, serve(router, req))
+}
+
+func TestWebhookSignatureV1Fallback(t *testing.T) {
+	assert.Equal(t, http.StatusOK, serve(webhookRouter(t, true), v1Request()), "WEBHOOK_ALLOW_V1=true")
+	assert.Equal(t, http.StatusUnauthorized, serve(webhookRouter(t, false), v1Request()), "WEBHOOK_ALLOW_V1=false")
+
+	req := v1Request()
+	req.Header.Set("Authorization", "Bearer forged")
+	assert.Equal(t, http.StatusUnauthorized, serve(webhookRouter(t, true), req))
+}
@@ -1,14 +1,25 @@
 package routes
 
 import (
+	"context"
+
 	"github.com/ambravo/a0-OTPus-prime/server/internal/api/handlers"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/api/middleware"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/otp"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
 
-func SetupRoutes(r *gin.Engine, cfg *config.Config, logger *zap.Logger) {
+// SetupRoutes registers the HTTP routes. Work started by a route, such as Telegram update handlers, stops when
+// ctx is cancelled.
+func SetupRoutes(ctx context.Context, r *gin.Engine, cfg *config.Config, st store.Store, otps *otp.Buffer,
+	plans *handlers.PendingPlans, deviceFlows *handlers.DeviceFlows, credentials *vault.Vault,
+	deletions *telegram.DeletionQueue, logger *zap.Logger) {
 	// Middleware to set Logger
 	r.Use(middleware.RequestLogger(logger))
 
@@ -20,20 +31,31 @@ func SetupRoutes(r *gin.Engine, cfg *config.Config, logger *zap.Logger) {
 	// Bot routes group
 	bot := r.Group("/bot")
 	{
-		// Telegram updates webhook
-		bot.POST("/updates", middleware.ValidateTelegramSecret(cfg.DefaultSecretToken),
-			handlers.HandleTelegramUpdates(cfg, logger))
+		// Telegram updates webhook, updates are polled instead in polling mode
+		if cfg.TelegramUpdateMode == config.UpdateModeWebhook {
+			bot.POST("/updates", middleware.ValidateTelegramSecret(cfg.DefaultSecretToken),
+				handlers.HandleTelegramUpdates(ctx, cfg, st, plans, deviceFlows, credentials, deletions, logger))
+		}
 
 		// Auth form routes
-		bot.GET("/auth-form", handlers.RenderAuthForm(cfg, logger))
-		bot.POST("/auth-form", handlers.ProcessAuthForm(cfg, logger))
+		bot.GET("/auth-form", handlers.RenderAuthForm(cfg, st, credentials, deletions, logger))
+		bot.POST("/auth-form", handlers.ProcessAuthForm(cfg, st, plans, deviceFlows, credentials, deletions, logger))
 	}
 
 	// Auth0 routes group
 	auth0 := r.Group("/auth0")
 	{
 		// OTP webhook
-		auth0.POST("/OTPs", middleware.ValidateHMACToken(cfg.HMACSecret),
-			handlers.HandleOTPWebhook(cfg, logger))
+		nonces := utils.NewNonceCache(2*cfg.WebhookMaxSkew, 10000)
+		auth0.POST("/OTPs", middleware.ValidateWebhookSignature(cfg.HMACKeys, cfg.WebhookMaxSkew, nonces, cfg.WebhookAllowV1),
+			handlers.HandleOTPWebhook(cfg, st, otps, deletions, logger))
+	}
+
+	// Pull API for test automation, only exposed when a token is configured
+	if cfg.OTPAPIToken != "" {
+		api := r.Group("/api", middleware.ValidateBearerToken(cfg.OTPAPIToken))
+		{
+			api.GET("/otps/latest", handlers.GetLatestOTP(otps, logger))
+		}
 	}
 }
@@ -1,76 +1,323 @@
 package auth0
 
 import (
+	"context"
 	"embed"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
-	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
 	"log"
+	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 	"time"
 )
 
 //go:embed actionTemplates
 var templatesFS embed.FS
 
-// EnablePhoneExtensibility creates or updates an Auth0 action
-func (c *Auth0Client) EnablePhoneExtensibility(domain, accessToken string, chatID int64, cfg *config.Config) error {
-	logger := c.logger
-	var err error
+var ErrActionNotFound = errors.New("action not found")
 
-	// Activate the Custom Phone Provider
-	err = c.ActivateCustomPhoneProvider(domain, accessToken)
+// Action builds are polled with exponential backoff, see waitForBuild
+const (
+	actionBuildInitialWait = 500 * time.Millisecond
+	actionBuildMaxWait     = 8 * time.Second
+	actionBuildTimeout     = 2 * time.Minute
+)
 
-	// Custom Phone Provider, for Database Attributes
-	err = c.UpdatePhoneActionTypeBased(domain, accessToken, chatID, cfg,
-		"Custom Phone Provider", "custom-phone-provider", "v1")
-	if err != nil {
-		return fmt.Errorf("failed to Update action: %s", "Custom Phone Provider")
+// ActionBuildError is returned when Auth0 fails to build an action, with the errors it reported
+type ActionBuildError struct {
+	Action string
+	Errors []ActionError
+}
+
+func (e *ActionBuildError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("action %q failed to build", e.Action)
 	}
 
-	// Custom Phone Provider for MFA
-	err = c.UpdatePhoneActionTypeBased(domain, accessToken, chatID, cfg,
-		"Custom Phone Provider - MFA", "send-phone-message", "v2")
+	var messages []string
+	for _, buildErr := range e.Errors {
+		messages = append(messages, buildErr.Message)
+	}
+	return fmt.Sprintf("action %q failed to build: %s", e.Action, strings.Join(messages, "; "))
+}
+
+// managedAction is an action managed by EnablePhoneExtensibility, bound to a trigger of the given version
+type managedAction struct {
+	Name    string
+	Trigger string
+	Version string
+}
+
+// phoneActions are the actions managed by EnablePhoneExtensibility on every tenant
+var phoneActions = []managedAction{
+	{Name: "Custom Phone Provider", Trigger: "custom-phone-provider", Version: "v1"},
+	{Name: "Custom Phone Provider - MFA", Trigger: "send-phone-message", Version: "v2"},
+}
+
+// emailAction forwards passwordless and MFA emails, on tenants that opted into email forwarding
+var emailAction = managedAction{Name: "Custom Email Provider", Trigger: emailTrigger, Version: "v1"}
+
+// managedActions returns the actions EnablePhoneExtensibility manages, with the email action only when
+// forwardEmail is set
+func managedActions(forwardEmail bool) []managedAction {
+	if !forwardEmail {
+		return phoneActions
+	}
+	return append(slices.Clip(phoneActions), emailAction)
+}
+
+const (
+	// emailTrigger receives every email of a tenant whose email provider is customEmailProvider
+	emailTrigger        = "custom-email-provider"
+	customEmailProvider = "custom"
+)
+
+// mfaProvider is the Guardian phone provider that sends MFA messages through the send-phone-message trigger
+const mfaProvider = "phone-message-hook"
+
+// mfaMessageTypes are the Guardian phone message types EnableMFA allows
+var mfaMessageTypes = []string{"sms", "voice"}
+
+// EnablePhoneExtensibility creates or updates the Auth0 actions, returning their IDs keyed by trigger.
+// With forwardEmail, the email action is set up too and the email provider switched to it.
+// Every change is a step with a compensating undo: when a step fails, the completed steps are rolled back
+// and a *StepError naming the failed step is returned.
+func (c *Auth0Client) EnablePhoneExtensibility(ctx context.Context, domain, accessToken string, chatID int64,
+	cfg *config.Config, forwardEmail bool) (map[string]string, error) {
+	// The current state is what the undo steps revert to
+	current, err := c.CapturePhoneSnapshot(ctx, domain, accessToken)
+	if err == nil && forwardEmail {
+		_, err = c.CaptureEmailConfiguration(ctx, domain, accessToken, current)
+	}
 	if err != nil {
-		logger.Error("AUTH0 is likely in a corrupt state!, please check actions and bindings")
-		return fmt.Errorf("failed to Update action: %s", "Custom Phone Provider - MFA")
+		return nil, &StepError{Step: "Read current configuration", Err: err}
 	}
 
-	err = c.EnableMFA(domain, accessToken)
+	actionIDs := make(map[string]string)
+
+	// Activate the Custom Phone Provider
+	steps := []setupStep{
+		{
+			Name: "Activate custom phone provider",
+			Do: func(ctx context.Context) error {
+				return c.ActivateCustomPhoneProvider(ctx, domain, accessToken)
+			},
+			Undo: func(ctx context.Context) error {
+				return c.restorePhoneProviders(ctx, domain, accessToken, current.Providers)
+			},
+		},
+	}
+
+	// Custom Phone Provider for Database Attributes, then Custom Phone Provider for MFA, then Custom Email Provider
+	for _, action := range managedActions(forwardEmail) {
+		action := action
+		var previous *ActionResponse
+
+		steps = append(steps,
+			setupStep{
+				Name: fmt.Sprintf("Create or update action %q", action.Name),
+				Do: func(ctx context.Context) error {
+					var err error
+					actionIDs[action.Trigger], previous, err = c.UpdateActionTypeBased(ctx, domain, accessToken, chatID, cfg,
+						action.Name, action.Trigger, action.Version)
+					return err
+				},
+				Undo: func(ctx context.Context) error {
+					// Updates only change the draft, the deployed version is reverted by the deploy step
+					if previous != nil {
+						return nil
+					}
+					return c.deleteAction(ctx, domain, accessToken, action.Name)
+				},
+			},
+			setupStep{
+				Name: fmt.Sprintf("Deploy action %q", action.Name),
+				Do: func(ctx context.Context) error {
+					return c.deployAction(ctx, domain, accessToken, actionIDs[action.Trigger])
+				},
+				Undo: func(ctx context.Context) error {
+					if previous == nil || previous.DeployedVersion == nil {
+						return nil
+					}
+					return c.deployActionVersion(ctx, domain, accessToken, previous.ID, previous.DeployedVersion.ID)
+				},
+			},
+			setupStep{
+				Name: fmt.Sprintf("Bind action %q", action.Name),
+				Do: func(ctx context.Context) error {
+					return c.updateBindings(ctx, domain, accessToken, action.Name, actionIDs[action.Trigger], action.Trigger)
+				},
+				Undo: func(ctx context.Context) error {
+					return c.restoreBindings(ctx, domain, accessToken, action.Trigger, current.Bindings[action.Trigger], false)
+				},
+			},
+		)
+	}
+
+	// Once its action is bound, so no email is sent to an empty trigger
+	if forwardEmail {
+		steps = append(steps, setupStep{
+			Name: "Activate custom email provider",
+			Do: func(ctx context.Context) error {
+				return c.ActivateCustomEmailProvider(ctx, domain, accessToken)
+			},
+			Undo: func(ctx context.Context) error {
+				return c.restoreEmailProvider(ctx, domain, accessToken, current.EmailProvider)
+			},
+		})
+	}
+
+	steps = append(steps, setupStep{
+		Name: "Enable SMS MFA",
+		Do: func(ctx context.Context) error {
+			return c.EnableMFA(ctx, domain, accessToken)
+		},
+		Undo: func(ctx context.Context) error {
+			return c.restoreGuardian(ctx, domain, accessToken, current)
+		},
+	})
+
+	if err := c.runSteps(ctx, domain, steps); err != nil {
+		return nil, err
+	}
+
+	return actionIDs, nil
+}
+
+// DisablePhoneExtensibility removes the actions created by EnablePhoneExtensibility and reverts the phone settings.
+// The settings are restored from snapshot when available, otherwise they are reset to the Auth0 defaults.
+// The email action and provider are only touched for tenants forwarding emails.
+func (c *Auth0Client) DisablePhoneExtensibility(ctx context.Context, domain, accessToken string, snapshot *PhoneSnapshot,
+	forwardEmail bool) error {
+	// Stop routing messages to the actions before removing them
+	if snapshot != nil {
+		if err := c.RestorePhoneSnapshot(ctx, domain, accessToken, snapshot); err != nil {
+			return err
+		}
+	} else {
+		if err := c.DisableMFA(ctx, domain, accessToken); err != nil {
+			return err
+		}
+
+		if err := c.DeactivateCustomPhoneProvider(ctx, domain, accessToken); err != nil {
+			return err
+		}
+
+		if forwardEmail {
+			if err := c.DeactivateCustomEmailProvider(ctx, domain, accessToken); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, action := range managedActions(forwardEmail) {
+		if err := c.removeBinding(ctx, domain, accessToken, action.Name, action.Trigger); err != nil {
+			return fmt.Errorf("failed to unbind action %s: %w", action.Name, err)
+		}
+
+		if err := c.deleteAction(ctx, domain, accessToken, action.Name); err != nil {
+			return fmt.Errorf("failed to delete action %s: %w", action.Name, err)
+		}
+	}
+
+	c.logger.Info("Phone extensibility disabled", zap.String("domain", domain))
+
+	return nil
+}
+
+// DisableEmailForwarding stops forwarding the emails of a tenant that is set up again without email forwarding.
+// The email provider is restored from snapshot when it holds the email configuration, otherwise it is disabled.
+// The email configuration is then removed from snapshot, since it no longer has to be restored.
+func (c *Auth0Client) DisableEmailForwarding(ctx context.Context, domain, accessToken string,
+	snapshot *PhoneSnapshot) error {
+	var err error
+	if snapshot != nil && snapshot.EmailCaptured {
+		err = c.restoreEmailProvider(ctx, domain, accessToken, snapshot.EmailProvider)
+	} else {
+		err = c.DeactivateCustomEmailProvider(ctx, domain, accessToken)
+	}
 	if err != nil {
 		return err
 	}
 
+	if err := c.removeBinding(ctx, domain, accessToken, emailAction.Name, emailAction.Trigger); err != nil {
+		return fmt.Errorf("failed to unbind action %s: %w", emailAction.Name, err)
+	}
+	if err := c.deleteAction(ctx, domain, accessToken, emailAction.Name); err != nil {
+		return fmt.Errorf("failed to delete action %s: %w", emailAction.Name, err)
+	}
+
+	if snapshot != nil {
+		delete(snapshot.Bindings, emailTrigger)
+		snapshot.EmailProvider = nil
+		snapshot.EmailCaptured = false
+	}
+
+	c.logger.Info("Email forwarding disabled", zap.String("domain", domain))
+
 	return nil
 }
 
-func (c *Auth0Client) UpdatePhoneActionTypeBased(domain string, accessToken string, chatID int64,
-	cfg *config.Config, actionName string, actionType string, actionTypeVersion string) error {
-	logger := c.logger
-
-	postURL := fmt.Sprintf("%s/auth0/OTPs", cfg.BaseURL)
-	tokenValue := fmt.Sprintf("%s:%d", domain, chatID)
-	bearerToken := utils.GenerateAuth0DomainToken(tokenValue, cfg.HMACSecret)
+// RotatePhoneActionSecrets updates the secrets of the existing phone and email actions to the active HMAC key
+// and deploys them. Actions missing on the tenant, like the email action of tenants set up without email
+// forwarding, are skipped. Bindings and phone settings are left untouched.
+func (c *Auth0Client) RotatePhoneActionSecrets(ctx context.Context, domain, accessToken string, chatID int64,
+	cfg *config.Config) error {
+	var rotated int
+	for _, action := range managedActions(true) {
+		_, err := c.getAction(ctx, domain, accessToken, action.Name)
+		if errors.Is(err, ErrActionNotFound) {
+			c.logger.Info("Action not found, nothing to rotate",
+				zap.String("action", action.Name),
+				zap.String("domain", domain))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read action %s: %w", action.Name, err)
+		}
 
-	actionApiManagementURL := fmt.Sprintf("https://%s/api/v2/actions/actions", domain)
+		actionID, _, err := c.UpdateActionTypeBased(ctx, domain, accessToken, chatID, cfg, action.Name, action.Trigger,
+			action.Version)
+		if err != nil {
+			return fmt.Errorf("failed to update action %s: %w", action.Name, err)
+		}
 
-	var actionScriptSourceCode []byte
-	var err error
+		if err := c.deployAction(ctx, domain, accessToken, actionID); err != nil {
+			return fmt.Errorf("failed to deploy action %s: %w", action.Name, err)
+		}
+		rotated++
+	}
 
-	switch expr := actionType; expr {
-	case "custom-phone-provider":
-		actionScriptSourceCode, err = templatesFS.ReadFile("actionTemplates/onExecuteCustomPhoneProvider.js")
-	case "send-phone-message":
-		actionScriptSourceCode, err = templatesFS.ReadFile("actionTemplates/onExecuteSendPhoneMessage.js")
-	default:
-		return fmt.Errorf("unknown action type: %s", expr)
+	if rotated == 0 {
+		return fmt.Errorf("no OTPus actions found on %s: %w", domain, ErrActionNotFound)
 	}
 
+	c.logger.Info("Phone action secrets rotated",
+		zap.String("domain", domain),
+		zap.String("key_id", cfg.HMACKeys.Active().ID))
+
+	return nil
+}
+
+// UpdateActionTypeBased creates or updates the action of any managed trigger, phone or email, and waits until it
+// is built. It returns the action ID and, when the action already existed, its state before the update.
+func (c *Auth0Client) UpdateActionTypeBased(ctx context.Context, domain string, accessToken string, chatID int64,
+	cfg *config.Config, actionName string, actionType string, actionTypeVersion string) (string, *ActionResponse, error) {
+	logger := c.logger
+
+	postURL := fmt.Sprintf("%s/auth0/OTPs", cfg.BaseURL)
+	// The Actions sign every request with this per-registration key (v2 scheme), derived from the active HMAC key
+	hmacKey := cfg.HMACKeys.Active()
+	signingKey := utils.DeriveWebhookKey(domain, fmt.Sprintf("%d", chatID), hmacKey.Secret)
+
+	actionScriptSourceCode, err := readActionTemplate(actionType)
 	if err != nil {
-		log.Fatalf("Failed to read Action SourceCode file: %v", err)
+		return "", nil, err
 	}
 
 	var secrets []Secret
@@ -81,7 +328,11 @@ func (c *Auth0Client) UpdatePhoneActionTypeBased(domain string, accessToken stri
 	})
 	secrets = append(secrets, Secret{
 		Name:  "BOT_GATEWAY_TOKEN",
-		Value: bearerToken,
+		Value: signingKey,
+	})
+	secrets = append(secrets, Secret{
+		Name:  "BOT_GATEWAY_KEY_ID",
+		Value: hmacKey.ID,
 	})
 	secrets = append(secrets, Secret{
 		Name:  "BOT_GATEWAY_CHAT_ID",
@@ -111,107 +362,116 @@ func (c *Auth0Client) UpdatePhoneActionTypeBased(domain string, accessToken stri
 		},
 	}
 
-	a0Client := c.client.R().SetAuthToken(accessToken).
-		SetHeader("Content-Type", "application/json").
-		SetBody(action)
-
 	// First, try to get existing action
-	existingAction, err := c.getAction(domain, accessToken, actionName)
-
-	var responseBody []byte
-	if err == nil && existingAction != nil {
-		// Action exists, update it
-		updateActionURL := actionApiManagementURL + "/" + existingAction.ID
-		resp, err := a0Client.Patch(updateActionURL)
+	existingAction, err := c.getAction(ctx, domain, accessToken, actionName)
+	if err != nil && !errors.Is(err, ErrActionNotFound) {
+		return "", nil, err
+	}
 
-		if err != nil {
-			return err
-		}
+	api := c.management(domain, accessToken)
 
-		if resp.StatusCode() != 200 {
-			return fmt.Errorf("failed to update action: %s", string(resp.Body()))
+	var actionResp ActionResponse
+	if existingAction != nil {
+		// Action exists, update it
+		if err := api.patch(ctx, "actions/actions/"+existingAction.ID, action, &actionResp); err != nil {
+			return "", nil, fmt.Errorf("failed to update action: %w", err)
 		}
-		responseBody = resp.Body()
-	} else if existingAction == nil {
+	} else {
 		// Action does not exist, create it
-		resp, err := a0Client.Post(actionApiManagementURL)
-
-		if err != nil {
+		if err := api.post(ctx, "actions/actions", action, &actionResp); err != nil {
 			logger.Error("Failed to create action",
 				zap.Error(err),
 				zap.String("domain", domain),
 				zap.String("action", actionName))
-			return fmt.Errorf("failed to create action: %w", err)
+			return "", nil, fmt.Errorf("failed to create action: %w", err)
 		}
+	}
+	// It is required to wait until the action changes from "Draft" to "Built" before it can be deployed
+	if err := c.waitForBuild(ctx, domain, accessToken, &actionResp); err != nil {
+		return "", nil, err
+	}
+
+	return actionResp.ID, existingAction, nil
+}
 
-		if resp.StatusCode() != 201 {
-			return fmt.Errorf("failed to create action: %s", string(resp.Body()))
+// waitForBuild polls an action until Auth0 has built it, waiting actionBuildInitialWait at first and twice as
+// long after every poll, up to actionBuildMaxWait. It gives up after actionBuildTimeout, and returns an
+// *ActionBuildError when the build fails.
+func (c *Auth0Client) waitForBuild(ctx context.Context, domain, accessToken string, action *ActionResponse) error {
+	buildCtx, cancel := context.WithTimeout(ctx, actionBuildTimeout)
+	defer cancel()
+
+	wait := actionBuildInitialWait
+	for {
+		switch action.Status {
+		case "built":
+			return nil
+		case "failed":
+			return &ActionBuildError{Action: action.Name, Errors: action.Errors}
 		}
-		responseBody = resp.Body()
-	}
 
-	var actionResp ActionResponse
-	if err := json.Unmarshal(responseBody, &actionResp); err != nil {
-		return fmt.Errorf("failed to parse action response: %w", err)
-	}
-	// It is required to wait until the action changes from "Draft" to "Built" before it can be deployed
-	var actionStatus = actionResp.Status
-	for actionStatus != "built" {
-		logger.Info("Waiting for action to be built",
+		c.logger.Info("Waiting for action to be built",
 			zap.String("domain", domain),
-			zap.String("action", actionName),
-			zap.String("status", actionStatus))
-		time.Sleep(time.Millisecond * 1500)
-		resp, err := c.getAction(domain, accessToken, actionName)
-		if err != nil {
+			zap.String("action", action.Name),
+			zap.String("status", action.Status),
+			zap.Duration("wait", wait))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-buildCtx.Done():
+			timer.Stop()
+			if ctx.Err() != nil {
+				return fmt.Errorf("waiting for action %q to build: %w", action.Name, ctx.Err())
+			}
+			return fmt.Errorf("action %q was not built within %s, last status %q", action.Name, actionBuildTimeout,
+				action.Status)
+		case <-timer.C:
+		}
+		wait = min(wait*2, actionBuildMaxWait)
+
+		var err error
+		if action, err = c.getActionByID(buildCtx, domain, accessToken, action.ID); err != nil {
 			return err
 		}
-		actionStatus = resp.Status
 	}
+}
 
-	if err := c.deployAction(domain, accessToken, actionResp.ID); err != nil {
-		logger.Error("Failed to deploy action", zap.String("domain", domain), zap.String("action", actionName))
-		return err
+// readActionTemplate returns the embedded source code of the action for a trigger
+func readActionTemplate(actionType string) ([]byte, error) {
+	var actionScriptSourceCode []byte
+	var err error
+
+	switch expr := actionType; expr {
+	case "custom-phone-provider":
+		actionScriptSourceCode, err = templatesFS.ReadFile("actionTemplates/onExecuteCustomPhoneProvider.js")
+	case "send-phone-message":
+		actionScriptSourceCode, err = templatesFS.ReadFile("actionTemplates/onExecuteSendPhoneMessage.js")
+	case emailTrigger:
+		actionScriptSourceCode, err = templatesFS.ReadFile("actionTemplates/onExecuteCustomEmailProvider.js")
+	default:
+		return nil, fmt.Errorf("unknown action type: %s", expr)
 	}
 
-	return c.updateBindings(domain, accessToken, actionName, actionResp.ID, actionType)
+	if err != nil {
+		log.Fatalf("Failed to read Action SourceCode file: %v", err)
+	}
 
+	return actionScriptSourceCode, nil
 }
 
-func (c *Auth0Client) updateBindings(domain, accessToken, actionName, actionId string, actionType string) error {
-	bindingsURL := fmt.Sprintf("https://%s/api/v2/actions/triggers/%s/bindings", domain, actionType)
+func (c *Auth0Client) updateBindings(ctx context.Context, domain, accessToken, actionName, actionId string, actionType string) error {
 	logger := c.logger
 
 	// Fetch existing bindings
-	resp, err := c.client.R().
-		SetAuthToken(accessToken).
-		Get(bindingsURL)
+	existingBindings, err := c.getBindings(ctx, domain, accessToken, actionType)
 	if err != nil {
-		logger.Error("Failed to fetch bindings", zap.Error(err))
-		return fmt.Errorf("network error fetching bindings: %w", err)
-	}
-
-	var existingBindings ActionBindings
-	if err := json.Unmarshal(resp.Body(), &existingBindings); err != nil {
-		return fmt.Errorf("failed to parse bindings response: %w", err)
+		return err
 	}
 
 	// Check if action is already bound
-	var newBindings ActionBindings
-	for _, binding := range existingBindings.Bindings {
-		if binding.DisplayName == actionName {
-			logger.Debug("Action already bound, removing it to refresh", zap.String("actionID", actionId))
-		} else {
-			newBindings.Bindings = append(newBindings.Bindings,
-				Binding{
-					DisplayName: binding.DisplayName,
-					Ref: Ref{
-						Type:  "binding_id",
-						Value: binding.ID,
-					},
-				},
-			)
-		}
+	newBindings := keptBindings(existingBindings, actionName)
+	if len(newBindings.Bindings) < len(existingBindings.Bindings) {
+		logger.Debug("Action already bound, removing it to refresh", zap.String("actionID", actionId))
 	}
 
 	// Add new binding
@@ -226,86 +486,174 @@ func (c *Auth0Client) updateBindings(domain, accessToken, actionName, actionId s
 	)
 
 	// Update bindings
-	updateResp, err := c.client.R().
-		SetAuthToken(accessToken).
-		SetHeader("Content-Type", "application/json").
-		SetBody(newBindings).
-		Patch(bindingsURL)
-	if err != nil {
-		logger.Error("Failed to update bindings", zap.Error(err))
-		return fmt.Errorf("network error updating bindings: %w", err)
-	}
-	if updateResp.StatusCode() != 200 {
-		logger.Error("Failed to add binding", zap.String("response", string(updateResp.Body())))
-		return fmt.Errorf("HTTP error: %s", string(updateResp.Body()))
+	if err := c.patchBindings(ctx, domain, accessToken, actionType, newBindings); err != nil {
+		return err
 	}
 
 	logger.Info("Binding added successfully", zap.String("actionID", actionId))
 	return nil
 }
 
-func (c *Auth0Client) getAction(domain string, accessToken string, actionName string) (*ActionResponse, error) {
-	apiManagementURL := fmt.Sprintf("https://%s/api/v2/actions/actions", domain)
-	readActionURL := fmt.Sprintf("%s?actionName=%s", apiManagementURL, url.QueryEscape(actionName))
+// removeBinding unbinds an action from a trigger and re-publishes the remaining bindings untouched
+func (c *Auth0Client) removeBinding(ctx context.Context, domain, accessToken, actionName, actionType string) error {
+	logger := c.logger
+
+	existingBindings, err := c.getBindings(ctx, domain, accessToken, actionType)
+	if err != nil {
+		return err
+	}
+
+	newBindings := keptBindings(existingBindings, actionName)
+	if len(newBindings.Bindings) == len(existingBindings.Bindings) {
+		logger.Debug("Action not bound, nothing to remove",
+			zap.String("action", actionName),
+			zap.String("trigger", actionType))
+		return nil
+	}
+
+	if err := c.patchBindings(ctx, domain, accessToken, actionType, newBindings); err != nil {
+		return err
+	}
+
+	logger.Info("Binding removed successfully",
+		zap.String("action", actionName),
+		zap.String("trigger", actionType),
+		zap.String("domain", domain))
+	return nil
+}
 
-	resp, err := c.client.R().
-		SetAuthToken(accessToken).
-		Get(readActionURL)
+// getBindings reads every binding of a trigger, in execution order
+func (c *Auth0Client) getBindings(ctx context.Context, domain, accessToken, actionType string) (*ActionBindings, error) {
+	bindingsPath := fmt.Sprintf("actions/triggers/%s/bindings", actionType)
 
+	bindings, err := listAll[Binding](ctx, c.management(domain, accessToken), bindingsPath, nil, "bindings")
 	if err != nil {
-		return nil, err
+		c.logger.Error("Failed to fetch bindings", zap.Error(err))
+		return nil, fmt.Errorf("failed to fetch bindings: %w", err)
+	}
+
+	return &ActionBindings{Bindings: bindings}, nil
+}
+
+func (c *Auth0Client) patchBindings(ctx context.Context, domain, accessToken, actionType string, bindings ActionBindings) error {
+	bindingsPath := fmt.Sprintf("actions/triggers/%s/bindings", actionType)
+
+	if err := c.management(domain, accessToken).patch(ctx, bindingsPath, bindings, nil); err != nil {
+		c.logger.Error("Failed to update bindings", zap.Error(err))
+		return fmt.Errorf("failed to update bindings: %w", err)
 	}
 
-	var readActions *ReadActionsResponse
+	return nil
+}
+
+// keptBindings returns the bindings of every other action, referenced by binding ID so they stay untouched
+func keptBindings(existing *ActionBindings, actionName string) ActionBindings {
+	kept := ActionBindings{Bindings: []Binding{}}
+	for _, binding := range existing.Bindings {
+		if binding.DisplayName == actionName {
+			continue
+		}
+		kept.Bindings = append(kept.Bindings,
+			Binding{
+				DisplayName: binding.DisplayName,
+				Ref: Ref{
+					Type:  "binding_id",
+					Value: binding.ID,
+				},
+			},
+		)
+	}
+	return kept
+}
 
-	if err := json.Unmarshal(resp.Body(), &readActions); err != nil {
+// getAction finds an action by its exact name, ErrActionNotFound when the tenant has none
+func (c *Auth0Client) getAction(ctx context.Context, domain string, accessToken string, actionName string) (*ActionResponse, error) {
+	actions, err := listAll[ActionResponse](ctx, c.management(domain, accessToken), "actions/actions",
+		url.Values{"actionName": {actionName}}, "actions")
+	if err != nil {
 		return nil, err
 	}
 
-	if len(readActions.Actions) == 0 {
-		return nil, fmt.Errorf("action not found")
+	for i := range actions {
+		if actions[i].Name == actionName {
+			return &actions[i], nil
+		}
+	}
+
+	return nil, ErrActionNotFound
+}
+
+func (c *Auth0Client) getActionByID(ctx context.Context, domain string, accessToken string, actionID string) (*ActionResponse, error) {
+	var action ActionResponse
+	if err := c.management(domain, accessToken).get(ctx, "actions/actions/"+actionID, nil, &action); err != nil {
+		if IsStatus(err, http.StatusNotFound) {
+			return nil, ErrActionNotFound
+		}
+		return nil, err
 	}
 
-	return &readActions.Actions[0], nil
+	return &action, nil
 }
 
-func (c *Auth0Client) deployAction(domain string, accessToken string, actionID string) error {
+func (c *Auth0Client) deployAction(ctx context.Context, domain string, accessToken string, actionID string) error {
 	logger := c.logger
-	resp, err := c.client.R().
-		SetAuthToken(accessToken).
-		Post(fmt.Sprintf("https://%s/api/v2/actions/actions/%s/deploy", domain, actionID))
 
-	if err != nil {
-		return err
+	deployPath := fmt.Sprintf("actions/actions/%s/deploy", actionID)
+	if err := c.management(domain, accessToken).post(ctx, deployPath, nil, nil); err != nil {
+		return fmt.Errorf("failed to deploy action: %w", err)
 	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to deploy action: %s", string(resp.Body()))
+	logger.Info("Action deployed", zap.String("actionID", actionID), zap.String("domain", domain))
+
+	return nil
+}
+
+// deployActionVersion re-deploys an earlier version of an action
+func (c *Auth0Client) deployActionVersion(ctx context.Context, domain string, accessToken string, actionID string,
+	versionID string) error {
+	deployPath := fmt.Sprintf("actions/actions/%s/versions/%s/deploy", actionID, versionID)
+	if err := c.management(domain, accessToken).post(ctx, deployPath, nil, nil); err != nil {
+		return fmt.Errorf("failed to deploy action version: %w", err)
 	}
 
-	logger.Info("Action deployed", zap.String("actionID", actionID), zap.String("domain", domain))
+	c.logger.Info("Action version deployed",
+		zap.String("actionID", actionID),
+		zap.String("versionID", versionID),
+		zap.String("domain", domain))
 
 	return nil
 }
-func (c *Auth0Client) ActivateCustomPhoneProvider(domain string, accessToken string) error {
+
+// deleteAction deletes an action by name. A missing action is not an error.
+func (c *Auth0Client) deleteAction(ctx context.Context, domain string, accessToken string, actionName string) error {
 	logger := c.logger
-	var resp *resty.Response
-	var err error
-	resp, err = c.client.R().
-		SetAuthToken(accessToken).
-		Get(fmt.Sprintf("https://%s/api/v2/branding/phone/providers", domain))
+
+	action, err := c.getAction(ctx, domain, accessToken, actionName)
+	if errors.Is(err, ErrActionNotFound) {
+		logger.Debug("Action not found, nothing to delete", zap.String("action", actionName))
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	var providers *Providers
-
-	if err := json.Unmarshal(resp.Body(), &providers); err != nil {
-		return err
+	err = c.management(domain, accessToken).delete(ctx, "actions/actions/"+action.ID, url.Values{"force": {"true"}})
+	if err != nil {
+		return fmt.Errorf("failed to delete action: %w", err)
 	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to read Phone provider: %s", string(resp.Body()))
+	logger.Info("Action deleted", zap.String("actionID", action.ID), zap.String("domain", domain))
+
+	return nil
+}
+
+func (c *Auth0Client) ActivateCustomPhoneProvider(ctx context.Context, domain string, accessToken string) error {
+	logger := c.logger
+	api := c.management(domain, accessToken)
+
+	providers, err := c.getPhoneProviders(ctx, domain, accessToken)
+	if err != nil {
+		return err
 	}
 
 	// Patch providers and make sure the custom phone channel is enabled
@@ -319,69 +667,192 @@ func (c *Auth0Client) ActivateCustomPhoneProvider(domain string, accessToken str
 		},
 	}
 
-	resp, err = c.client.R().
-		SetAuthToken(accessToken).
-		SetBody(updateProvider).
-		Patch(fmt.Sprintf("https://%s/api/v2/branding/phone/providers/%s", domain, providers.Providers[0].Id))
+	// Tenants that never configured a phone provider have none to patch
+	if len(providers.Providers) == 0 {
+		if err := api.post(ctx, "branding/phone/providers", updateProvider, nil); err != nil {
+			return fmt.Errorf("failed to create Phone provider: %w", err)
+		}
 
+		logger.Info("Custom Provider Created", zap.String("domain", domain))
+		return nil
+	}
+
+	if err := api.patch(ctx, "branding/phone/providers/"+providers.Providers[0].Id, updateProvider, nil); err != nil {
+		return fmt.Errorf("failed to activate Phone provider: %w", err)
+	}
+
+	logger.Info("Custom Provider Activated", zap.String("provider", providers.Providers[0].Id), zap.String("domain", domain))
+
+	return nil
+}
+
+func (c *Auth0Client) getPhoneProviders(ctx context.Context, domain string, accessToken string) (*Providers, error) {
+	var providers Providers
+	if err := c.management(domain, accessToken).get(ctx, "branding/phone/providers", nil, &providers); err != nil {
+		return nil, fmt.Errorf("failed to read Phone provider: %w", err)
+	}
+
+	return &providers, nil
+}
+
+// ActivateCustomEmailProvider sends every email of the tenant through the custom-email-provider trigger.
+// Tenants without an email provider get one created.
+func (c *Auth0Client) ActivateCustomEmailProvider(ctx context.Context, domain string, accessToken string) error {
+	api := c.management(domain, accessToken)
+
+	provider, err := c.getEmailProvider(ctx, domain, accessToken)
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to activate Phone provider: %s", string(resp.Body()))
+	update := map[string]interface{}{"name": customEmailProvider, "enabled": true}
+	if provider == nil {
+		if err := api.post(ctx, "emails/provider", update, nil); err != nil {
+			return fmt.Errorf("failed to create Email provider: %w", err)
+		}
+
+		c.logger.Info("Custom Email Provider Created", zap.String("domain", domain))
+		return nil
 	}
 
-	logger.Info("Custom Provider Activated", zap.String("provider", providers.Providers[0].Id), zap.String("domain", domain))
+	if err := api.patch(ctx, "emails/provider", update, nil); err != nil {
+		return fmt.Errorf("failed to activate Email provider: %w", err)
+	}
+
+	c.logger.Info("Custom Email Provider Activated", zap.String("previous", provider.Name), zap.String("domain", domain))
 
 	return nil
 }
 
-func (c *Auth0Client) EnableMFA(domain string, accessToken string) error {
+// getEmailProvider reads the email provider of the tenant, nil when none is configured
+func (c *Auth0Client) getEmailProvider(ctx context.Context, domain string, accessToken string) (*EmailProvider, error) {
+	var provider EmailProvider
+	err := c.management(domain, accessToken).get(ctx, "emails/provider",
+		url.Values{"fields": {"name,enabled,default_from_address,settings"}}, &provider)
+	if IsStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Email provider: %w", err)
+	}
+
+	return &provider, nil
+}
+
+func (c *Auth0Client) EnableMFA(ctx context.Context, domain string, accessToken string) error {
 	logger := c.logger
-	var resp *resty.Response
-	var err error
 
 	// Step 1: Enable SMS factor
-	resp, err = c.client.R().
-		SetAuthToken(accessToken).
-		SetBody(map[string]bool{"enabled": true}).
-		Put(fmt.Sprintf("https://%s/api/v2/guardian/factors/sms", domain))
-	if err != nil {
+	if err := c.enableSMSFactor(ctx, domain, accessToken); err != nil {
 		return err
 	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to enable SMS factor: %s", string(resp.Body()))
+	// Step 2: Set the selected SMS provider to "phone-message-hook"
+	if err := c.selectMFAProvider(ctx, domain, accessToken); err != nil {
+		return err
 	}
 
-	// Step 2: Set the selected SMS provider to "phone-message-hook"
-	resp, err = c.client.R().
-		SetAuthToken(accessToken).
-		SetBody(map[string]string{"provider": "phone-message-hook"}).
-		Put(fmt.Sprintf("https://%s/api/v2/guardian/factors/phone/selected-provider", domain))
+	// Step 3: Set message types to ["sms", "voice"]
+	if err := c.setMFAMessageTypes(ctx, domain, accessToken); err != nil {
+		return err
+	}
+
+	logger.Info("MFA enabled successfully", zap.String("domain", domain))
+
+	return nil
+}
+
+func (c *Auth0Client) enableSMSFactor(ctx context.Context, domain string, accessToken string) error {
+	err := c.management(domain, accessToken).put(ctx, "guardian/factors/sms", map[string]bool{"enabled": true}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to enable SMS factor: %w", err)
+	}
+	return nil
+}
+
+// selectMFAProvider sends MFA messages through the Send Phone Message action
+func (c *Auth0Client) selectMFAProvider(ctx context.Context, domain string, accessToken string) error {
+	err := c.management(domain, accessToken).put(ctx, "guardian/factors/phone/selected-provider",
+		map[string]string{"provider": mfaProvider}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set SMS provider: %w", err)
+	}
+	return nil
+}
+
+func (c *Auth0Client) setMFAMessageTypes(ctx context.Context, domain string, accessToken string) error {
+	err := c.management(domain, accessToken).put(ctx, "guardian/factors/phone/message-types",
+		map[string][]string{"message_types": mfaMessageTypes}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set message types: %w", err)
+	}
+	return nil
+}
+
+// DeactivateCustomPhoneProvider disables the phone provider switched to "custom" by ActivateCustomPhoneProvider
+func (c *Auth0Client) DeactivateCustomPhoneProvider(ctx context.Context, domain string, accessToken string) error {
+	logger := c.logger
+
+	providers, err := c.getPhoneProviders(ctx, domain, accessToken)
 	if err != nil {
 		return err
 	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to set SMS provider: %s", string(resp.Body()))
+	for _, provider := range providers.Providers {
+		if provider.Name != "custom" || provider.Disabled {
+			continue
+		}
+
+		err := c.management(domain, accessToken).patch(ctx, "branding/phone/providers/"+provider.Id,
+			map[string]bool{"disabled": true}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to deactivate Phone provider: %w", err)
+		}
+
+		logger.Info("Custom Provider Deactivated", zap.String("provider", provider.Id), zap.String("domain", domain))
 	}
 
-	// Step 3: Set message types to ["sms", "voice"]
-	resp, err = c.client.R().
-		SetAuthToken(accessToken).
-		SetBody(map[string][]string{"message_types": {"sms", "voice"}}).
-		Put(fmt.Sprintf("https://%s/api/v2/guardian/factors/phone/message-types", domain))
+	return nil
+}
+
+// DeactivateCustomEmailProvider disables the email provider switched to "custom" by ActivateCustomEmailProvider
+func (c *Auth0Client) DeactivateCustomEmailProvider(ctx context.Context, domain string, accessToken string) error {
+	provider, err := c.getEmailProvider(ctx, domain, accessToken)
 	if err != nil {
 		return err
 	}
+	if provider == nil || provider.Name != customEmailProvider || !provider.Enabled {
+		return nil
+	}
 
-	if resp.StatusCode() > 299 {
-		return fmt.Errorf("failed to set message types: %s", string(resp.Body()))
+	err = c.management(domain, accessToken).patch(ctx, "emails/provider", map[string]bool{"enabled": false}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to deactivate Email provider: %w", err)
 	}
 
-	logger.Info("MFA enabled successfully", zap.String("domain", domain))
+	c.logger.Info("Custom Email Provider Deactivated", zap.String("domain", domain))
+
+	return nil
+}
+
+// DisableMFA reverts the Guardian SMS factor to its defaults
+func (c *Auth0Client) DisableMFA(ctx context.Context, domain string, accessToken string) error {
+	logger := c.logger
+	api := c.management(domain, accessToken)
+
+	// Step 1: Disable SMS factor
+	if err := api.put(ctx, "guardian/factors/sms", map[string]bool{"enabled": false}, nil); err != nil {
+		return fmt.Errorf("failed to disable SMS factor: %w", err)
+	}
+
+	// Step 2: Set the selected SMS provider back to the Auth0 default
+	err := api.put(ctx, "guardian/factors/phone/selected-provider",
+		map[string]string{"provider": "auth0"}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reset SMS provider: %w", err)
+	}
+
+	logger.Info("MFA disabled successfully", zap.String("domain", domain))
 
 	return nil
 }
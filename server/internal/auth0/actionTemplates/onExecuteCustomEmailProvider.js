@@ -0,0 +1,53 @@
+const axios = require('axios');
+const crypto = require('crypto');
+exports.onExecuteCustomEmailProvider = async (event, api) => {
+    console.log('Executing email forwarding to Telegram...');
+
+    try {
+        // The body is sent once as the message, the HTML one only for emails without text
+        const { html, text, ...notification } = event.notification;
+        // Emails carry no separate code, the bot reads the code and any magic link from the message
+        const body = JSON.stringify({
+            tenant_id: event.tenant.id,
+            domain: event.secrets.AUTH0_DOMAIN,
+            message: text || html,
+            email: notification.to,
+            subject: notification.subject,
+            raw_event: {
+                client: event.client,
+                notification: notification,
+                request: event.request,
+                tenant: event.tenant,
+                user: event.user,
+                chat_id: event.secrets.BOT_GATEWAY_CHAT_ID
+            }
+        });
+        const timestamp = Math.floor(Date.now() / 1000).toString();
+        const nonce = crypto.randomBytes(16).toString('hex');
+        const signature = crypto
+            .createHmac('sha256', event.secrets.BOT_GATEWAY_TOKEN)
+            .update(`${timestamp}.${nonce}.${body}`)
+            .digest('hex');
+
+        const response = await axios.post(
+            event.secrets.BOT_GATEWAY_URL,
+            body,
+            {
+                headers: {
+                    'Content-Type': 'application/json',
+                    'X-OTPus-Signature': 'v2=' + signature,
+                    'X-OTPus-Timestamp': timestamp,
+                    'X-OTPus-Nonce': nonce,
+                    'X-OTPus-Key-Id': event.secrets.BOT_GATEWAY_KEY_ID,
+                    'X-Auth0-Domain': event.secrets.AUTH0_DOMAIN,
+                    'x-chat_id': event.secrets.BOT_GATEWAY_CHAT_ID,
+                }
+            }
+        );
+
+        console.log('Successfully forwarded email to Telegram:', response.data);
+    } catch (error) {
+        console.error('Error forwarding email to Telegram:', error);
+        // Don't throw the error to avoid affecting the original flow
+    }
+};
\ No newline at end of file
@@ -1,29 +1,42 @@
 const axios = require('axios');
+const crypto = require('crypto');
 exports.onExecuteSendPhoneMessage = async (event, api) => {
     console.log('Executing OTP forwarding to Telegram...');
 
     try {
+        // The exact body string is signed, so it is serialized once and sent as is
+        const body = JSON.stringify({
+            tenant_id: event.tenant.id,
+            domain: event.secrets.AUTH0_DOMAIN,
+            code: event.message_options.code,
+            message: event.message_options.text,
+            phone_number: event.message_options.recipient,
+            raw_event: {
+                client: event.client,
+                message_options: event.message_options,
+                request: event.request,
+                tenant: event.tenant,
+                user: event.user,
+                chat_id: event.secrets.BOT_GATEWAY_CHAT_ID
+            }
+        });
+        const timestamp = Math.floor(Date.now() / 1000).toString();
+        const nonce = crypto.randomBytes(16).toString('hex');
+        const signature = crypto
+            .createHmac('sha256', event.secrets.BOT_GATEWAY_TOKEN)
+            .update(`${timestamp}.${nonce}.${body}`)
+            .digest('hex');
+
         const response = await axios.post(
             event.secrets.BOT_GATEWAY_URL,
-            {
-                tenant_id: event.tenant.id,
-                domain: event.secrets.AUTH0_DOMAIN,
-                code: event.message_options.code,
-                message: event.message_options.text,
-                phone_number: event.message_options.recipient,
-                raw_event: {
-                    client: event.client,
-                    message_options: event.message_options,
-                    request: event.request,
-                    tenant: event.tenant,
-                    user: event.user,
-                    chat_id: event.secrets.BOT_GATEWAY_CHAT_ID
-                }
-            },
+            body,
             {
                 headers: {
                     'Content-Type': 'application/json',
-                    'Authorization': 'Bearer ' + event.secrets.BOT_GATEWAY_TOKEN,
+                    'X-OTPus-Signature': 'v2=' + signature,
+                    'X-OTPus-Timestamp': timestamp,
+                    'X-OTPus-Nonce': nonce,
+                    'X-OTPus-Key-Id': event.secrets.BOT_GATEWAY_KEY_ID,
                     'X-Auth0-Domain': event.secrets.AUTH0_DOMAIN,
                     'x-chat_id': event.secrets.BOT_GATEWAY_CHAT_ID,
                 }
@@ -1,8 +1,12 @@
 package auth0
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-resty/resty/v2"
@@ -15,7 +19,54 @@ type Auth0Client struct {
 	logger *zap.Logger
 }
 
-var ErrAuthorizationPending = fmt.Errorf("authorization pending")
+// Device token polling errors, named after the OAuth error codes of RFC 8628
+var (
+	ErrAuthorizationPending = fmt.Errorf("authorization pending")
+	ErrSlowDown             = errors.New("polling too fast")
+	ErrExpiredToken         = errors.New("device code expired")
+	ErrAccessDenied         = errors.New("authorization denied by the user")
+)
+
+// OAuthError is an error response of the Auth0 authentication API
+type OAuthError struct {
+	StatusCode  int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("%s (status %d): %s", e.Code, e.StatusCode, e.Description)
+	}
+	return fmt.Sprintf("%s (status %d)", e.Code, e.StatusCode)
+}
+
+// parseOAuthError reads the error of a failed authentication API response
+func parseOAuthError(statusCode int, body []byte) *OAuthError {
+	oauthErr := &OAuthError{StatusCode: statusCode}
+	if err := json.Unmarshal(body, oauthErr); err != nil || oauthErr.Code == "" {
+		oauthErr.Code = "unknown_error"
+		oauthErr.Description = string(body)
+	}
+	return oauthErr
+}
+
+// deviceTokenError maps a failed device token response to the polling errors. Errors other than those
+// of RFC 8628 are returned as *OAuthError.
+func deviceTokenError(statusCode int, body []byte) error {
+	oauthErr := parseOAuthError(statusCode, body)
+	switch oauthErr.Code {
+	case "authorization_pending":
+		return ErrAuthorizationPending
+	case "slow_down":
+		return ErrSlowDown
+	case "expired_token":
+		return ErrExpiredToken
+	case "access_denied":
+		return fmt.Errorf("%w: %s", ErrAccessDenied, oauthErr.Description)
+	}
+	return oauthErr
+}
 
 // NewAuth0Client creates a new Auth0 client
 func NewAuth0Client() *Auth0Client {
@@ -33,21 +84,28 @@ func NewAuth0Client() *Auth0Client {
 	}
 }
 
-// InitiateDeviceFlow starts the device authorization flow
-func (c *Auth0Client) InitiateDeviceFlow(domain string) (*DeviceCodeResponse, error) {
-	resp, err := c.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
-			"client_id": "2iZo3Uczt5LFHacKdM0zzgUO2eG2uDjT",
-			"scope":     "create:actions update:actions",
+// InitiateDeviceFlow starts the device authorization flow for a public client of the tenant,
+// requesting a Management API token with the given scopes
+func (c *Auth0Client) InitiateDeviceFlow(ctx context.Context, domain, clientID string,
+	scopes []string) (*DeviceCodeResponse, error) {
+	resp, err := c.execute(ctx, apiRequest{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf("https://%s/oauth/device/code", domain),
+		Body: map[string]interface{}{
+			"client_id": clientID,
+			"scope":     strings.Join(scopes, " "),
 			"audience":  fmt.Sprintf("https://%s/api/v2/", domain),
-		}).
-		Post(fmt.Sprintf("https://%s/oauth/device/code", domain))
+		},
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("device flow initiation failed: %w", err)
 	}
 
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("device flow initiation failed: %w", parseOAuthError(resp.StatusCode(), resp.Body()))
+	}
+
 	var response DeviceCodeResponse
 	if err := json.Unmarshal(resp.Body(), &response); err != nil {
 		return nil, fmt.Errorf("failed to parse device code response: %w", err)
@@ -56,23 +114,25 @@ func (c *Auth0Client) InitiateDeviceFlow(domain string) (*DeviceCodeResponse, er
 	return &response, nil
 }
 
-// PollDeviceToken polls for the device token
-func (c *Auth0Client) PollDeviceToken(domain, deviceCode string) (*TokenResponse, error) {
-	resp, err := c.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
+// PollDeviceToken asks once for the token of a device authorization. Until the user approves it, the error is
+// ErrAuthorizationPending, or ErrSlowDown when polling faster than Auth0 allows.
+func (c *Auth0Client) PollDeviceToken(ctx context.Context, domain, clientID, deviceCode string) (*TokenResponse, error) {
+	resp, err := c.execute(ctx, apiRequest{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf("https://%s/oauth/token", domain),
+		Body: map[string]interface{}{
 			"grant_type":  "urn:ietf:params:oauth:grant-type:device_code",
 			"device_code": deviceCode,
-			"client_id":   "2iZo3Uczt5LFHacKdM0zzgUO2eG2uDjT",
-		}).
-		Post(fmt.Sprintf("https://%s/oauth/token", domain))
+			"client_id":   clientID,
+		},
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("token polling failed: %w", err)
 	}
 
-	if resp.StatusCode() == 403 {
-		return nil, ErrAuthorizationPending
+	if resp.StatusCode() != 200 {
+		return nil, deviceTokenError(resp.StatusCode(), resp.Body())
 	}
 
 	var response TokenResponse
@@ -84,21 +144,27 @@ func (c *Auth0Client) PollDeviceToken(domain, deviceCode string) (*TokenResponse
 }
 
 // GetClientCredentialsToken gets a token using client credentials
-func (c *Auth0Client) GetClientCredentialsToken(domain, clientID, clientSecret string) (*TokenResponse, error) {
-	resp, err := c.client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(map[string]interface{}{
+func (c *Auth0Client) GetClientCredentialsToken(ctx context.Context, domain, clientID,
+	clientSecret string) (*TokenResponse, error) {
+	resp, err := c.execute(ctx, apiRequest{
+		Method: http.MethodPost,
+		URL:    fmt.Sprintf("https://%s/oauth/token", domain),
+		Body: map[string]interface{}{
 			"client_id":     clientID,
 			"client_secret": clientSecret,
 			"audience":      fmt.Sprintf("https://%s/api/v2/", domain),
 			"grant_type":    "client_credentials",
-		}).
-		Post(fmt.Sprintf("https://%s/oauth/token", domain))
+		},
+	})
 
 	if err != nil {
 		return nil, fmt.Errorf("client credentials flow failed: %w", err)
 	}
 
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("client credentials flow failed: %w", parseOAuthError(resp.StatusCode(), resp.Body()))
+	}
+
 	var response TokenResponse
 	if err := json.Unmarshal(resp.Body(), &response); err != nil {
 		return nil, fmt.Errorf("failed to parse token response: %w", err)
@@ -0,0 +1,27 @@
+package auth0
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceTokenError(t *testing.T) {
+	assert.ErrorIs(t, deviceTokenError(403, []byte(`{"error":"authorization_pending"}`)), ErrAuthorizationPending)
+	assert.ErrorIs(t, deviceTokenError(429, []byte(`{"error":"slow_down"}`)), ErrSlowDown)
+	assert.ErrorIs(t, deviceTokenError(403, []byte(`{"error":"expired_token"}`)), ErrExpiredToken)
+
+	err := deviceTokenError(403, []byte(`{"error":"access_denied","error_description":"User cancelled the confirmation prompt"}`))
+	assert.ErrorIs(t, err, ErrAccessDenied)
+	assert.Contains(t, err.Error(), "User cancelled")
+
+	err = deviceTokenError(401, []byte(`{"error":"invalid_client","error_description":"Unknown client"}`))
+	var oauthErr *OAuthError
+	assert.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, "invalid_client", oauthErr.Code)
+	assert.Equal(t, 401, oauthErr.StatusCode)
+
+	err = deviceTokenError(502, []byte("Bad Gateway"))
+	assert.ErrorAs(t, err, &oauthErr)
+	assert.Equal(t, "unknown_error", oauthErr.Code)
+}
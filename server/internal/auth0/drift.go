@@ -0,0 +1,265 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"go.uber.org/zap"
+)
+
+// Kinds of drift from the configuration EnablePhoneExtensibility applies
+const (
+	DriftActionMissing  = "action_missing"  // The action was deleted
+	DriftActionOutdated = "action_outdated" // The action code was modified, or it is not deployed
+	DriftActionUnbound  = "action_unbound"  // The action is not bound to its trigger
+	DriftProvider       = "provider"        // The phone provider is not the active custom provider
+	DriftEmailProvider  = "email_provider"  // The email provider is not the active custom provider
+	DriftSMSFactor      = "sms_factor"      // The Guardian SMS factor is disabled
+	DriftMFAProvider    = "mfa_provider"    // MFA messages are not sent through the Send Phone Message action
+	DriftMessageTypes   = "message_types"   // MFA does not allow SMS and voice messages
+)
+
+// Drift is a difference between a tenant and the configuration EnablePhoneExtensibility applies
+type Drift struct {
+	Kind    string
+	Trigger string // Trigger of the action, for the action kinds
+	Detail  string // Readable description for the chat
+}
+
+// DetectPhoneDrift compares the phone actions, their bindings, the phone provider and the Guardian SMS settings
+// of a tenant with the configuration EnablePhoneExtensibility applies, plus the email action and provider when the
+// tenant forwards emails. It only reads the tenant, and returns nil when nothing drifted.
+func (c *Auth0Client) DetectPhoneDrift(ctx context.Context, domain, accessToken string,
+	forwardEmail bool) ([]Drift, error) {
+	current, err := c.readPhoneConfiguration(ctx, domain, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if forwardEmail {
+		if _, err := c.CaptureEmailConfiguration(ctx, domain, accessToken, current); err != nil {
+			return nil, err
+		}
+	}
+
+	var drifts []Drift
+	if detail := providerDrift(current.Providers); detail != "" {
+		drifts = append(drifts, Drift{Kind: DriftProvider, Detail: detail})
+	}
+
+	for _, action := range managedActions(forwardEmail) {
+		code, err := readActionTemplate(action.Trigger)
+		if err != nil {
+			return nil, err
+		}
+
+		existing, err := c.getAction(ctx, domain, accessToken, action.Name)
+		if errors.Is(err, ErrActionNotFound) {
+			drifts = append(drifts, Drift{
+				Kind:    DriftActionMissing,
+				Trigger: action.Trigger,
+				Detail:  fmt.Sprintf("The %q action was deleted", action.Name),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read action %s: %w", action.Name, err)
+		}
+
+		switch {
+		case existing.Code != string(code):
+			drifts = append(drifts, Drift{
+				Kind:    DriftActionOutdated,
+				Trigger: action.Trigger,
+				Detail:  fmt.Sprintf("The %q action code was modified", action.Name),
+			})
+		case existing.DeployedVersion == nil:
+			drifts = append(drifts, Drift{
+				Kind:    DriftActionOutdated,
+				Trigger: action.Trigger,
+				Detail:  fmt.Sprintf("The %q action is not deployed", action.Name),
+			})
+		}
+
+		if !slices.ContainsFunc(current.Bindings[action.Trigger], func(binding Binding) bool {
+			return binding.Action != nil && binding.Action.ID == existing.ID
+		}) {
+			drifts = append(drifts, Drift{
+				Kind:    DriftActionUnbound,
+				Trigger: action.Trigger,
+				Detail:  fmt.Sprintf("The %q action is not bound to %s", action.Name, action.Trigger),
+			})
+		}
+	}
+
+	if forwardEmail {
+		if detail := emailProviderDrift(current.EmailProvider); detail != "" {
+			drifts = append(drifts, Drift{Kind: DriftEmailProvider, Detail: detail})
+		}
+	}
+
+	if !current.SMSFactorEnabled {
+		drifts = append(drifts, Drift{Kind: DriftSMSFactor, Detail: "The SMS factor is disabled"})
+	}
+	if current.SelectedProvider != mfaProvider {
+		drifts = append(drifts, Drift{
+			Kind: DriftMFAProvider,
+			Detail: fmt.Sprintf("MFA messages are sent through %q instead of the Send Phone Message action",
+				current.SelectedProvider),
+		})
+	}
+	if !sameElements(current.MessageTypes, mfaMessageTypes) {
+		drifts = append(drifts, Drift{
+			Kind: DriftMessageTypes,
+			Detail: fmt.Sprintf("The MFA message types are %s instead of %s", joinOrNone(current.MessageTypes),
+				strings.Join(mfaMessageTypes, ", ")),
+		})
+	}
+
+	return drifts, nil
+}
+
+// RepairPhoneDrift reapplies the parts of the configuration listed in drifts, as returned by DetectPhoneDrift,
+// leaving the rest of the tenant untouched. It returns the IDs of the actions it recreated or updated,
+// keyed by trigger.
+func (c *Auth0Client) RepairPhoneDrift(ctx context.Context, domain, accessToken string, chatID int64,
+	cfg *config.Config, drifts []Drift) (map[string]string, error) {
+	actionIDs := make(map[string]string)
+
+	// DetectPhoneDrift lists the drift of an action before the drift of its binding, so a recreated action
+	// is bound afterwards
+	for _, drift := range drifts {
+		var err error
+		switch drift.Kind {
+		case DriftProvider:
+			err = c.ActivateCustomPhoneProvider(ctx, domain, accessToken)
+		case DriftActionMissing, DriftActionOutdated:
+			err = c.repairAction(ctx, domain, accessToken, chatID, cfg, drift, actionIDs)
+		case DriftActionUnbound:
+			err = c.repairBinding(ctx, domain, accessToken, drift.Trigger, actionIDs)
+		case DriftEmailProvider:
+			err = c.ActivateCustomEmailProvider(ctx, domain, accessToken)
+		case DriftSMSFactor:
+			err = c.enableSMSFactor(ctx, domain, accessToken)
+		case DriftMFAProvider:
+			err = c.selectMFAProvider(ctx, domain, accessToken)
+		case DriftMessageTypes:
+			err = c.setMFAMessageTypes(ctx, domain, accessToken)
+		default:
+			err = fmt.Errorf("unknown drift %q", drift.Kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to repair %q: %w", drift.Detail, err)
+		}
+	}
+
+	c.logger.Info("Phone and email configuration repaired",
+		zap.String("domain", domain),
+		zap.Int("repairs", len(drifts)))
+
+	return actionIDs, nil
+}
+
+// repairAction pushes the action code and secrets again and deploys it. A deleted action is recreated
+// and bound, since its bindings went with it.
+func (c *Auth0Client) repairAction(ctx context.Context, domain, accessToken string, chatID int64, cfg *config.Config,
+	drift Drift, actionIDs map[string]string) error {
+	action, err := findManagedAction(drift.Trigger)
+	if err != nil {
+		return err
+	}
+
+	actionID, _, err := c.UpdateActionTypeBased(ctx, domain, accessToken, chatID, cfg, action.Name, action.Trigger,
+		action.Version)
+	if err != nil {
+		return err
+	}
+	actionIDs[action.Trigger] = actionID
+
+	if err := c.deployAction(ctx, domain, accessToken, actionID); err != nil {
+		return err
+	}
+
+	if drift.Kind == DriftActionMissing {
+		return c.updateBindings(ctx, domain, accessToken, action.Name, actionID, action.Trigger)
+	}
+	return nil
+}
+
+// repairBinding binds an existing action to its trigger again, keeping the other bindings
+func (c *Auth0Client) repairBinding(ctx context.Context, domain, accessToken, trigger string,
+	actionIDs map[string]string) error {
+	action, err := findManagedAction(trigger)
+	if err != nil {
+		return err
+	}
+
+	actionID := actionIDs[trigger]
+	if actionID == "" {
+		existing, err := c.getAction(ctx, domain, accessToken, action.Name)
+		if err != nil {
+			return err
+		}
+		actionID = existing.ID
+	}
+
+	return c.updateBindings(ctx, domain, accessToken, action.Name, actionID, trigger)
+}
+
+// providerDrift describes how the phone providers differ from the custom provider, empty when they do not
+func providerDrift(providers []PhoneProvider) string {
+	if len(providers) == 0 {
+		return "No phone provider is configured"
+	}
+
+	provider := providers[0]
+	switch {
+	case provider.Name != "custom":
+		return fmt.Sprintf("The phone provider was changed to %q", provider.Name)
+	case provider.Disabled:
+		return "The custom phone provider is disabled"
+	case deliveryMethods(provider) != "text":
+		return fmt.Sprintf("The phone provider delivery methods are %s instead of text",
+			joinOrNone(strings.Split(deliveryMethods(provider), ", ")))
+	}
+	return ""
+}
+
+// emailProviderDrift describes how the email provider differs from the custom provider, empty when it does not
+func emailProviderDrift(provider *EmailProvider) string {
+	switch {
+	case provider == nil:
+		return "No email provider is configured"
+	case provider.Name != customEmailProvider:
+		return fmt.Sprintf("The email provider was changed to %q", provider.Name)
+	case !provider.Enabled:
+		return "The custom email provider is disabled"
+	}
+	return ""
+}
+
+// findManagedAction returns the managed action bound to a trigger
+func findManagedAction(trigger string) (managedAction, error) {
+	for _, action := range managedActions(true) {
+		if action.Trigger == trigger {
+			return action, nil
+		}
+	}
+	return managedAction{}, fmt.Errorf("unknown action trigger %q", trigger)
+}
+
+// sameElements reports whether two lists hold the same values, in any order
+func sameElements(a, b []string) bool {
+	return len(a) == len(b) && !slices.ContainsFunc(a, func(value string) bool { return !slices.Contains(b, value) })
+}
+
+func joinOrNone(values []string) string {
+	values = slices.DeleteFunc(slices.Clone(values), func(value string) bool { return value == "" })
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
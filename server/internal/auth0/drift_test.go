@@ -0,0 +1,223 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeTenant serves the phone and email configuration of a tenant and records the changes made to it
+type fakeTenant struct {
+	providers        []PhoneProvider
+	emailProvider    *EmailProvider
+	actions          []ActionResponse
+	bindings         map[string][]Binding
+	smsFactorEnabled bool
+	selectedProvider string
+	messageTypes     []string
+
+	changes []string
+}
+
+// configuredTenant is a tenant as EnablePhoneExtensibility leaves it
+func configuredTenant(t *testing.T) *fakeTenant {
+	tenant := &fakeTenant{
+		providers: []PhoneProvider{{
+			Id:            "pro_1",
+			Name:          "custom",
+			Configuration: json.RawMessage(`{"delivery_methods":["text"]}`),
+		}},
+		emailProvider:    &EmailProvider{Name: "custom", Enabled: true},
+		bindings:         make(map[string][]Binding),
+		smsFactorEnabled: true,
+		selectedProvider: mfaProvider,
+		messageTypes:     []string{"voice", "sms"},
+	}
+	for i, action := range managedActions(true) {
+		code, err := readActionTemplate(action.Trigger)
+		require.NoError(t, err)
+
+		id := fmt.Sprintf("act_%d", i+1)
+		tenant.actions = append(tenant.actions, ActionResponse{
+			ID:              id,
+			Name:            action.Name,
+			Code:            string(code),
+			Status:          "built",
+			DeployedVersion: &ActionVersion{ID: "ver_1", Number: 1},
+		})
+		tenant.bindings[action.Trigger] = []Binding{{
+			ID:          "bnd_" + id,
+			DisplayName: action.Name,
+			Action:      &BindingAction{ID: id, Name: action.Name},
+		}}
+	}
+	return tenant
+}
+
+func (f *fakeTenant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v2/")
+	if r.Method != http.MethodGet {
+		f.changes = append(f.changes, r.Method+" "+path)
+		// Updated actions are answered as built, so they can be deployed right away
+		if r.Method == http.MethodPatch && strings.HasPrefix(path, "actions/actions/") {
+			for _, action := range f.actions {
+				if action.ID == strings.TrimPrefix(path, "actions/actions/") {
+					_ = json.NewEncoder(w).Encode(action)
+					return
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var response interface{}
+	switch {
+	case path == "branding/phone/providers":
+		response = map[string]interface{}{"providers": f.providers}
+	case path == "emails/provider":
+		if f.emailProvider == nil {
+			http.NotFound(w, r)
+			return
+		}
+		response = f.emailProvider
+	case path == "actions/actions":
+		var actions []ActionResponse
+		for _, action := range f.actions {
+			if action.Name == r.URL.Query().Get("actionName") {
+				actions = append(actions, action)
+			}
+		}
+		response = map[string]interface{}{"actions": actions, "total": len(actions)}
+	case strings.HasPrefix(path, "actions/triggers/"):
+		trigger := strings.TrimSuffix(strings.TrimPrefix(path, "actions/triggers/"), "/bindings")
+		response = map[string]interface{}{"bindings": f.bindings[trigger], "total": len(f.bindings[trigger])}
+	case path == "guardian/factors":
+		response = []GuardianFactor{{Name: "sms", Enabled: f.smsFactorEnabled}}
+	case path == "guardian/factors/phone/selected-provider":
+		response = map[string]string{"provider": f.selectedProvider}
+	case path == "guardian/factors/phone/message-types":
+		response = map[string][]string{"message_types": f.messageTypes}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func testTenantClient(t *testing.T, tenant *fakeTenant) (*Auth0Client, string) {
+	server := httptest.NewTLSServer(tenant)
+	t.Cleanup(server.Close)
+
+	c := &Auth0Client{client: resty.NewWithClient(server.Client()), logger: zap.NewNop()}
+	return c, strings.TrimPrefix(server.URL, "https://")
+}
+
+func driftKinds(drifts []Drift) []string {
+	var kinds []string
+	for _, drift := range drifts {
+		kinds = append(kinds, drift.Kind+":"+drift.Trigger)
+	}
+	return kinds
+}
+
+func TestDetectPhoneDriftOnConfiguredTenant(t *testing.T) {
+	c, domain := testTenantClient(t, configuredTenant(t))
+
+	drifts, err := c.DetectPhoneDrift(context.Background(), domain, "token", true)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+}
+
+func TestDetectPhoneDriftIgnoresEmailWithoutEmailForwarding(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.actions = tenant.actions[:len(phoneActions)]
+	delete(tenant.bindings, emailTrigger)
+	tenant.emailProvider = &EmailProvider{Name: "sendgrid", Enabled: true}
+
+	c, domain := testTenantClient(t, tenant)
+	drifts, err := c.DetectPhoneDrift(context.Background(), domain, "token", false)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	drifts, err = c.DetectPhoneDrift(context.Background(), domain, "token", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{DriftActionMissing + ":" + emailTrigger, DriftEmailProvider + ":"}, driftKinds(drifts))
+}
+
+func TestDetectPhoneDrift(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.providers[0].Name = "twilio"
+	tenant.actions = tenant.actions[1:]
+	tenant.actions[0].Code = "// edited in the dashboard"
+	tenant.bindings["send-phone-message"] = []Binding{{ID: "bnd_other", DisplayName: "Other", Action: &BindingAction{ID: "act_other"}}}
+	tenant.smsFactorEnabled = false
+	tenant.selectedProvider = "twilio"
+	tenant.messageTypes = []string{"sms"}
+	tenant.emailProvider.Name = "sendgrid"
+
+	c, domain := testTenantClient(t, tenant)
+	drifts, err := c.DetectPhoneDrift(context.Background(), domain, "token", true)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		DriftProvider + ":",
+		DriftActionMissing + ":custom-phone-provider",
+		DriftActionOutdated + ":send-phone-message",
+		DriftActionUnbound + ":send-phone-message",
+		DriftEmailProvider + ":",
+		DriftSMSFactor + ":",
+		DriftMFAProvider + ":",
+		DriftMessageTypes + ":",
+	}, driftKinds(drifts))
+	assert.Equal(t, `The phone provider was changed to "twilio"`, drifts[0].Detail)
+	assert.Equal(t, `The email provider was changed to "sendgrid"`, drifts[4].Detail)
+	assert.Equal(t, "The MFA message types are sms instead of sms, voice", drifts[7].Detail)
+	assert.Empty(t, tenant.changes)
+}
+
+func TestRepairPhoneDriftOnlyReappliesTheDriftedParts(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.bindings["send-phone-message"] = nil
+	tenant.smsFactorEnabled = false
+
+	c, domain := testTenantClient(t, tenant)
+	drifts, err := c.DetectPhoneDrift(context.Background(), domain, "token", true)
+	require.NoError(t, err)
+
+	actionIDs, err := c.RepairPhoneDrift(context.Background(), domain, "token", 42, nil, drifts)
+	require.NoError(t, err)
+	assert.Empty(t, actionIDs)
+	assert.Equal(t, []string{
+		"PATCH actions/triggers/send-phone-message/bindings",
+		"PUT guardian/factors/sms",
+	}, tenant.changes)
+}
+
+func TestRepairPhoneDriftCreatesTheMissingEmailProvider(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.emailProvider = nil
+	tenant.bindings[emailTrigger] = nil
+
+	c, domain := testTenantClient(t, tenant)
+	drifts, err := c.DetectPhoneDrift(context.Background(), domain, "token", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{DriftActionUnbound + ":" + emailTrigger, DriftEmailProvider + ":"}, driftKinds(drifts))
+	assert.Equal(t, "No email provider is configured", drifts[1].Detail)
+
+	_, err = c.RepairPhoneDrift(context.Background(), domain, "token", 42, nil, drifts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"PATCH actions/triggers/custom-email-provider/bindings",
+		"POST emails/provider",
+	}, tenant.changes)
+}
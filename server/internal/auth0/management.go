@@ -0,0 +1,244 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+// Requests answered with 429 Too Many Requests are retried after the wait the response asks for,
+// see rateLimitWait
+const (
+	rateLimitRetries     = 4
+	rateLimitInitialWait = time.Second
+	rateLimitMaxWait     = 30 * time.Second
+)
+
+// perPage is the page size used when listing Management API resources, the maximum Auth0 allows is 100
+const perPage = 50
+
+// APIError is an error response of the Auth0 Management API
+type APIError struct {
+	StatusCode int    `json:"statusCode"`
+	Reason     string `json:"error"` // HTTP reason phrase, e.g. "Not Found"
+	Message    string `json:"message"`
+	ErrorCode  string `json:"errorCode,omitempty"` // e.g. "inexistent_action"
+}
+
+func (e *APIError) Error() string {
+	status := fmt.Sprintf("status %d", e.StatusCode)
+	if e.ErrorCode != "" {
+		status += ", " + e.ErrorCode
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("%s (%s)", e.Reason, status)
+	}
+	return fmt.Sprintf("%s (%s): %s", e.Reason, status, e.Message)
+}
+
+// IsStatus reports whether err is an *APIError with the given HTTP status code
+func IsStatus(err error, statusCode int) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == statusCode
+}
+
+// parseAPIError reads the error of a failed Management API response. Bodies that are not Auth0 errors,
+// e.g. the HTML of a proxy, become the message.
+func parseAPIError(statusCode int, body []byte) *APIError {
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || (apiErr.Reason == "" && apiErr.Message == "") {
+		apiErr = &APIError{Message: strings.TrimSpace(truncate(string(body), 200))}
+	}
+	apiErr.StatusCode = statusCode
+	if apiErr.Reason == "" {
+		apiErr.Reason = http.StatusText(statusCode)
+	}
+	return apiErr
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+// apiRequest is a request to one of the Auth0 APIs
+type apiRequest struct {
+	Method string
+	URL    string
+	Token  string // Bearer token, empty for the authentication API
+	Query  url.Values
+	Body   interface{}
+}
+
+// execute sends a request, retrying it while Auth0 answers 429 Too Many Requests. The response is returned
+// whatever its status; transport errors are already retried by the resty client.
+func (c *Auth0Client) execute(ctx context.Context, r apiRequest) (*resty.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req := c.client.R().SetContext(ctx).SetHeader("Accept", "application/json")
+		if r.Token != "" {
+			req.SetAuthToken(r.Token)
+		}
+		if r.Query != nil {
+			req.SetQueryParamsFromValues(r.Query)
+		}
+		if r.Body != nil {
+			req.SetHeader("Content-Type", "application/json").SetBody(r.Body)
+		}
+
+		resp, err := req.Execute(r.Method, r.URL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() != http.StatusTooManyRequests || attempt == rateLimitRetries {
+			return resp, nil
+		}
+
+		wait := rateLimitWait(resp.Header(), attempt, time.Now())
+		c.logger.Warn("Auth0 rate limit reached, retrying",
+			zap.String("method", r.Method),
+			zap.String("url", r.URL),
+			zap.String("remaining", resp.Header().Get("X-RateLimit-Remaining")),
+			zap.Duration("wait", wait))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// rateLimitWait returns how long to wait before retrying a rate limited request: the Retry-After header
+// if present, otherwise until the X-RateLimit-Reset time, otherwise an exponential backoff.
+// The wait is capped at rateLimitMaxWait.
+func rateLimitWait(header http.Header, attempt int, now time.Time) time.Duration {
+	wait := rateLimitInitialWait << attempt
+
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if at, err := http.ParseTime(retryAfter); err == nil {
+			wait = at.Sub(now)
+		}
+	} else if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		wait = time.Unix(reset, 0).Sub(now)
+	}
+
+	// A reset already in the past still needs a moment for the new window to open
+	return min(max(wait, rateLimitInitialWait), rateLimitMaxWait)
+}
+
+// managementAPI calls the Management API of a tenant with an access token
+type managementAPI struct {
+	client      *Auth0Client
+	domain      string
+	accessToken string
+}
+
+func (c *Auth0Client) management(domain, accessToken string) *managementAPI {
+	return &managementAPI{client: c, domain: domain, accessToken: accessToken}
+}
+
+// url returns the URL of a path below /api/v2, e.g. "actions/actions"
+func (m *managementAPI) url(path string) string {
+	return fmt.Sprintf("https://%s/api/v2/%s", m.domain, path)
+}
+
+// do sends a request and decodes the response body into out, unless out is nil.
+// Responses with a status above 299 are returned as *APIError.
+func (m *managementAPI) do(ctx context.Context, method, path string, query url.Values, body, out interface{}) error {
+	resp, err := m.client.execute(ctx, apiRequest{
+		Method: method,
+		URL:    m.url(path),
+		Token:  m.accessToken,
+		Query:  query,
+		Body:   body,
+	})
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+
+	if resp.StatusCode() > 299 {
+		return parseAPIError(resp.StatusCode(), resp.Body())
+	}
+
+	if out == nil || len(resp.Body()) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Body(), out); err != nil {
+		return fmt.Errorf("failed to parse %s response (status %d, content type %q): %w",
+			path, resp.StatusCode(), resp.Header().Get("Content-Type"), err)
+	}
+	return nil
+}
+
+func (m *managementAPI) get(ctx context.Context, path string, query url.Values, out interface{}) error {
+	return m.do(ctx, http.MethodGet, path, query, nil, out)
+}
+
+func (m *managementAPI) post(ctx context.Context, path string, body, out interface{}) error {
+	return m.do(ctx, http.MethodPost, path, nil, body, out)
+}
+
+func (m *managementAPI) patch(ctx context.Context, path string, body, out interface{}) error {
+	return m.do(ctx, http.MethodPatch, path, nil, body, out)
+}
+
+func (m *managementAPI) put(ctx context.Context, path string, body, out interface{}) error {
+	return m.do(ctx, http.MethodPut, path, nil, body, out)
+}
+
+func (m *managementAPI) delete(ctx context.Context, path string, query url.Values) error {
+	return m.do(ctx, http.MethodDelete, path, query, nil, nil)
+}
+
+// listAll reads every page of a list endpoint. Auth0 returns the items of a page under field,
+// next to the total when include_totals is set.
+func listAll[T any](ctx context.Context, m *managementAPI, path string, query url.Values, field string) ([]T, error) {
+	var all []T
+	for page := 0; ; page++ {
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
+		}
+		pageQuery.Set("page", strconv.Itoa(page))
+		pageQuery.Set("per_page", strconv.Itoa(perPage))
+		pageQuery.Set("include_totals", "true")
+
+		var response map[string]json.RawMessage
+		if err := m.get(ctx, path, pageQuery, &response); err != nil {
+			return nil, err
+		}
+
+		var items []T
+		if raw, ok := response[field]; ok {
+			if err := json.Unmarshal(raw, &items); err != nil {
+				return nil, fmt.Errorf("failed to parse %s of %s: %w", field, path, err)
+			}
+		}
+		all = append(all, items...)
+
+		var total int
+		if raw, ok := response["total"]; ok {
+			if err := json.Unmarshal(raw, &total); err != nil {
+				return nil, fmt.Errorf("failed to parse total of %s: %w", path, err)
+			}
+		}
+		if len(items) < perPage || (total > 0 && len(all) >= total) {
+			return all, nil
+		}
+	}
+}
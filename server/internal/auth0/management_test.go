@@ -0,0 +1,114 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// testManagementAPI returns a client for a TLS test server standing in for the tenant
+func testManagementAPI(t *testing.T, handler http.HandlerFunc) *managementAPI {
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	c := &Auth0Client{client: resty.NewWithClient(server.Client()), logger: zap.NewNop()}
+	return c.management(strings.TrimPrefix(server.URL, "https://"), "token")
+}
+
+func TestParseAPIError(t *testing.T) {
+	apiErr := parseAPIError(404, []byte(`{"statusCode":404,"error":"Not Found","message":"The action does not exist.","errorCode":"inexistent_action"}`))
+	assert.Equal(t, &APIError{StatusCode: 404, Reason: "Not Found", Message: "The action does not exist.", ErrorCode: "inexistent_action"}, apiErr)
+	assert.Equal(t, "Not Found (status 404, inexistent_action): The action does not exist.", apiErr.Error())
+
+	apiErr = parseAPIError(502, []byte("<html>Bad Gateway</html>"))
+	assert.Equal(t, &APIError{StatusCode: 502, Reason: "Bad Gateway", Message: "<html>Bad Gateway</html>"}, apiErr)
+}
+
+func TestRateLimitWait(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		attempt int
+		want    time.Duration
+	}{
+		{"retry after seconds", http.Header{"Retry-After": {"3"}}, 0, 3 * time.Second},
+		{"retry after date", http.Header{"Retry-After": {now.Add(5 * time.Second).UTC().Format(http.TimeFormat)}}, 0, 5 * time.Second},
+		{"rate limit reset", http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()+7, 10)}}, 0, 7 * time.Second},
+		{"reset in the past", http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Unix()-7, 10)}}, 0, rateLimitInitialWait},
+		{"backoff", http.Header{}, 2, 4 * rateLimitInitialWait},
+		{"capped", http.Header{"Retry-After": {"3600"}}, 0, rateLimitMaxWait},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, rateLimitWait(tt.header, tt.attempt, now))
+		})
+	}
+}
+
+func TestManagementRetriesRateLimitedRequests(t *testing.T) {
+	var calls int
+	api := testManagementAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"providers":[{"id":"pro_1","name":"custom"}]}`)
+	})
+
+	var providers Providers
+	require.NoError(t, api.get(context.Background(), "branding/phone/providers", nil, &providers))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, "pro_1", providers.Providers[0].Id)
+}
+
+func TestManagementReturnsAPIError(t *testing.T) {
+	api := testManagementAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"statusCode":403,"error":"Forbidden","message":"Insufficient scope","errorCode":"insufficient_scope"}`)
+	})
+
+	err := api.put(context.Background(), "guardian/factors/sms", map[string]bool{"enabled": true}, nil)
+	assert.True(t, IsStatus(err, http.StatusForbidden))
+	assert.False(t, IsStatus(err, http.StatusNotFound))
+	assert.ErrorContains(t, err, "insufficient_scope")
+}
+
+func TestListAllReadsEveryPage(t *testing.T) {
+	const total = perPage + 3
+	var pages []string
+	api := testManagementAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		pages = append(pages, r.URL.Query().Get("page"))
+		assert.Equal(t, "post-login", r.URL.Query().Get("trigger"))
+		assert.Equal(t, strconv.Itoa(perPage), r.URL.Query().Get("per_page"))
+
+		var bindings []Binding
+		for i := page * perPage; i < min((page+1)*perPage, total); i++ {
+			bindings = append(bindings, Binding{ID: strconv.Itoa(i)})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"total": total, "bindings": bindings})
+	})
+
+	bindings, err := listAll[Binding](context.Background(), api, "bindings", map[string][]string{"trigger": {"post-login"}}, "bindings")
+	require.NoError(t, err)
+	assert.Len(t, bindings, total)
+	assert.Equal(t, strconv.Itoa(total-1), bindings[total-1].ID)
+	assert.Equal(t, []string{"0", "1"}, pages)
+}
@@ -1,6 +1,9 @@
 package auth0
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // ActionTrigger represents an Auth0 action trigger
 type ActionTrigger struct {
@@ -33,20 +36,43 @@ type ActionCreate struct {
 type ActionResponse struct {
 	ID                string          `json:"id"`
 	Name              string          `json:"name"`
+	Code              string          `json:"code"`
 	SupportedTriggers []ActionTrigger `json:"supported_triggers"`
 	Status            string          `json:"status"`
+	Errors            []ActionError   `json:"errors,omitempty"` // Build errors, set when Status is "failed"
+	DeployedVersion   *ActionVersion  `json:"deployed_version,omitempty"`
 	Created           string          `json:"created_at"`
 	Updated           string          `json:"updated_at"`
 }
 
+// ActionError is an error Auth0 reported while building an action
+type ActionError struct {
+	ID      string `json:"id"`
+	Message string `json:"msg"`
+	URL     string `json:"url,omitempty"`
+}
+
+// ActionVersion identifies a deployed version of an action
+type ActionVersion struct {
+	ID     string `json:"id"`
+	Number int    `json:"number"`
+}
+
 type ActionBindings struct {
 	Bindings []Binding `json:"bindings"`
 }
 
 type Binding struct {
-	DisplayName string `json:"display_name"`
-	ID          string `json:"id,omitempty"`
-	Ref         Ref    `json:"ref"`
+	DisplayName string         `json:"display_name"`
+	ID          string         `json:"id,omitempty"`
+	Ref         Ref            `json:"ref"`
+	Action      *BindingAction `json:"action,omitempty"`
+}
+
+// BindingAction is the action a binding points to, as returned when reading bindings
+type BindingAction struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
 }
 
 type Ref struct {
@@ -54,12 +80,6 @@ type Ref struct {
 	Value string `json:"value"`
 }
 
-// ReadActionsResponse represents the response containing the total number of actions and a list of actions.
-type ReadActionsResponse struct {
-	Total   int              `json:"total"`
-	Actions []ActionResponse `json:"actions"`
-}
-
 // TokenResponse represents the response from Auth0's token endpoint
 type TokenResponse struct {
 	AccessToken string `json:"access_token"`
@@ -78,19 +98,19 @@ type DeviceCodeResponse struct {
 }
 
 type Providers struct {
-	Providers []struct {
-		Id            string `json:"id"`
-		Tenant        string `json:"tenant"`
-		Name          string `json:"name"`
-		Channel       string `json:"channel"`
-		Disabled      bool   `json:"disabled"`
-		Configuration struct {
-			DeliveryMethods interface{} `json:"delivery_methods"`
-		} `json:"configuration"`
-		Credentials interface{} `json:"credentials"`
-		CreatedAt   time.Time   `json:"created_at"`
-		UpdatedAt   time.Time   `json:"updated_at"`
-	} `json:"providers"`
+	Providers []PhoneProvider `json:"providers"`
+}
+
+type PhoneProvider struct {
+	Id            string          `json:"id"`
+	Tenant        string          `json:"tenant"`
+	Name          string          `json:"name"`
+	Channel       string          `json:"channel"`
+	Disabled      bool            `json:"disabled"`
+	Configuration json.RawMessage `json:"configuration,omitempty"`
+	Credentials   interface{}     `json:"credentials"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
 }
 
 type UpdateProvider struct {
@@ -100,3 +120,66 @@ type UpdateProvider struct {
 		DeliveryMethods []string `json:"delivery_methods"`
 	} `json:"configuration"`
 }
+
+// EmailProvider is the tenant email provider. Its credentials cannot be read back from Auth0.
+type EmailProvider struct {
+	Name               string          `json:"name"`
+	Enabled            bool            `json:"enabled"`
+	DefaultFromAddress string          `json:"default_from_address,omitempty"`
+	Settings           json.RawMessage `json:"settings,omitempty"`
+}
+
+// GuardianFactor represents an MFA factor and whether it is enabled
+type GuardianFactor struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// PhoneSnapshot is the tenant phone configuration captured before EnablePhoneExtensibility modifies it
+type PhoneSnapshot struct {
+	Bindings         map[string][]Binding `json:"bindings"` // Keyed by trigger ID
+	Providers        []PhoneProvider      `json:"providers"`
+	EmailProvider    *EmailProvider       `json:"email_provider,omitempty"` // Nil when the tenant had none
+	EmailCaptured    bool                 `json:"email_captured"`           // Only while the tenant forwards emails
+	SMSFactorEnabled bool                 `json:"sms_factor_enabled"`
+	SelectedProvider string               `json:"selected_provider"`
+	MessageTypes     []string             `json:"message_types"`
+}
+
+// Plan is the ordered list of Management API operations EnablePhoneExtensibility would perform
+type Plan struct {
+	Domain     string             `json:"domain"`
+	Operations []PlannedOperation `json:"operations"`
+
+	// EmailOperations are performed after Operations only when the user opts into email forwarding
+	EmailOperations []PlannedOperation `json:"email_operations,omitempty"`
+	// EmailProvider is the current email provider, nil when the tenant has none
+	EmailProvider *EmailProvider `json:"email_provider,omitempty"`
+	// EmailUnavailable explains why email forwarding cannot be offered, e.g. a token without the email scopes
+	EmailUnavailable string `json:"email_unavailable,omitempty"`
+}
+
+// PlannedOperation is a single write to the Management API and its effect on the current state
+type PlannedOperation struct {
+	Kind        string   `json:"kind"` // create, update, deploy, bind or put
+	Method      string   `json:"method"`
+	Path        string   `json:"path"`
+	Description string   `json:"description"`
+	Changes     []Change `json:"changes,omitempty"`
+}
+
+// Change describes how a single field differs from the current state
+type Change struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// ActionStatus is the live state of a phone action in a tenant
+type ActionStatus struct {
+	Name            string
+	Trigger         string
+	Status          string // Build status, "missing" when the action does not exist
+	DeployedVersion int    // Zero when no version is deployed
+	Bound           bool
+}
@@ -0,0 +1,241 @@
+package auth0
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// PlanPhoneExtensibility is the dry-run mode of EnablePhoneExtensibility. It only reads the tenant and returns,
+// in execution order, the operations EnablePhoneExtensibility would perform with their diff against the current state.
+func (c *Auth0Client) PlanPhoneExtensibility(ctx context.Context, domain, accessToken string) (*Plan, error) {
+	current, err := c.CapturePhoneSnapshot(ctx, domain, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Domain: domain}
+
+	// Custom Phone Provider
+	if len(current.Providers) == 0 {
+		plan.add(PlannedOperation{
+			Kind:        "create",
+			Method:      "POST",
+			Path:        "branding/phone/providers",
+			Description: "Create the custom phone provider",
+			Changes: []Change{
+				{Field: "name", From: "(none)", To: "custom"},
+				{Field: "delivery_methods", From: "(none)", To: "text"},
+			},
+		})
+	} else {
+		provider := current.Providers[0]
+		plan.add(PlannedOperation{
+			Kind:        "update",
+			Method:      "PATCH",
+			Path:        "branding/phone/providers/" + provider.Id,
+			Description: "Switch the phone provider to custom",
+			Changes: diff(
+				Change{Field: "name", From: provider.Name, To: "custom"},
+				Change{Field: "disabled", From: strconv.FormatBool(provider.Disabled), To: "false"},
+				Change{Field: "delivery_methods", From: deliveryMethods(provider), To: "text"},
+			),
+		})
+	}
+
+	// Actions, in the order they are created, deployed and bound
+	for _, action := range phoneActions {
+		if err := c.planAction(ctx, &plan.Operations, domain, accessToken, action.Name, action.Trigger,
+			current.Bindings[action.Trigger]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Guardian SMS factor
+	plan.add(PlannedOperation{
+		Kind:        "put",
+		Method:      "PUT",
+		Path:        "guardian/factors/sms",
+		Description: "Enable the SMS factor",
+		Changes:     diff(Change{Field: "enabled", From: strconv.FormatBool(current.SMSFactorEnabled), To: "true"}),
+	})
+	plan.add(PlannedOperation{
+		Kind:        "put",
+		Method:      "PUT",
+		Path:        "guardian/factors/phone/selected-provider",
+		Description: "Send MFA messages through the Send Phone Message action",
+		Changes:     diff(Change{Field: "provider", From: current.SelectedProvider, To: "phone-message-hook"}),
+	})
+	plan.add(PlannedOperation{
+		Kind:        "put",
+		Method:      "PUT",
+		Path:        "guardian/factors/phone/message-types",
+		Description: "Allow SMS and voice messages",
+		Changes:     diff(Change{Field: "message_types", From: strings.Join(current.MessageTypes, ", "), To: "sms, voice"}),
+	})
+
+	if err := c.planEmailForwarding(ctx, plan, domain, accessToken, current); err != nil {
+		return nil, err
+	}
+
+	c.logger.Info("Phone extensibility plan created",
+		zap.String("domain", domain),
+		zap.Int("operations", len(plan.Operations)),
+		zap.Int("email_operations", len(plan.EmailOperations)))
+
+	return plan, nil
+}
+
+// planEmailForwarding plans the optional email forwarding step, which the user has to opt into. A token that cannot
+// read the email configuration only makes the step unavailable.
+func (c *Auth0Client) planEmailForwarding(ctx context.Context, plan *Plan, domain, accessToken string,
+	current *PhoneSnapshot) error {
+	if _, err := c.CaptureEmailConfiguration(ctx, domain, accessToken, current); err != nil {
+		if IsStatus(err, http.StatusForbidden) {
+			plan.EmailUnavailable = "the token cannot read the email configuration"
+			return nil
+		}
+		return err
+	}
+
+	if err := c.planAction(ctx, &plan.EmailOperations, domain, accessToken, emailAction.Name, emailAction.Trigger,
+		current.Bindings[emailAction.Trigger]); err != nil {
+		return err
+	}
+
+	// Custom Email Provider, once its action is bound
+	plan.EmailProvider = current.EmailProvider
+	if current.EmailProvider == nil {
+		plan.EmailOperations = append(plan.EmailOperations, PlannedOperation{
+			Kind:        "create",
+			Method:      "POST",
+			Path:        "emails/provider",
+			Description: "Create the custom email provider",
+			Changes: []Change{
+				{Field: "name", From: "(none)", To: customEmailProvider},
+				{Field: "enabled", From: "(none)", To: "true"},
+			},
+		})
+	} else {
+		plan.EmailOperations = append(plan.EmailOperations, PlannedOperation{
+			Kind:        "update",
+			Method:      "PATCH",
+			Path:        "emails/provider",
+			Description: "Switch the email provider to custom",
+			Changes: diff(
+				Change{Field: "name", From: current.EmailProvider.Name, To: customEmailProvider},
+				Change{Field: "enabled", From: strconv.FormatBool(current.EmailProvider.Enabled), To: "true"},
+			),
+		})
+	}
+
+	return nil
+}
+
+func (c *Auth0Client) planAction(ctx context.Context, operations *[]PlannedOperation, domain, accessToken,
+	actionName, actionType string, bindings []Binding) error {
+	code, err := readActionTemplate(actionType)
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.getAction(ctx, domain, accessToken, actionName)
+	if err != nil && !errors.Is(err, ErrActionNotFound) {
+		return err
+	}
+
+	actionRef := "{new}"
+	if existing == nil {
+		*operations = append(*operations, PlannedOperation{
+			Kind:        "create",
+			Method:      "POST",
+			Path:        "actions/actions",
+			Description: fmt.Sprintf("Create the %q action", actionName),
+			Changes: []Change{
+				{Field: "trigger", From: "(none)", To: actionType},
+				{Field: "code", From: "(none)", To: "OTPus template"},
+				{Field: "secrets", From: "(none)", To: "gateway URL, token, chat ID and domain"},
+			},
+		})
+	} else {
+		actionRef = existing.ID
+		codeBefore := "OTPus template"
+		if existing.Code != string(code) {
+			codeBefore = "modified"
+		}
+		*operations = append(*operations, PlannedOperation{
+			Kind:        "update",
+			Method:      "PATCH",
+			Path:        "actions/actions/" + existing.ID,
+			Description: fmt.Sprintf("Update the %q action", actionName),
+			Changes: diff(
+				Change{Field: "code", From: codeBefore, To: "OTPus template"},
+				Change{Field: "secrets", From: "current values", To: "gateway URL, token, chat ID and domain"},
+			),
+		})
+	}
+
+	*operations = append(*operations, PlannedOperation{
+		Kind:        "deploy",
+		Method:      "POST",
+		Path:        fmt.Sprintf("actions/actions/%s/deploy", actionRef),
+		Description: fmt.Sprintf("Deploy the %q action", actionName),
+	})
+
+	var before, after []string
+	for _, binding := range bindings {
+		before = append(before, binding.DisplayName)
+		if binding.DisplayName != actionName {
+			after = append(after, binding.DisplayName)
+		}
+	}
+	after = append(after, actionName)
+
+	*operations = append(*operations, PlannedOperation{
+		Kind:        "bind",
+		Method:      "PATCH",
+		Path:        fmt.Sprintf("actions/triggers/%s/bindings", actionType),
+		Description: fmt.Sprintf("Bind the %q action, keeping the other bindings", actionName),
+		Changes:     diff(Change{Field: "bindings", From: bindingList(before), To: bindingList(after)}),
+	})
+
+	return nil
+}
+
+func (p *Plan) add(operation PlannedOperation) {
+	p.Operations = append(p.Operations, operation)
+}
+
+// diff keeps only the changes that modify the current value
+func diff(changes ...Change) []Change {
+	var result []Change
+	for _, change := range changes {
+		if change.From != change.To {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+func bindingList(names []string) string {
+	if len(names) == 0 {
+		return "(none)"
+	}
+	return strings.Join(names, ", ")
+}
+
+func deliveryMethods(provider PhoneProvider) string {
+	var configuration struct {
+		DeliveryMethods []string `json:"delivery_methods"`
+	}
+	if err := json.Unmarshal(provider.Configuration, &configuration); err != nil {
+		return ""
+	}
+	return strings.Join(configuration.DeliveryMethods, ", ")
+}
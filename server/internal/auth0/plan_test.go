@@ -0,0 +1,28 @@
+package auth0
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlanPhoneExtensibilityKeepsEmailForwardingApart(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.emailProvider = &EmailProvider{Name: "sendgrid", Enabled: true}
+
+	c, domain := testTenantClient(t, tenant)
+	plan, err := c.PlanPhoneExtensibility(context.Background(), domain, "token")
+	require.NoError(t, err)
+
+	for _, operation := range plan.Operations {
+		assert.NotContains(t, operation.Path, "email")
+	}
+	require.NotEmpty(t, plan.EmailOperations)
+	last := plan.EmailOperations[len(plan.EmailOperations)-1]
+	assert.Equal(t, "PATCH emails/provider", last.Method+" "+last.Path)
+	assert.Equal(t, "sendgrid", plan.EmailProvider.Name)
+	assert.Empty(t, plan.EmailUnavailable)
+	assert.Empty(t, tenant.changes)
+}
@@ -0,0 +1,44 @@
+package auth0
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	keys, err := utils.NewKeyring([]utils.HMACKey{{ID: config.DefaultHMACKeyID, Secret: "secret"}},
+		config.DefaultHMACKeyID)
+	require.NoError(t, err)
+	return &config.Config{BaseURL: "https://otpus.example.com", HMACKeys: keys}
+}
+
+func TestRotatePhoneActionSecretsSkipsMissingActions(t *testing.T) {
+	// Set up before email forwarding existed, with only the phone actions
+	tenant := configuredTenant(t)
+	tenant.actions = tenant.actions[:2]
+
+	c, domain := testTenantClient(t, tenant)
+	require.NoError(t, c.RotatePhoneActionSecrets(context.Background(), domain, "token", 42, testConfig(t)))
+
+	assert.Equal(t, []string{
+		"PATCH actions/actions/act_1",
+		"POST actions/actions/act_1/deploy",
+		"PATCH actions/actions/act_2",
+		"POST actions/actions/act_2/deploy",
+	}, tenant.changes)
+}
+
+func TestRotatePhoneActionSecretsWithoutActions(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.actions = nil
+
+	c, domain := testTenantClient(t, tenant)
+	err := c.RotatePhoneActionSecrets(context.Background(), domain, "token", 42, testConfig(t))
+	assert.ErrorIs(t, err, ErrActionNotFound)
+	assert.Empty(t, tenant.changes)
+}
@@ -0,0 +1,97 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rollbackTimeout bounds undoing the completed steps. Rollback still runs when the setup was cancelled,
+// so a disconnected auth form does not leave the tenant half configured.
+const rollbackTimeout = 30 * time.Second
+
+// setupStep is a single change to the tenant with the compensating action that reverts it
+type setupStep struct {
+	Name string
+	Do   func(ctx context.Context) error
+	Undo func(ctx context.Context) error
+}
+
+// StepError reports the setup step that failed and the outcome of rolling back the completed steps
+type StepError struct {
+	Step           string
+	Err            error
+	RollbackErrors []error
+}
+
+func (e *StepError) Error() string {
+	msg := fmt.Sprintf("step %q failed: %v", e.Step, e.Err)
+	if len(e.RollbackErrors) > 0 {
+		var errs []string
+		for _, err := range e.RollbackErrors {
+			errs = append(errs, err.Error())
+		}
+		msg += fmt.Sprintf(" (rollback incomplete: %s)", strings.Join(errs, "; "))
+	}
+	return msg
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// RolledBack reports whether every completed step was reverted
+func (e *StepError) RolledBack() bool {
+	return len(e.RollbackErrors) == 0
+}
+
+// AsStepError returns the StepError wrapped in err, if any
+func AsStepError(err error) (*StepError, bool) {
+	var stepErr *StepError
+	ok := errors.As(err, &stepErr)
+	return stepErr, ok
+}
+
+// runSteps executes the steps in order. When one fails, it and the completed steps are undone in reverse order.
+func (c *Auth0Client) runSteps(ctx context.Context, domain string, steps []setupStep) error {
+	logger := c.logger
+
+	for i, step := range steps {
+		logger.Debug("Running setup step", zap.String("domain", domain), zap.String("step", step.Name))
+
+		err := step.Do(ctx)
+		if err == nil {
+			continue
+		}
+
+		logger.Error("Setup step failed, rolling back",
+			zap.Error(err),
+			zap.String("domain", domain),
+			zap.String("step", step.Name))
+
+		// The failed step may have partially applied, so it is reverted along with the completed ones
+		stepErr := &StepError{Step: step.Name, Err: err}
+		rollbackCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+		defer cancel()
+		for j := i; j >= 0; j-- {
+			if steps[j].Undo == nil {
+				continue
+			}
+			if undoErr := steps[j].Undo(rollbackCtx); undoErr != nil {
+				logger.Error("Failed to roll back setup step",
+					zap.Error(undoErr),
+					zap.String("domain", domain),
+					zap.String("step", steps[j].Name))
+				stepErr.RollbackErrors = append(stepErr.RollbackErrors, fmt.Errorf("%s: %w", steps[j].Name, undoErr))
+			}
+		}
+
+		return stepErr
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRunStepsRollsBackInReverseOrder(t *testing.T) {
+	c := &Auth0Client{logger: zap.NewNop()}
+	var calls []string
+
+	step := func(name string, fail bool) setupStep {
+		return setupStep{
+			Name: name,
+			Do: func(context.Context) error {
+				calls = append(calls, "do "+name)
+				if fail {
+					return errors.New("boom")
+				}
+				return nil
+			},
+			Undo: func(context.Context) error {
+				calls = append(calls, "undo "+name)
+				return nil
+			},
+		}
+	}
+
+	err := c.runSteps(context.Background(), "test.auth0.com", []setupStep{step("a", false), step("b", false), step("c", true), step("d", false)})
+
+	stepErr, ok := AsStepError(err)
+	require.True(t, ok)
+	assert.Equal(t, "c", stepErr.Step)
+	assert.True(t, stepErr.RolledBack())
+	assert.Equal(t, []string{"do a", "do b", "do c", "undo c", "undo b", "undo a"}, calls)
+}
+
+func TestRunStepsReportsRollbackFailures(t *testing.T) {
+	c := &Auth0Client{logger: zap.NewNop()}
+
+	err := c.runSteps(context.Background(), "test.auth0.com", []setupStep{
+		{Name: "a", Do: func(context.Context) error { return nil }, Undo: func(context.Context) error { return errors.New("cannot undo") }},
+		{Name: "b", Do: func(context.Context) error { return errors.New("boom") }},
+	})
+
+	stepErr, ok := AsStepError(err)
+	require.True(t, ok)
+	assert.Equal(t, "b", stepErr.Step)
+	assert.False(t, stepErr.RolledBack())
+	assert.Contains(t, err.Error(), "rollback incomplete")
+}
+
+func TestRunStepsSuccess(t *testing.T) {
+	c := &Auth0Client{logger: zap.NewNop()}
+
+	err := c.runSteps(context.Background(), "test.auth0.com", []setupStep{
+		{Name: "a", Do: func(context.Context) error { return nil }},
+	})
+	assert.NoError(t, err)
+}
+
+func TestRunStepsRollsBackAfterCancellation(t *testing.T) {
+	c := &Auth0Client{logger: zap.NewNop()}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var undoErr error
+	err := c.runSteps(ctx, "test.auth0.com", []setupStep{
+		{
+			Name: "a",
+			Do:   func(context.Context) error { return nil },
+			Undo: func(ctx context.Context) error {
+				undoErr = ctx.Err()
+				return nil
+			},
+		},
+		{
+			Name: "b",
+			Do: func(ctx context.Context) error {
+				cancel()
+				return ctx.Err()
+			},
+		},
+	})
+
+	stepErr, ok := AsStepError(err)
+	require.True(t, ok)
+	assert.Equal(t, "b", stepErr.Step)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, stepErr.RolledBack())
+	assert.NoError(t, undoErr)
+}
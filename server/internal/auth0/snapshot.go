@@ -0,0 +1,300 @@
+package auth0
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// CapturePhoneSnapshot reads the tenant configuration that EnablePhoneExtensibility overwrites:
+// the phone trigger bindings, the phone providers and the Guardian SMS settings. The email configuration is
+// only added by CaptureEmailConfiguration, for tenants opting into email forwarding.
+func (c *Auth0Client) CapturePhoneSnapshot(ctx context.Context, domain, accessToken string) (*PhoneSnapshot, error) {
+	snapshot, err := c.readPhoneConfiguration(ctx, domain, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	c.logger.Info("Phone configuration captured", zap.String("domain", domain))
+
+	return snapshot, nil
+}
+
+// readPhoneConfiguration reads the phone configuration captured by CapturePhoneSnapshot
+func (c *Auth0Client) readPhoneConfiguration(ctx context.Context, domain, accessToken string) (*PhoneSnapshot, error) {
+	snapshot := &PhoneSnapshot{
+		Bindings: make(map[string][]Binding),
+	}
+
+	for _, action := range phoneActions {
+		bindings, err := c.getBindings(ctx, domain, accessToken, action.Trigger)
+		if err != nil {
+			return nil, err
+		}
+		snapshot.Bindings[action.Trigger] = bindings.Bindings
+	}
+
+	providers, err := c.getPhoneProviders(ctx, domain, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Providers = providers.Providers
+
+	var factors []GuardianFactor
+	if err := c.readSetting(ctx, domain, accessToken, "guardian/factors", &factors); err != nil {
+		return nil, err
+	}
+	for _, factor := range factors {
+		if factor.Name == "sms" {
+			snapshot.SMSFactorEnabled = factor.Enabled
+		}
+	}
+
+	var selectedProvider struct {
+		Provider string `json:"provider"`
+	}
+	if err := c.readSetting(ctx, domain, accessToken, "guardian/factors/phone/selected-provider", &selectedProvider); err != nil {
+		return nil, err
+	}
+	snapshot.SelectedProvider = selectedProvider.Provider
+
+	var messageTypes struct {
+		MessageTypes []string `json:"message_types"`
+	}
+	if err := c.readSetting(ctx, domain, accessToken, "guardian/factors/phone/message-types", &messageTypes); err != nil {
+		return nil, err
+	}
+	snapshot.MessageTypes = messageTypes.MessageTypes
+
+	return snapshot, nil
+}
+
+// CaptureEmailConfiguration adds the email trigger bindings and email provider to a snapshot, before setup
+// first forwards the emails of the tenant. It returns false when the snapshot already holds them.
+func (c *Auth0Client) CaptureEmailConfiguration(ctx context.Context, domain, accessToken string,
+	snapshot *PhoneSnapshot) (bool, error) {
+	if snapshot.EmailCaptured {
+		return false, nil
+	}
+
+	bindings, err := c.getBindings(ctx, domain, accessToken, emailTrigger)
+	if err != nil {
+		return false, err
+	}
+	if snapshot.Bindings == nil {
+		snapshot.Bindings = make(map[string][]Binding)
+	}
+	snapshot.Bindings[emailTrigger] = bindings.Bindings
+
+	if snapshot.EmailProvider, err = c.getEmailProvider(ctx, domain, accessToken); err != nil {
+		return false, err
+	}
+	snapshot.EmailCaptured = true
+
+	c.logger.Info("Email configuration captured", zap.String("domain", domain))
+
+	return true, nil
+}
+
+// RestorePhoneSnapshot puts back the configuration captured by CapturePhoneSnapshot, and the email configuration
+// when the snapshot holds it. Bindings of the bot's own actions are left out, so they end up unbound.
+func (c *Auth0Client) RestorePhoneSnapshot(ctx context.Context, domain, accessToken string, snapshot *PhoneSnapshot) error {
+	logger := c.logger
+
+	if err := c.restoreGuardian(ctx, domain, accessToken, snapshot); err != nil {
+		return err
+	}
+
+	if err := c.restorePhoneProviders(ctx, domain, accessToken, snapshot.Providers); err != nil {
+		return err
+	}
+
+	if snapshot.EmailCaptured {
+		if err := c.restoreEmailProvider(ctx, domain, accessToken, snapshot.EmailProvider); err != nil {
+			return err
+		}
+	}
+
+	for _, action := range managedActions(snapshot.EmailCaptured) {
+		if err := c.restoreBindings(ctx, domain, accessToken, action.Trigger, snapshot.Bindings[action.Trigger], true); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Phone configuration restored", zap.String("domain", domain))
+
+	return nil
+}
+
+// restoreBindings re-publishes captured bindings for a trigger, optionally leaving out the bot's own actions
+func (c *Auth0Client) restoreBindings(ctx context.Context, domain, accessToken, trigger string, captured []Binding,
+	skipOwn bool) error {
+	bindings := ActionBindings{Bindings: []Binding{}}
+	for _, binding := range captured {
+		if skipOwn && isManagedAction(binding.DisplayName) {
+			continue
+		}
+
+		// Reference the action rather than the binding, binding IDs do not survive re-binding
+		ref := Ref{Type: "binding_id", Value: binding.ID}
+		if binding.Action != nil && binding.Action.ID != "" {
+			ref = Ref{Type: "action_id", Value: binding.Action.ID}
+		}
+		bindings.Bindings = append(bindings.Bindings, Binding{DisplayName: binding.DisplayName, Ref: ref})
+	}
+
+	if err := c.patchBindings(ctx, domain, accessToken, trigger, bindings); err != nil {
+		return fmt.Errorf("failed to restore %s bindings: %w", trigger, err)
+	}
+	return nil
+}
+
+func (c *Auth0Client) restoreGuardian(ctx context.Context, domain, accessToken string, snapshot *PhoneSnapshot) error {
+	api := c.management(domain, accessToken)
+
+	if err := api.put(ctx, "guardian/factors/sms", map[string]bool{"enabled": snapshot.SMSFactorEnabled}, nil); err != nil {
+		return fmt.Errorf("failed to restore SMS factor: %w", err)
+	}
+
+	if snapshot.SelectedProvider != "" {
+		err := api.put(ctx, "guardian/factors/phone/selected-provider",
+			map[string]string{"provider": snapshot.SelectedProvider}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to restore SMS provider: %w", err)
+		}
+	}
+
+	if len(snapshot.MessageTypes) > 0 {
+		err := api.put(ctx, "guardian/factors/phone/message-types",
+			map[string][]string{"message_types": snapshot.MessageTypes}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to restore message types: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// restorePhoneProviders reverts the providers to their captured name, state and configuration.
+// Provider credentials cannot be read back from Auth0, so they are left as they are.
+func (c *Auth0Client) restorePhoneProviders(ctx context.Context, domain, accessToken string, captured []PhoneProvider) error {
+	logger := c.logger
+	api := c.management(domain, accessToken)
+
+	current, err := c.getPhoneProviders(ctx, domain, accessToken)
+	if err != nil {
+		return err
+	}
+
+	for _, provider := range current.Providers {
+		var original *PhoneProvider
+		for i := range captured {
+			if captured[i].Id == provider.Id {
+				original = &captured[i]
+			}
+		}
+
+		// The provider was created by ActivateCustomPhoneProvider
+		if original == nil {
+			if err := api.delete(ctx, "branding/phone/providers/"+provider.Id, nil); err != nil {
+				return fmt.Errorf("failed to delete Phone provider: %w", err)
+			}
+
+			logger.Info("Phone provider deleted", zap.String("provider", provider.Id), zap.String("domain", domain))
+			continue
+		}
+
+		body := map[string]interface{}{
+			"name":     original.Name,
+			"disabled": original.Disabled,
+		}
+		if len(original.Configuration) > 0 {
+			body["configuration"] = original.Configuration
+		}
+
+		if err := api.patch(ctx, "branding/phone/providers/"+provider.Id, body, nil); err != nil {
+			return fmt.Errorf("failed to restore Phone provider: %w", err)
+		}
+
+		logger.Info("Phone provider restored", zap.String("provider", provider.Id), zap.String("domain", domain))
+	}
+
+	return nil
+}
+
+// restoreEmailProvider reverts the email provider to its captured state, or deletes it when the tenant had none.
+// Auth0 never returns provider credentials, so a provider other than the custom one cannot be switched back:
+// the custom provider is disabled instead, and the credentials have to be entered again in the dashboard.
+func (c *Auth0Client) restoreEmailProvider(ctx context.Context, domain, accessToken string, captured *EmailProvider) error {
+	api := c.management(domain, accessToken)
+
+	if captured == nil {
+		current, err := c.getEmailProvider(ctx, domain, accessToken)
+		if err != nil || current == nil {
+			return err
+		}
+
+		// The provider was created by ActivateCustomEmailProvider
+		if err := api.delete(ctx, "emails/provider", nil); err != nil {
+			return fmt.Errorf("failed to delete Email provider: %w", err)
+		}
+
+		c.logger.Info("Email provider deleted", zap.String("domain", domain))
+		return nil
+	}
+
+	if LosesEmailCredentials(captured) {
+		if err := c.DeactivateCustomEmailProvider(ctx, domain, accessToken); err != nil {
+			return err
+		}
+
+		c.logger.Warn("Email provider cannot be restored without its credentials",
+			zap.String("provider", captured.Name),
+			zap.String("domain", domain))
+		return nil
+	}
+
+	body := map[string]interface{}{
+		"name":    captured.Name,
+		"enabled": captured.Enabled,
+	}
+	if captured.DefaultFromAddress != "" {
+		body["default_from_address"] = captured.DefaultFromAddress
+	}
+	if len(captured.Settings) > 0 {
+		body["settings"] = captured.Settings
+	}
+
+	if err := api.patch(ctx, "emails/provider", body, nil); err != nil {
+		return fmt.Errorf("failed to restore Email provider: %w", err)
+	}
+
+	c.logger.Info("Email provider restored", zap.String("provider", captured.Name), zap.String("domain", domain))
+
+	return nil
+}
+
+// LosesEmailCredentials reports whether switching the email provider to the custom provider loses credentials
+// that Auth0 never returns, so that the provider cannot be restored
+func LosesEmailCredentials(provider *EmailProvider) bool {
+	return provider != nil && provider.Name != customEmailProvider
+}
+
+// readSetting reads a Management API resource below /api/v2 into out
+func (c *Auth0Client) readSetting(ctx context.Context, domain, accessToken, path string, out interface{}) error {
+	if err := c.management(domain, accessToken).get(ctx, path, nil, out); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func isManagedAction(name string) bool {
+	for _, action := range managedActions(true) {
+		if action.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package auth0
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestorePhoneSnapshotLeavesEmailAloneWithoutEmailForwarding(t *testing.T) {
+	tenant := configuredTenant(t)
+	tenant.emailProvider = &EmailProvider{Name: "sendgrid", Enabled: true}
+
+	snapshot := &PhoneSnapshot{Bindings: map[string][]Binding{}, SelectedProvider: "auth0"}
+
+	c, domain := testTenantClient(t, tenant)
+	require.NoError(t, c.RestorePhoneSnapshot(context.Background(), domain, "token", snapshot))
+
+	assert.NotContains(t, tenant.changes, "PATCH emails/provider")
+	assert.NotContains(t, tenant.changes, "DELETE emails/provider")
+	assert.NotContains(t, tenant.changes, "PATCH actions/triggers/"+emailTrigger+"/bindings")
+}
+
+func TestRestorePhoneSnapshotDisablesProvidersWithLostCredentials(t *testing.T) {
+	tenant := configuredTenant(t)
+	snapshot := &PhoneSnapshot{
+		Bindings:      map[string][]Binding{},
+		EmailProvider: &EmailProvider{Name: "sendgrid", Enabled: true},
+		EmailCaptured: true,
+	}
+	require.True(t, LosesEmailCredentials(snapshot.EmailProvider))
+
+	c, domain := testTenantClient(t, tenant)
+	require.NoError(t, c.RestorePhoneSnapshot(context.Background(), domain, "token", snapshot))
+
+	assert.Contains(t, tenant.changes, "PATCH emails/provider")
+	assert.NotContains(t, tenant.changes, "DELETE emails/provider")
+}
+
+func TestRestorePhoneSnapshotDeletesTheCreatedEmailProvider(t *testing.T) {
+	tenant := configuredTenant(t)
+	snapshot := &PhoneSnapshot{Bindings: map[string][]Binding{}, EmailCaptured: true}
+
+	c, domain := testTenantClient(t, tenant)
+	require.NoError(t, c.RestorePhoneSnapshot(context.Background(), domain, "token", snapshot))
+
+	assert.Contains(t, tenant.changes, "DELETE emails/provider")
+}
+
+func TestDisableEmailForwarding(t *testing.T) {
+	tenant := configuredTenant(t)
+	snapshot := &PhoneSnapshot{
+		Bindings:      map[string][]Binding{emailTrigger: nil},
+		EmailCaptured: true,
+	}
+
+	c, domain := testTenantClient(t, tenant)
+	require.NoError(t, c.DisableEmailForwarding(context.Background(), domain, "token", snapshot))
+
+	assert.Equal(t, []string{
+		"DELETE emails/provider",
+		"PATCH actions/triggers/" + emailTrigger + "/bindings",
+		"DELETE actions/actions/act_3",
+	}, tenant.changes)
+	assert.False(t, snapshot.EmailCaptured)
+	assert.NotContains(t, snapshot.Bindings, emailTrigger)
+}
@@ -0,0 +1,44 @@
+package auth0
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// GetPhoneActionsStatus reads the build, deployment and binding state of the phone actions, and of the email action
+// when the tenant forwards emails
+func (c *Auth0Client) GetPhoneActionsStatus(ctx context.Context, domain, accessToken string,
+	forwardEmail bool) ([]ActionStatus, error) {
+	var statuses []ActionStatus
+	for _, action := range managedActions(forwardEmail) {
+		status := ActionStatus{Name: action.Name, Trigger: action.Trigger}
+
+		existing, err := c.getAction(ctx, domain, accessToken, action.Name)
+		if errors.Is(err, ErrActionNotFound) {
+			status.Status = "missing"
+			statuses = append(statuses, status)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read action %s: %w", action.Name, err)
+		}
+		status.Status = existing.Status
+		if existing.DeployedVersion != nil {
+			status.DeployedVersion = existing.DeployedVersion.Number
+		}
+
+		bindings, err := c.getBindings(ctx, domain, accessToken, action.Trigger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s bindings: %w", action.Trigger, err)
+		}
+		for _, binding := range bindings.Bindings {
+			if binding.Action != nil && binding.Action.ID == existing.ID {
+				status.Bound = true
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -5,13 +5,45 @@ package config
 import (
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// DefaultHMACKeyID identifies HMAC_DEFAULT_SECRET in the HMAC keyring
+const DefaultHMACKeyID = "default"
+
+// DefaultAuth0DeviceScopes are the Management API scopes the device flow requests, covering the actions,
+// trigger bindings, phone and email providers and Guardian factors that setup and disconnect change
+var DefaultAuth0DeviceScopes = []string{
+	"read:actions", "create:actions", "update:actions", "delete:actions",
+	"read:phone_providers", "create:phone_providers", "update:phone_providers", "delete:phone_providers",
+	"read:email_provider", "create:email_provider", "update:email_provider", "delete:email_provider",
+	"read:guardian_factors", "update:guardian_factors",
+}
+
+// Telegram message types with their own retention
+const (
+	MessageTypeOTP     = "otp"
+	MessageTypeCommand = "command"
+	MessageTypeDrift   = "drift"
+)
+
+// MessageTypes lists the message types a retention can be configured for
+var MessageTypes = []string{MessageTypeOTP, MessageTypeCommand, MessageTypeDrift}
+
+// Ways the bot receives Telegram updates
+const (
+	UpdateModeWebhook = "webhook"
+	UpdateModePolling = "polling"
+)
+
 // Config holds all configuration for the application
 type Config struct {
 	// Server settings
@@ -22,10 +54,57 @@ type Config struct {
 	TelegramToken      string `json:"telegram_token"`
 	DefaultSecretToken string `json:"default_secret_token"`
 	HMACSecret         string `json:"hmac_secret"`
+	OTPAPIToken        string `json:"otp_api_token"`
+
+	// HMACKeys holds HMACSecret under DefaultHMACKeyID plus the keys from HMAC_KEYS
+	HMACKeys *utils.Keyring `json:"-"`
 
 	// Auth0 settings
 	Auth0DemoPlatformApiURL string `json:"auth0_api_url"`
 
+	// Device authorization for personal tenants, disabled without a client ID
+	Auth0DeviceClientID string   `json:"auth0_device_client_id"`
+	Auth0DeviceScopes   []string `json:"auth0_device_scopes"`
+
+	// Persistence
+	StorePath string `json:"store_path"`
+
+	// Encryption seals every stored record under the master key from ENCRYPTION_KEY or ENCRYPTION_KEY_FILE,
+	// and still opens records sealed with the previous keys. It is nil when no master key is set, which only a
+	// store written before encryption accepts. CredentialVault lets users store client
+	// credentials at setup, so maintenance runs without asking for them again.
+	Encryption      *utils.Envelope `json:"-"`
+	CredentialVault bool            `json:"credential_vault"`
+
+	// Webhook signatures
+	WebhookAllowV1 bool          `json:"webhook_allow_v1"`
+	WebhookMaxSkew time.Duration `json:"webhook_max_skew"`
+
+	// Telegram updates
+	TelegramUpdateMode            string `json:"telegram_update_mode"`
+	TelegramWebhookMaxConnections int    `json:"telegram_webhook_max_connections"`
+
+	// Telegram message retention, zero keeps messages
+	MessageRetention       time.Duration            `json:"message_retention"`
+	MessageRetentionByType map[string]time.Duration `json:"message_retention_by_type"`
+	MessageRetentionByChat map[int64]time.Duration  `json:"message_retention_by_chat"`
+
+	// Setup
+	SetupRequireConfirmation bool          `json:"setup_require_confirmation"`
+	AuthFormLinkTTL          time.Duration `json:"auth_form_link_ttl"`
+
+	// DriftCheckInterval is how often tenants with stored credentials are compared with the configuration
+	// setup applies, zero disables the checks
+	DriftCheckInterval time.Duration `json:"drift_check_interval"`
+
+	// Group access: besides chat admins, TelegramAdminUserIDs may configure tenants in any chat.
+	// TelegramLoginURL opens auth forms through Telegram login buttons, so links only work for the requesting user.
+	TelegramAdminUserIDs []int64 `json:"telegram_admin_user_ids"`
+	TelegramLoginURL     bool    `json:"telegram_login_url"`
+
+	// OTP pull API
+	OTPBufferTTL time.Duration `json:"otp_buffer_ttl"`
+
 	// Environment
 	Environment string `json:"environment"`
 }
@@ -54,10 +133,21 @@ func LoadConfig() (*Config, error) {
 
 	cfg := &Config{
 		// Default values
-		BotPort:            8080,
-		DefaultSecretToken: "a-very-long-default-secret-string",
-		HMACSecret:         "a-very-long-default-secret-string",
-		Environment:        env,
+		BotPort:                       8080,
+		DefaultSecretToken:            "a-very-long-default-secret-string",
+		HMACSecret:                    "a-very-long-default-secret-string",
+		StorePath:                     "data/otpus.db",
+		OTPBufferTTL:                  5 * time.Minute,
+		SetupRequireConfirmation:      true,
+		AuthFormLinkTTL:               10 * time.Minute,
+		DriftCheckInterval:            15 * time.Minute,
+		Auth0DeviceScopes:             DefaultAuth0DeviceScopes,
+		WebhookAllowV1:                true,
+		WebhookMaxSkew:                5 * time.Minute,
+		TelegramUpdateMode:            UpdateModeWebhook,
+		TelegramWebhookMaxConnections: 3,
+		MessageRetention:              5 * time.Minute,
+		Environment:                   env,
 	}
 
 	// Load BOT_PORT with default fallback
@@ -86,6 +176,174 @@ func LoadConfig() (*Config, error) {
 		cfg.HMACSecret = secret
 	}
 
+	keyring, err := loadHMACKeys(cfg.HMACSecret)
+	if err != nil {
+		logger.Error("Invalid HMAC key configuration", zap.Error(err))
+		return nil, fmt.Errorf("invalid HMAC key configuration: %v", err)
+	}
+	cfg.HMACKeys = keyring
+
+	if storePath := os.Getenv("STORE_PATH"); storePath != "" {
+		cfg.StorePath = storePath
+	}
+
+	envelope, err := loadEncryptionKeys()
+	if err != nil {
+		logger.Error("Invalid encryption key configuration", zap.Error(err))
+		return nil, fmt.Errorf("invalid encryption key configuration: %v", err)
+	}
+	cfg.Encryption = envelope
+
+	if vaultStr := os.Getenv("CREDENTIAL_VAULT"); vaultStr != "" {
+		vault, err := strconv.ParseBool(vaultStr)
+		if err != nil {
+			logger.Error("Invalid CREDENTIAL_VAULT value", zap.Error(err))
+			return nil, fmt.Errorf("invalid CREDENTIAL_VAULT value: %v", err)
+		}
+		cfg.CredentialVault = vault
+	}
+	// Stored client secrets are never written in plaintext
+	if cfg.CredentialVault && cfg.Encryption == nil {
+		logger.Error("CREDENTIAL_VAULT requires ENCRYPTION_KEY")
+		return nil, fmt.Errorf("CREDENTIAL_VAULT requires ENCRYPTION_KEY or ENCRYPTION_KEY_FILE")
+	}
+
+	// Polling lets the bot run behind NAT, without a public BASE_URL for the Telegram webhook
+	if mode := os.Getenv("TELEGRAM_UPDATE_MODE"); mode != "" {
+		if mode != UpdateModeWebhook && mode != UpdateModePolling {
+			logger.Error("Invalid TELEGRAM_UPDATE_MODE value", zap.String("mode", mode))
+			return nil, fmt.Errorf("invalid TELEGRAM_UPDATE_MODE value: %s", mode)
+		}
+		cfg.TelegramUpdateMode = mode
+	}
+
+	if connStr := os.Getenv("TELEGRAM_WEBHOOK_MAX_CONNECTIONS"); connStr != "" {
+		conn, err := strconv.Atoi(connStr)
+		if err != nil || conn < 1 || conn > 100 {
+			logger.Error("Invalid TELEGRAM_WEBHOOK_MAX_CONNECTIONS value", zap.String("value", connStr))
+			return nil, fmt.Errorf("invalid TELEGRAM_WEBHOOK_MAX_CONNECTIONS value: %s, expected 1-100", connStr)
+		}
+		cfg.TelegramWebhookMaxConnections = conn
+	}
+
+	if retentionStr := os.Getenv("TELEGRAM_MESSAGE_EXPIRATION_TIME"); retentionStr != "" {
+		retention, err := parseRetention(retentionStr)
+		if err != nil {
+			logger.Error("Invalid TELEGRAM_MESSAGE_EXPIRATION_TIME value", zap.Error(err))
+			return nil, fmt.Errorf("invalid TELEGRAM_MESSAGE_EXPIRATION_TIME value: %v", err)
+		}
+		cfg.MessageRetention = retention
+	}
+
+	byType, err := parseRetentions(os.Getenv("TELEGRAM_MESSAGE_EXPIRATION_BY_TYPE"), func(key string) (string, error) {
+		if !slices.Contains(MessageTypes, key) {
+			return "", fmt.Errorf("unknown message type %q", key)
+		}
+		return key, nil
+	})
+	if err != nil {
+		logger.Error("Invalid TELEGRAM_MESSAGE_EXPIRATION_BY_TYPE value", zap.Error(err))
+		return nil, fmt.Errorf("invalid TELEGRAM_MESSAGE_EXPIRATION_BY_TYPE value: %v", err)
+	}
+	cfg.MessageRetentionByType = byType
+
+	byChat, err := parseRetentions(os.Getenv("TELEGRAM_MESSAGE_EXPIRATION_BY_CHAT"), func(key string) (int64, error) {
+		return strconv.ParseInt(key, 10, 64)
+	})
+	if err != nil {
+		logger.Error("Invalid TELEGRAM_MESSAGE_EXPIRATION_BY_CHAT value", zap.Error(err))
+		return nil, fmt.Errorf("invalid TELEGRAM_MESSAGE_EXPIRATION_BY_CHAT value: %v", err)
+	}
+	cfg.MessageRetentionByChat = byChat
+
+	if confirmStr := os.Getenv("SETUP_REQUIRE_CONFIRMATION"); confirmStr != "" {
+		confirm, err := strconv.ParseBool(confirmStr)
+		if err != nil {
+			logger.Error("Invalid SETUP_REQUIRE_CONFIRMATION value", zap.Error(err))
+			return nil, fmt.Errorf("invalid SETUP_REQUIRE_CONFIRMATION value: %v", err)
+		}
+		cfg.SetupRequireConfirmation = confirm
+	}
+
+	// Auth-form links can only be used once, and only until they expire
+	if ttlStr := os.Getenv("AUTH_FORM_LINK_TTL"); ttlStr != "" {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			logger.Error("Invalid AUTH_FORM_LINK_TTL value", zap.String("value", ttlStr))
+			return nil, fmt.Errorf("invalid AUTH_FORM_LINK_TTL value: %s", ttlStr)
+		}
+		cfg.AuthFormLinkTTL = ttl
+	}
+
+	if intervalStr := os.Getenv("DRIFT_CHECK_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil || interval < 0 {
+			logger.Error("Invalid DRIFT_CHECK_INTERVAL value", zap.String("value", intervalStr))
+			return nil, fmt.Errorf("invalid DRIFT_CHECK_INTERVAL value: %s", intervalStr)
+		}
+		cfg.DriftCheckInterval = interval
+	}
+
+	// The device client must be a native application of the tenant with the Device Code grant enabled
+	cfg.Auth0DeviceClientID = os.Getenv("AUTH0_DEVICE_CLIENT_ID")
+
+	if scopesStr := os.Getenv("AUTH0_DEVICE_SCOPES"); scopesStr != "" {
+		cfg.Auth0DeviceScopes = strings.FieldsFunc(scopesStr, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+	}
+
+	if idsStr := os.Getenv("TELEGRAM_ADMIN_USER_IDS"); idsStr != "" {
+		ids, err := parseUserIDs(idsStr)
+		if err != nil {
+			logger.Error("Invalid TELEGRAM_ADMIN_USER_IDS value", zap.Error(err))
+			return nil, fmt.Errorf("invalid TELEGRAM_ADMIN_USER_IDS value: %v", err)
+		}
+		cfg.TelegramAdminUserIDs = ids
+	}
+
+	// Login buttons need the BASE_URL domain to be linked to the bot with /setdomain in BotFather
+	if loginStr := os.Getenv("TELEGRAM_LOGIN_URL"); loginStr != "" {
+		login, err := strconv.ParseBool(loginStr)
+		if err != nil {
+			logger.Error("Invalid TELEGRAM_LOGIN_URL value", zap.Error(err))
+			return nil, fmt.Errorf("invalid TELEGRAM_LOGIN_URL value: %v", err)
+		}
+		cfg.TelegramLoginURL = login
+	}
+
+	// Static v1 bearer tokens stay accepted until every tenant has been set up again
+	if allowStr := os.Getenv("WEBHOOK_ALLOW_V1"); allowStr != "" {
+		allow, err := strconv.ParseBool(allowStr)
+		if err != nil {
+			logger.Error("Invalid WEBHOOK_ALLOW_V1 value", zap.Error(err))
+			return nil, fmt.Errorf("invalid WEBHOOK_ALLOW_V1 value: %v", err)
+		}
+		cfg.WebhookAllowV1 = allow
+	}
+
+	if skewStr := os.Getenv("WEBHOOK_MAX_SKEW"); skewStr != "" {
+		// A zero window would reject every signed request
+		skew, err := time.ParseDuration(skewStr)
+		if err != nil || skew <= 0 {
+			logger.Error("Invalid WEBHOOK_MAX_SKEW value", zap.String("value", skewStr))
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_SKEW value: %s", skewStr)
+		}
+		cfg.WebhookMaxSkew = skew
+	}
+
+	// The OTP pull API stays disabled unless a token is configured
+	cfg.OTPAPIToken = os.Getenv("OTP_API_TOKEN")
+
+	if ttlStr := os.Getenv("OTP_BUFFER_TTL"); ttlStr != "" {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			logger.Error("Invalid OTP_BUFFER_TTL value", zap.String("value", ttlStr))
+			return nil, fmt.Errorf("invalid OTP_BUFFER_TTL value: %s", ttlStr)
+		}
+		cfg.OTPBufferTTL = ttl
+	}
+
 	// Base URL for the application
 	cfg.BaseURL = fmt.Sprintf("http://localhost:%d", cfg.BotPort)
 	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
@@ -95,7 +353,139 @@ func LoadConfig() (*Config, error) {
 	logger.Info("Configuration loaded successfully",
 		zap.Int("port", cfg.BotPort),
 		zap.String("environment", cfg.Environment),
-		zap.String("base_url", cfg.BaseURL))
+		zap.String("base_url", cfg.BaseURL),
+		zap.String("store_path", cfg.StorePath),
+		zap.String("telegram_update_mode", cfg.TelegramUpdateMode),
+		zap.String("hmac_active_key_id", cfg.HMACKeys.Active().ID),
+		zap.Bool("encryption", cfg.Encryption != nil),
+		zap.Bool("device_flow", cfg.Auth0DeviceClientID != ""),
+		zap.Bool("credential_vault", cfg.CredentialVault),
+		zap.Duration("drift_check_interval", cfg.DriftCheckInterval))
 
 	return cfg, nil
 }
+
+// parseUserIDs parses a comma separated list of Telegram user IDs
+func parseUserIDs(value string) ([]int64, error) {
+	var ids []int64
+	for _, idStr := range strings.Split(value, ",") {
+		idStr = strings.TrimSpace(idStr)
+		if idStr == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user ID %q", idStr)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseRetention parses a message retention. Plain numbers are minutes, as TELEGRAM_MESSAGE_EXPIRATION_TIME
+// always was, anything else is a Go duration such as 90s or 1h.
+func parseRetention(value string) (time.Duration, error) {
+	if minutes, err := strconv.Atoi(value); err == nil {
+		return time.Duration(minutes) * time.Minute, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	return retention, nil
+}
+
+// parseRetentions parses a comma separated list of key=retention pairs
+func parseRetentions[K comparable](value string, parseKey func(string) (K, error)) (map[K]time.Duration, error) {
+	retentions := make(map[K]time.Duration)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		keyStr, retentionStr, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid entry %q, expected key=retention", pair)
+		}
+		key, err := parseKey(strings.TrimSpace(keyStr))
+		if err != nil {
+			return nil, err
+		}
+		retention, err := parseRetention(strings.TrimSpace(retentionStr))
+		if err != nil {
+			return nil, err
+		}
+		retentions[key] = retention
+	}
+	return retentions, nil
+}
+
+// loadHMACKeys builds the HMAC keyring. HMAC_KEYS adds id:secret pairs next to the default secret,
+// HMAC_ACTIVE_KEY_ID selects the signing key and HMAC_RETIRED_KEY_IDS lists keys no longer accepted.
+func loadHMACKeys(defaultSecret string) (*utils.Keyring, error) {
+	extra, err := utils.ParseHMACKeys(os.Getenv("HMAC_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	keys := append([]utils.HMACKey{{ID: DefaultHMACKeyID, Secret: defaultSecret}}, extra...)
+
+	retired := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("HMAC_RETIRED_KEY_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			retired[id] = true
+		}
+	}
+	for i := range keys {
+		keys[i].Retired = retired[keys[i].ID]
+	}
+
+	activeID := DefaultHMACKeyID
+	if id := os.Getenv("HMAC_ACTIVE_KEY_ID"); id != "" {
+		activeID = id
+	}
+
+	return utils.NewKeyring(keys, activeID)
+}
+
+// loadEncryptionKeys builds the envelope the store is encrypted with. The master key is read from
+// ENCRYPTION_KEY or from the file named by ENCRYPTION_KEY_FILE, and recorded as ENCRYPTION_KEY_VERSION.
+// ENCRYPTION_PREVIOUS_KEYS lists version:key pairs of earlier master keys, needed until the records sealed
+// with them are re-encrypted. Without a master key it returns a nil envelope.
+func loadEncryptionKeys() (*utils.Envelope, error) {
+	keyStr, keyFile := os.Getenv("ENCRYPTION_KEY"), os.Getenv("ENCRYPTION_KEY_FILE")
+	switch {
+	case keyStr != "" && keyFile != "":
+		return nil, fmt.Errorf("set either ENCRYPTION_KEY or ENCRYPTION_KEY_FILE, not both")
+	case keyFile != "":
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ENCRYPTION_KEY_FILE: %w", err)
+		}
+		keyStr = string(data)
+	case keyStr == "":
+		if os.Getenv("ENCRYPTION_PREVIOUS_KEYS") != "" {
+			return nil, fmt.Errorf("ENCRYPTION_PREVIOUS_KEYS is set without ENCRYPTION_KEY")
+		}
+		return nil, nil
+	}
+
+	key, err := utils.ParseEncryptionKey(keyStr)
+	if err != nil {
+		return nil, err
+	}
+
+	version := uint64(1)
+	if versionStr := os.Getenv("ENCRYPTION_KEY_VERSION"); versionStr != "" {
+		if version, err = strconv.ParseUint(versionStr, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPTION_KEY_VERSION %q", versionStr)
+		}
+	}
+
+	previous, err := utils.ParseMasterKeys(os.Getenv("ENCRYPTION_PREVIOUS_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	keys := append([]utils.MasterKey{{Version: uint32(version), Key: key}}, previous...)
+
+	return utils.NewEnvelope(keys, uint32(version))
+}
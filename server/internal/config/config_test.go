@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setRequiredEnv(t *testing.T) {
+	t.Setenv("TELEGRAM_BOT_TOKEN", "token")
+	t.Setenv("ENCRYPTION_KEY", strings.Repeat("ab", 32))
+}
+
+func TestLoadConfigWebhookMaxSkew(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("WEBHOOK_MAX_SKEW", "2m")
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, cfg.WebhookMaxSkew)
+}
+
+func TestLoadConfigRejectsNonPositiveWebhookMaxSkew(t *testing.T) {
+	for _, skew := range []string{"0", "0s", "-1m", "soon"} {
+		t.Run(skew, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("WEBHOOK_MAX_SKEW", skew)
+
+			_, err := LoadConfig()
+			assert.ErrorContains(t, err, "WEBHOOK_MAX_SKEW")
+		})
+	}
+}
+
+func TestLoadConfigWithoutEncryptionKey(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ENCRYPTION_KEY", "")
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+	assert.Nil(t, cfg.Encryption, "the store decides whether it can run without a master key")
+
+	t.Setenv("CREDENTIAL_VAULT", "true")
+	_, err = LoadConfig()
+	assert.ErrorContains(t, err, "ENCRYPTION_KEY")
+}
+
+func TestLoadConfigRejectsNonPositiveOTPBufferTTL(t *testing.T) {
+	for _, ttl := range []string{"0", "0s", "-5m", "later"} {
+		t.Run(ttl, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("OTP_BUFFER_TTL", ttl)
+
+			_, err := LoadConfig()
+			assert.ErrorContains(t, err, "OTP_BUFFER_TTL")
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package otp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a captured OTP as exposed to test automation. Phone OTPs have a phone number, emails an email,
+// a subject and possibly a magic link.
+type Entry struct {
+	Domain      string    `json:"domain"`
+	PhoneNumber string    `json:"phone_number,omitempty"`
+	Email       string    `json:"email,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Code        string    `json:"code"`
+	MagicLink   string    `json:"magic_link,omitempty"`
+	Message     string    `json:"message"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+type slot struct {
+	entry *Entry
+	// notify is closed and replaced whenever a new entry is stored
+	notify  chan struct{}
+	waiters int
+}
+
+// Buffer keeps the latest OTP per domain and recipient for a limited time
+type Buffer struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	slots map[string]*slot
+}
+
+// NewBuffer creates a buffer whose entries expire after ttl
+func NewBuffer(ttl time.Duration) *Buffer {
+	return &Buffer{
+		ttl:   ttl,
+		slots: make(map[string]*slot),
+	}
+}
+
+// phoneReplacer strips formatting so "+1 (555) 010-0100" and "15550100100" match. It also covers a "+"
+// that was decoded as a space from an unescaped query string.
+var phoneReplacer = strings.NewReplacer(" ", "", "+", "", "-", "", "(", "", ")", "")
+
+// key identifies the recipient of an entry, a phone number or an email address. Email addresses keep their
+// "+" and are compared case-insensitively.
+func key(domain, recipient string) string {
+	recipient = strings.TrimSpace(recipient)
+	if strings.Contains(recipient, "@") {
+		recipient = strings.ToLower(recipient)
+	} else {
+		recipient = phoneReplacer.Replace(recipient)
+	}
+	return strings.ToLower(strings.TrimSpace(domain)) + "|" + recipient
+}
+
+// recipient is the phone number or, for emails, the email address of an entry
+func (e *Entry) recipient() string {
+	if e.Email != "" {
+		return e.Email
+	}
+	return e.PhoneNumber
+}
+
+// Put stores an entry, replacing any previous one for the same domain and recipient, and wakes up waiters
+func (b *Buffer) Put(entry Entry) {
+	if entry.ReceivedAt.IsZero() {
+		entry.ReceivedAt = time.Now().UTC()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep()
+
+	k := key(entry.Domain, entry.recipient())
+	s, ok := b.slots[k]
+	if !ok {
+		s = &slot{notify: make(chan struct{})}
+		b.slots[k] = s
+	}
+	s.entry = &entry
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// Latest returns the newest non-expired entry for a phone number or email address received after since.
+// If there is none, it waits until one arrives or ctx is done, in which case it returns nil.
+func (b *Buffer) Latest(ctx context.Context, domain, recipient string, since time.Time) *Entry {
+	k := key(domain, recipient)
+	for {
+		b.mu.Lock()
+		s, ok := b.slots[k]
+		if !ok {
+			s = &slot{notify: make(chan struct{})}
+			b.slots[k] = s
+		}
+		if entry := s.entry; entry != nil && entry.ReceivedAt.After(since) && !b.expired(entry) {
+			b.mu.Unlock()
+			result := *entry
+			return &result
+		}
+		notify := s.notify
+		s.waiters++
+		b.mu.Unlock()
+
+		var done bool
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			done = true
+		}
+
+		b.mu.Lock()
+		s.waiters--
+		b.mu.Unlock()
+		if done {
+			return nil
+		}
+	}
+}
+
+func (b *Buffer) expired(entry *Entry) bool {
+	return time.Since(entry.ReceivedAt) > b.ttl
+}
+
+// sweep drops expired entries. Slots with pending waiters are kept so they can still be notified.
+// Must be called with the lock held.
+func (b *Buffer) sweep() {
+	for k, s := range b.slots {
+		if s.entry != nil && b.expired(s.entry) {
+			s.entry = nil
+		}
+		if s.entry == nil && s.waiters == 0 {
+			delete(b.slots, k)
+		}
+	}
+}
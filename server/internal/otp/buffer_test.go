@@ -0,0 +1,70 @@
+package otp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferLatest(t *testing.T) {
+	b := NewBuffer(time.Minute)
+	b.Put(Entry{Domain: "Test.auth0.com", PhoneNumber: "+1 555 0100", Code: "111111"})
+	b.Put(Entry{Domain: "test.auth0.com", PhoneNumber: "+15550100", Code: "222222"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	entry := b.Latest(ctx, "test.auth0.com", "+15550100", time.Time{})
+	require.NotNil(t, entry)
+	assert.Equal(t, "222222", entry.Code)
+
+	// Nothing newer than the last entry
+	assert.Nil(t, b.Latest(ctx, "test.auth0.com", "+15550100", entry.ReceivedAt))
+	// Other recipients are isolated
+	assert.Nil(t, b.Latest(ctx, "test.auth0.com", "+15550199", time.Time{}))
+}
+
+func TestBufferLongPoll(t *testing.T) {
+	b := NewBuffer(time.Minute)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Put(Entry{Domain: "test.auth0.com", PhoneNumber: "+15550100", Code: "333333"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	entry := b.Latest(ctx, "test.auth0.com", "+15550100", time.Now())
+	require.NotNil(t, entry)
+	assert.Equal(t, "333333", entry.Code)
+}
+
+func TestBufferExpiry(t *testing.T) {
+	b := NewBuffer(time.Millisecond)
+	b.Put(Entry{Domain: "test.auth0.com", PhoneNumber: "+15550100", Code: "444444"})
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.Nil(t, b.Latest(ctx, "test.auth0.com", "+15550100", time.Time{}))
+}
+
+func TestBufferKeysEmailsByAddress(t *testing.T) {
+	b := NewBuffer(time.Minute)
+	b.Put(Entry{Domain: "test.auth0.com", Email: "QA+login@Example.com", Code: "333333"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	entry := b.Latest(ctx, "test.auth0.com", "qa+login@example.com", time.Time{})
+	require.NotNil(t, entry)
+	assert.Equal(t, "333333", entry.Code)
+
+	// The "+" tag is part of the address
+	assert.Nil(t, b.Latest(ctx, "test.auth0.com", "qalogin@example.com", time.Time{}))
+}
@@ -0,0 +1,50 @@
+package otp
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	urlPattern = regexp.MustCompile(`https?://[^\s"'<>]+`)
+	// A code following the word "code", as in "Your verification code is: 123456"
+	labelledCodePattern = regexp.MustCompile(`(?i)\bcode\D{0,40}?\b(\d{4,10})\b`)
+	// Otherwise, the first six digit number
+	codePattern = regexp.MustCompile(`\b\d{6}\b`)
+)
+
+// magicLinkMarkers identify the URLs of passwordless magic links and verification tickets among the other links
+// of an email, such as logos and privacy policies
+var magicLinkMarkers = []string{"/passwordless/verify_redirect", "verification_code=", "ticket="}
+
+// ExtractMagicLink returns the first magic link of an email, in plain text or HTML, or "" when it has none
+func ExtractMagicLink(message string) string {
+	for _, match := range urlPattern.FindAllString(message, -1) {
+		link := strings.TrimRight(html.UnescapeString(match), ".,;:!?)")
+		for _, marker := range magicLinkMarkers {
+			if strings.Contains(link, marker) {
+				return link
+			}
+		}
+	}
+	return ""
+}
+
+// ExtractCode returns the one-time code of an email, or "" when it has none. Numbers in links are ignored,
+// except the verification code of a magic link when the text shows no code.
+func ExtractCode(message string) string {
+	text := urlPattern.ReplaceAllString(message, " ")
+	if match := labelledCodePattern.FindStringSubmatch(text); match != nil {
+		return match[1]
+	}
+	if code := codePattern.FindString(text); code != "" {
+		return code
+	}
+
+	if link, err := url.Parse(ExtractMagicLink(message)); err == nil {
+		return link.Query().Get("verification_code")
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package otp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"labelled", "Your verification code is: 482913. It expires in 5 minutes.", "482913"},
+		{"labelled after other numbers", "© 2026 Acme\nUse code 7351 to continue", "7351"},
+		{"six digits", "Enter 120394 to sign in", "120394"},
+		{"ignores links", "Open https://acme.auth0.com/u/123456 to continue", ""},
+		{
+			"from the magic link",
+			`<a href="https://acme.auth0.com/passwordless/verify_redirect?verification_code=553201&amp;connection=email">Log in</a>`,
+			"553201",
+		},
+		{"none", "Welcome to Acme", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ExtractCode(tt.message))
+		})
+	}
+}
+
+func TestExtractMagicLink(t *testing.T) {
+	message := `<img src="https://cdn.acme.com/logo.png">
+<a href="https://acme.auth0.com/passwordless/verify_redirect?scope=openid&amp;verification_code=553201&amp;email=a%2Bb%40acme.com">Log in</a>`
+
+	assert.Equal(t,
+		"https://acme.auth0.com/passwordless/verify_redirect?scope=openid&verification_code=553201&email=a%2Bb%40acme.com",
+		ExtractMagicLink(message))
+	assert.Equal(t, "https://acme.auth0.com/u/email-verification?ticket=abc",
+		ExtractMagicLink("Verify your account: https://acme.auth0.com/u/email-verification?ticket=abc."))
+	assert.Empty(t, ExtractMagicLink("See https://acme.com/privacy"))
+}
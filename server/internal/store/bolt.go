@@ -0,0 +1,440 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	registrationsBucket = []byte("registrations")
+	snapshotsBucket     = []byte("snapshots")
+	deletionsBucket     = []byte("deletions")
+	chatSettingsBucket  = []byte("chat_settings")
+	authLinksBucket     = []byte("auth_links")
+	credentialsBucket   = []byte("credentials")
+)
+
+// buckets lists every bucket of the database
+var buckets = [][]byte{registrationsBucket, snapshotsBucket, deletionsBucket, chatSettingsBucket, authLinksBucket,
+	credentialsBucket}
+
+// BoltStore is the default Store backed by an embedded bbolt database. Every record is sealed with the
+// envelope, so nothing about tenants and chats is written to disk in plaintext.
+type BoltStore struct {
+	db       *bolt.DB
+	envelope *utils.Envelope
+}
+
+// NewBoltStore opens (or creates) the database file at path, encrypting its records with envelope.
+// Without an envelope, a database written before the store was encrypted keeps being used in plaintext
+// until a master key is configured. New databases and encrypted ones return ErrEncryptionKeyRequired.
+func NewBoltStore(path string, envelope *utils.Envelope) (*BoltStore, error) {
+	if envelope == nil {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return nil, ErrEncryptionKeyRequired
+		}
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create store directory: %w", err)
+		}
+	}
+
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to initialize store: %w", err)
+	}
+
+	s := &BoltStore{db: db, envelope: envelope}
+	if envelope == nil {
+		sealed, err := s.hasSealedRecords()
+		if err == nil && sealed {
+			err = ErrEncryptionKeyRequired
+		}
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// hasSealedRecords reports whether any record was sealed with a master key
+func (s *BoltStore) hasSealedRecords() (bool, error) {
+	var sealed bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			err := tx.Bucket(bucket).ForEach(func(_, data []byte) error {
+				sealed = sealed || utils.IsSealed(data)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to read store: %w", err)
+	}
+	return sealed, nil
+}
+
+// encode marshals a record and seals it. The bucket and key are the additional data, so a record
+// copied to another key or bucket cannot be opened.
+func (s *BoltStore) encode(bucket, key []byte, v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || s.envelope == nil {
+		return data, err
+	}
+	return s.envelope.Seal(data, recordAAD(bucket, key))
+}
+
+// decode opens a record sealed by encode. Records written before the store was encrypted are read as they
+// are, until Reencrypt seals them.
+func (s *BoltStore) decode(bucket, key, data []byte, v interface{}) error {
+	if utils.IsSealed(data) {
+		if s.envelope == nil {
+			return ErrEncryptionKeyRequired
+		}
+		var err error
+		if data, err = s.envelope.Open(data, recordAAD(bucket, key)); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Reencrypt seals the records still in plaintext and wraps the data keys of records sealed with a previous
+// master key with the active one. It returns how many records were updated. Once it has run with the new
+// master key, the previous keys are no longer needed. Without a master key there is nothing to do.
+func (s *BoltStore) Reencrypt() (int, error) {
+	if s.envelope == nil {
+		return 0, nil
+	}
+
+	var updated int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			b := tx.Bucket(bucket)
+
+			// Collected first, bbolt does not support modifying a bucket while iterating it
+			records := make(map[string][]byte)
+			err := b.ForEach(func(key, data []byte) error {
+				aad := recordAAD(bucket, key)
+
+				var sealed []byte
+				var err error
+				if !utils.IsSealed(data) {
+					sealed, err = s.envelope.Seal(data, aad)
+				} else if version, _ := utils.KeyVersion(data); version != s.envelope.ActiveVersion() {
+					sealed, err = s.envelope.Rewrap(data, aad)
+				} else {
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to re-encrypt %s/%s: %w", bucket, key, err)
+				}
+				records[string(key)] = sealed
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for key, sealed := range records {
+				if err := b.Put([]byte(key), sealed); err != nil {
+					return err
+				}
+			}
+			updated += len(records)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return updated, nil
+}
+
+func recordAAD(bucket, key []byte) []byte {
+	return []byte(string(bucket) + "/" + string(key))
+}
+
+func (s *BoltStore) SaveRegistration(reg *Registration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(registrationsBucket)
+
+		key := []byte(reg.Domain)
+		var existing *Registration
+		if data := b.Get(key); data != nil {
+			existing = &Registration{}
+			if err := s.decode(registrationsBucket, key, data, existing); err != nil {
+				return fmt.Errorf("failed to parse registration: %w", err)
+			}
+		}
+		stamp(reg, existing)
+
+		data, err := s.encode(registrationsBucket, key, reg)
+		if err != nil {
+			return fmt.Errorf("failed to encode registration: %w", err)
+		}
+		return b.Put(key, data)
+	})
+}
+
+func (s *BoltStore) GetRegistration(domain string) (*Registration, error) {
+	var reg *Registration
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(registrationsBucket).Get([]byte(domain))
+		if data == nil {
+			return ErrNotFound
+		}
+		reg = &Registration{}
+		return s.decode(registrationsBucket, []byte(domain), data, reg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+func (s *BoltStore) ListRegistrations() ([]*Registration, error) {
+	return s.listRegistrations(func(*Registration) bool { return true })
+}
+
+func (s *BoltStore) ListRegistrationsByChat(chatID int64) ([]*Registration, error) {
+	return s.listRegistrations(func(reg *Registration) bool { return reg.ChatID == chatID })
+}
+
+func (s *BoltStore) listRegistrations(match func(*Registration) bool) ([]*Registration, error) {
+	var regs []*Registration
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(registrationsBucket).ForEach(func(key, data []byte) error {
+			reg := &Registration{}
+			if err := s.decode(registrationsBucket, key, data, reg); err != nil {
+				return fmt.Errorf("failed to parse registration: %w", err)
+			}
+			if match(reg) {
+				regs = append(regs, reg)
+			}
+			return nil
+		})
+	})
+	return regs, err
+}
+
+func (s *BoltStore) DeleteRegistration(domain string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(registrationsBucket).Delete([]byte(domain))
+	})
+}
+
+func (s *BoltStore) SaveSnapshot(snapshot *Snapshot) error {
+	if snapshot.CapturedAt.IsZero() {
+		snapshot.CapturedAt = time.Now().UTC()
+	}
+
+	key := []byte(snapshot.Domain)
+	data, err := s.encode(snapshotsBucket, key, snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Put(key, data)
+	})
+}
+
+func (s *BoltStore) GetSnapshot(domain string) (*Snapshot, error) {
+	var snapshot *Snapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(snapshotsBucket).Get([]byte(domain))
+		if data == nil {
+			return ErrNotFound
+		}
+		snapshot = &Snapshot{}
+		return s.decode(snapshotsBucket, []byte(domain), data, snapshot)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func (s *BoltStore) DeleteSnapshot(domain string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(snapshotsBucket).Delete([]byte(domain))
+	})
+}
+
+func (s *BoltStore) SaveChatSettings(settings *ChatSettings) error {
+	settings.UpdatedAt = time.Now().UTC()
+
+	key := []byte(strconv.FormatInt(settings.ChatID, 10))
+	data, err := s.encode(chatSettingsBucket, key, settings)
+	if err != nil {
+		return fmt.Errorf("failed to encode chat settings: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatSettingsBucket).Put(key, data)
+	})
+}
+
+func (s *BoltStore) GetChatSettings(chatID int64) (*ChatSettings, error) {
+	var settings *ChatSettings
+	err := s.db.View(func(tx *bolt.Tx) error {
+		key := []byte(strconv.FormatInt(chatID, 10))
+		data := tx.Bucket(chatSettingsBucket).Get(key)
+		if data == nil {
+			return ErrNotFound
+		}
+		settings = &ChatSettings{}
+		return s.decode(chatSettingsBucket, key, data, settings)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *BoltStore) SaveDeletion(deletion *Deletion) error {
+	key := []byte(deletion.Key())
+	data, err := s.encode(deletionsBucket, key, deletion)
+	if err != nil {
+		return fmt.Errorf("failed to encode deletion: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deletionsBucket).Put(key, data)
+	})
+}
+
+func (s *BoltStore) ListDeletions() ([]*Deletion, error) {
+	var deletions []*Deletion
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deletionsBucket).ForEach(func(key, data []byte) error {
+			deletion := &Deletion{}
+			if err := s.decode(deletionsBucket, key, data, deletion); err != nil {
+				return fmt.Errorf("failed to parse deletion: %w", err)
+			}
+			deletions = append(deletions, deletion)
+			return nil
+		})
+	})
+	return deletions, err
+}
+
+func (s *BoltStore) DeleteDeletion(chatID, messageID int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deletionsBucket).Delete([]byte(deletionKey(chatID, messageID)))
+	})
+}
+
+func (s *BoltStore) UpdateAuthLink(nonce string, update func(link *AuthLink) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(authLinksBucket)
+
+		// Purge expired links, deleting while iterating is not supported by bbolt cursors
+		now := time.Now()
+		var expired [][]byte
+		err := b.ForEach(func(key, data []byte) error {
+			link := &AuthLink{}
+			if err := s.decode(authLinksBucket, key, data, link); err != nil || now.After(link.ExpiresAt) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		key := []byte(nonce)
+		link := &AuthLink{Nonce: nonce}
+		if data := b.Get(key); data != nil {
+			if err := s.decode(authLinksBucket, key, data, link); err != nil {
+				return fmt.Errorf("failed to parse auth link: %w", err)
+			}
+		}
+
+		if err := update(link); err != nil {
+			return err
+		}
+
+		data, err := s.encode(authLinksBucket, key, link)
+		if err != nil {
+			return fmt.Errorf("failed to encode auth link: %w", err)
+		}
+		return b.Put(key, data)
+	})
+}
+
+func (s *BoltStore) SaveCredential(credential *Credential) error {
+	if credential.CreatedAt.IsZero() {
+		credential.CreatedAt = time.Now().UTC()
+	}
+
+	key := []byte(credential.Domain)
+	data, err := s.encode(credentialsBucket, key, credential)
+	if err != nil {
+		return fmt.Errorf("failed to encode credential: %w", err)
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).Put(key, data)
+	})
+}
+
+func (s *BoltStore) GetCredential(domain string) (*Credential, error) {
+	var credential *Credential
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(credentialsBucket).Get([]byte(domain))
+		if data == nil {
+			return ErrNotFound
+		}
+		credential = &Credential{}
+		return s.decode(credentialsBucket, []byte(domain), data, credential)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+func (s *BoltStore) DeleteCredential(domain string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).Delete([]byte(domain))
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
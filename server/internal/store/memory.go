@@ -0,0 +1,261 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a non-persistent Store, intended for tests and ephemeral deployments. Nothing is written
+// to disk, so its records are not encrypted.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	registrations map[string]Registration
+	snapshots     map[string]Snapshot
+	deletions     map[string]Deletion
+	chatSettings  map[int64]ChatSettings
+	authLinks     map[string]AuthLink
+	credentials   map[string]Credential
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		registrations: make(map[string]Registration),
+		snapshots:     make(map[string]Snapshot),
+		deletions:     make(map[string]Deletion),
+		chatSettings:  make(map[int64]ChatSettings),
+		authLinks:     make(map[string]AuthLink),
+		credentials:   make(map[string]Credential),
+	}
+}
+
+func (s *MemoryStore) SaveRegistration(reg *Registration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing *Registration
+	if current, ok := s.registrations[reg.Domain]; ok {
+		existing = &current
+	}
+	stamp(reg, existing)
+	s.registrations[reg.Domain] = copyRegistration(reg)
+	return nil
+}
+
+func (s *MemoryStore) GetRegistration(domain string) (*Registration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reg, ok := s.registrations[domain]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := copyRegistration(&reg)
+	return &result, nil
+}
+
+func (s *MemoryStore) ListRegistrations() ([]*Registration, error) {
+	return s.listRegistrations(func(*Registration) bool { return true }), nil
+}
+
+func (s *MemoryStore) ListRegistrationsByChat(chatID int64) ([]*Registration, error) {
+	return s.listRegistrations(func(reg *Registration) bool { return reg.ChatID == chatID }), nil
+}
+
+func (s *MemoryStore) listRegistrations(match func(*Registration) bool) []*Registration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var regs []*Registration
+	for _, reg := range s.registrations {
+		if match(&reg) {
+			result := copyRegistration(&reg)
+			regs = append(regs, &result)
+		}
+	}
+	// Match the key order of the bolt implementation
+	sort.Slice(regs, func(i, j int) bool { return regs[i].Domain < regs[j].Domain })
+	return regs
+}
+
+func (s *MemoryStore) DeleteRegistration(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.registrations, domain)
+	return nil
+}
+
+func (s *MemoryStore) SaveSnapshot(snapshot *Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snapshot.CapturedAt.IsZero() {
+		snapshot.CapturedAt = time.Now().UTC()
+	}
+	result := *snapshot
+	result.Data = append([]byte(nil), snapshot.Data...)
+	s.snapshots[snapshot.Domain] = result
+	return nil
+}
+
+func (s *MemoryStore) GetSnapshot(domain string) (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot, ok := s.snapshots[domain]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	snapshot.Data = append([]byte(nil), snapshot.Data...)
+	return &snapshot, nil
+}
+
+func (s *MemoryStore) DeleteSnapshot(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.snapshots, domain)
+	return nil
+}
+
+func (s *MemoryStore) SaveChatSettings(settings *ChatSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings.UpdatedAt = time.Now().UTC()
+	s.chatSettings[settings.ChatID] = copyChatSettings(settings)
+	return nil
+}
+
+func (s *MemoryStore) GetChatSettings(chatID int64) (*ChatSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	settings, ok := s.chatSettings[chatID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := copyChatSettings(&settings)
+	return &result, nil
+}
+
+func (s *MemoryStore) SaveDeletion(deletion *Deletion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deletions[deletion.Key()] = *deletion
+	return nil
+}
+
+func (s *MemoryStore) ListDeletions() ([]*Deletion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var deletions []*Deletion
+	for _, deletion := range s.deletions {
+		deletion := deletion
+		deletions = append(deletions, &deletion)
+	}
+	// Match the key order of the bolt implementation
+	sort.Slice(deletions, func(i, j int) bool { return deletions[i].Key() < deletions[j].Key() })
+	return deletions, nil
+}
+
+func (s *MemoryStore) DeleteDeletion(chatID, messageID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deletions, deletionKey(chatID, messageID))
+	return nil
+}
+
+func (s *MemoryStore) UpdateAuthLink(nonce string, update func(link *AuthLink) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, link := range s.authLinks {
+		if now.After(link.ExpiresAt) {
+			delete(s.authLinks, key)
+		}
+	}
+
+	link := AuthLink{Nonce: nonce}
+	if current, ok := s.authLinks[nonce]; ok {
+		link = copyAuthLink(&current)
+	}
+
+	if err := update(&link); err != nil {
+		return err
+	}
+	s.authLinks[nonce] = copyAuthLink(&link)
+	return nil
+}
+
+func (s *MemoryStore) SaveCredential(credential *Credential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if credential.CreatedAt.IsZero() {
+		credential.CreatedAt = time.Now().UTC()
+	}
+	s.credentials[credential.Domain] = *credential
+	return nil
+}
+
+func (s *MemoryStore) GetCredential(domain string) (*Credential, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	credential, ok := s.credentials[domain]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &credential, nil
+}
+
+func (s *MemoryStore) DeleteCredential(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.credentials, domain)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// copyRegistration prevents callers from mutating the stored maps
+func copyRegistration(reg *Registration) Registration {
+	result := *reg
+	if reg.ActionIDs != nil {
+		result.ActionIDs = make(map[string]string, len(reg.ActionIDs))
+		for k, v := range reg.ActionIDs {
+			result.ActionIDs[k] = v
+		}
+	}
+	return result
+}
+
+// copyChatSettings prevents callers from mutating the stored retention
+func copyChatSettings(settings *ChatSettings) ChatSettings {
+	result := *settings
+	if settings.Retention != nil {
+		retention := *settings.Retention
+		result.Retention = &retention
+	}
+	return result
+}
+
+// copyAuthLink prevents callers from mutating the stored use time
+func copyAuthLink(link *AuthLink) AuthLink {
+	result := *link
+	if link.UsedAt != nil {
+		usedAt := *link.UsedAt
+		result.UsedAt = &usedAt
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotFound is returned when a record does not exist in the store
+var ErrNotFound = errors.New("record not found")
+
+// ErrEncryptionKeyRequired is returned when a store without a master key is new or already holds encrypted records
+var ErrEncryptionKeyRequired = errors.New("the store needs an encryption key")
+
+// Registration binds an Auth0 domain to the Telegram chat receiving its OTPs
+type Registration struct {
+	Domain    string            `json:"domain"`
+	ChatID    int64             `json:"chat_id"`
+	ThreadID  int64             `json:"thread_id"` // Forum topic OTPs are posted to, zero outside forums
+	AuthType  string            `json:"auth_type"`
+	ActionIDs map[string]string `json:"action_ids"` // Keyed by trigger ID
+	KeyID     string            `json:"key_id"`     // HMAC key the actions sign with, empty before key IDs existed
+	Paused    bool              `json:"paused"`     // OTPs are not posted to the chat while paused
+	// ForwardEmail is set when the user opted into forwarding the tenant's emails to the chat
+	ForwardEmail bool      `json:"forward_email,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Snapshot is the tenant configuration captured before the bot first modified it
+type Snapshot struct {
+	Domain     string          `json:"domain"`
+	Data       json.RawMessage `json:"data"`
+	CapturedAt time.Time       `json:"captured_at"`
+}
+
+// ChatSettings are the preferences a chat chose with /settings. The zero value is the default behavior.
+type ChatSettings struct {
+	ChatID       int64          `json:"chat_id"`
+	Retention    *time.Duration `json:"retention,omitempty"` // Nil uses the server retention
+	HideRawEvent bool           `json:"hide_raw_event"`
+	MaskPhone    bool           `json:"mask_phone"`
+	Silent       bool           `json:"silent"`
+	Template     string         `json:"template"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// Deletion is a Telegram message scheduled for deletion
+type Deletion struct {
+	ChatID    int64     `json:"chat_id"`
+	MessageID int64     `json:"message_id"`
+	DeleteAt  time.Time `json:"delete_at"`
+	Attempts  int       `json:"attempts"`
+}
+
+// AuthLink tracks the use of a signed auth-form link, so it can only be used once
+type AuthLink struct {
+	Nonce     string     `json:"nonce"`
+	Session   string     `json:"session"` // Hash of the browser session that opened the link, empty until opened
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
+
+// Credential is the client credentials of a tenant, stored with the consent of the user who set it up
+type Credential struct {
+	Domain       string    `json:"domain"`
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret"`
+	ConsentedBy  int64     `json:"consented_by"` // Telegram user who agreed to store the credentials
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Key identifies the message a deletion is for
+func (d *Deletion) Key() string {
+	return deletionKey(d.ChatID, d.MessageID)
+}
+
+// Store persists the server state that cannot be derived from Telegram or Auth0
+type Store interface {
+	// SaveRegistration creates or replaces the registration for its domain
+	SaveRegistration(reg *Registration) error
+	// GetRegistration returns the registration for a domain or ErrNotFound
+	GetRegistration(domain string) (*Registration, error)
+	// ListRegistrations returns every registration
+	ListRegistrations() ([]*Registration, error)
+	// ListRegistrationsByChat returns the registrations owned by a chat
+	ListRegistrationsByChat(chatID int64) ([]*Registration, error)
+	// DeleteRegistration removes the registration for a domain
+	DeleteRegistration(domain string) error
+	// SaveSnapshot creates or replaces the snapshot for its domain
+	SaveSnapshot(snapshot *Snapshot) error
+	// GetSnapshot returns the snapshot for a domain or ErrNotFound
+	GetSnapshot(domain string) (*Snapshot, error)
+	// DeleteSnapshot removes the snapshot for a domain
+	DeleteSnapshot(domain string) error
+	// SaveChatSettings creates or replaces the settings of a chat
+	SaveChatSettings(settings *ChatSettings) error
+	// GetChatSettings returns the settings of a chat or ErrNotFound
+	GetChatSettings(chatID int64) (*ChatSettings, error)
+	// SaveDeletion creates or replaces the deletion for its message
+	SaveDeletion(deletion *Deletion) error
+	// ListDeletions returns every pending deletion
+	ListDeletions() ([]*Deletion, error)
+	// DeleteDeletion removes the deletion for a message
+	DeleteDeletion(chatID, messageID int64) error
+	// UpdateAuthLink atomically updates the link for a nonce. update receives a link with only the nonce set
+	// when there is none yet; its error is returned and nothing is saved. Expired links are purged.
+	UpdateAuthLink(nonce string, update func(link *AuthLink) error) error
+	// SaveCredential creates or replaces the credential for its domain
+	SaveCredential(credential *Credential) error
+	// GetCredential returns the credential for a domain or ErrNotFound
+	GetCredential(domain string) (*Credential, error)
+	// DeleteCredential removes the credential for a domain
+	DeleteCredential(domain string) error
+	// Close releases the underlying resources
+	Close() error
+}
+
+// stamp keeps the original creation time of an existing registration and refreshes the update time
+func stamp(reg *Registration, existing *Registration) {
+	now := time.Now().UTC()
+	if existing != nil && !existing.CreatedAt.IsZero() {
+		reg.CreatedAt = existing.CreatedAt
+	}
+	if reg.CreatedAt.IsZero() {
+		reg.CreatedAt = now
+	}
+	reg.UpdatedAt = now
+}
+
+func deletionKey(chatID, messageID int64) string {
+	return fmt.Sprintf("%d:%d", chatID, messageID)
+}
@@ -0,0 +1,324 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testEnvelope seals with the master key version active, all the listed versions can be opened
+func testEnvelope(t *testing.T, active uint32, versions ...uint32) *utils.Envelope {
+	var keys []utils.MasterKey
+	for _, version := range versions {
+		keys = append(keys, utils.MasterKey{Version: version, Key: bytes.Repeat([]byte{byte(version)}, utils.EncryptionKeySize)})
+	}
+	envelope, err := utils.NewEnvelope(keys, active)
+	require.NoError(t, err)
+	return envelope
+}
+
+func testStores(t *testing.T) map[string]Store {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"), testEnvelope(t, 1, 1))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bolt.Close() })
+
+	return map[string]Store{
+		"bolt":   bolt,
+		"memory": NewMemoryStore(),
+	}
+}
+
+func TestRegistrations(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.GetRegistration("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			reg := &Registration{
+				Domain:    "test.auth0.com",
+				ChatID:    42,
+				AuthType:  "auth_client_credentials",
+				ActionIDs: map[string]string{"send-phone-message": "act_1"},
+			}
+			require.NoError(t, s.SaveRegistration(reg))
+			require.NoError(t, s.SaveRegistration(&Registration{Domain: "other.auth0.com", ChatID: 7}))
+
+			got, err := s.GetRegistration("test.auth0.com")
+			require.NoError(t, err)
+			assert.Equal(t, int64(42), got.ChatID)
+			assert.Equal(t, "act_1", got.ActionIDs["send-phone-message"])
+			assert.False(t, got.CreatedAt.IsZero())
+			createdAt := got.CreatedAt
+
+			// Saving again keeps the creation time
+			require.NoError(t, s.SaveRegistration(&Registration{Domain: "test.auth0.com", ChatID: 42}))
+			got, err = s.GetRegistration("test.auth0.com")
+			require.NoError(t, err)
+			assert.True(t, createdAt.Equal(got.CreatedAt))
+			assert.False(t, got.UpdatedAt.Before(createdAt))
+
+			regs, err := s.ListRegistrationsByChat(42)
+			require.NoError(t, err)
+			require.Len(t, regs, 1)
+			assert.Equal(t, "test.auth0.com", regs[0].Domain)
+
+			regs, err = s.ListRegistrations()
+			require.NoError(t, err)
+			assert.Len(t, regs, 2)
+
+			require.NoError(t, s.DeleteRegistration("test.auth0.com"))
+			_, err = s.GetRegistration("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.GetSnapshot("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			data := []byte(`{"selected_provider":"twilio"}`)
+			require.NoError(t, s.SaveSnapshot(&Snapshot{Domain: "test.auth0.com", Data: data}))
+
+			got, err := s.GetSnapshot("test.auth0.com")
+			require.NoError(t, err)
+			assert.JSONEq(t, string(data), string(got.Data))
+			assert.False(t, got.CapturedAt.IsZero())
+
+			require.NoError(t, s.DeleteSnapshot("test.auth0.com"))
+			_, err = s.GetSnapshot("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestDeletions(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			deleteAt := time.Now().Add(5 * time.Minute).UTC()
+			require.NoError(t, s.SaveDeletion(&Deletion{ChatID: 42, MessageID: 1, DeleteAt: deleteAt}))
+			require.NoError(t, s.SaveDeletion(&Deletion{ChatID: 42, MessageID: 2, DeleteAt: deleteAt}))
+
+			// Saving the same message again replaces its deletion
+			require.NoError(t, s.SaveDeletion(&Deletion{ChatID: 42, MessageID: 1, DeleteAt: deleteAt, Attempts: 2}))
+
+			deletions, err := s.ListDeletions()
+			require.NoError(t, err)
+			require.Len(t, deletions, 2)
+			assert.Equal(t, int64(1), deletions[0].MessageID)
+			assert.Equal(t, 2, deletions[0].Attempts)
+			assert.True(t, deleteAt.Equal(deletions[0].DeleteAt))
+
+			require.NoError(t, s.DeleteDeletion(42, 1))
+			deletions, err = s.ListDeletions()
+			require.NoError(t, err)
+			require.Len(t, deletions, 1)
+			assert.Equal(t, int64(2), deletions[0].MessageID)
+		})
+	}
+}
+
+func TestChatSettings(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.GetChatSettings(42)
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			retention := 15 * time.Minute
+			require.NoError(t, s.SaveChatSettings(&ChatSettings{
+				ChatID:    42,
+				Retention: &retention,
+				MaskPhone: true,
+				Template:  "compact",
+			}))
+
+			got, err := s.GetChatSettings(42)
+			require.NoError(t, err)
+			require.NotNil(t, got.Retention)
+			assert.Equal(t, 15*time.Minute, *got.Retention)
+			assert.True(t, got.MaskPhone)
+			assert.False(t, got.Silent)
+			assert.Equal(t, "compact", got.Template)
+			assert.False(t, got.UpdatedAt.IsZero())
+
+			_, err = s.GetChatSettings(7)
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestAuthLinks(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			errUsed := errors.New("used")
+			use := func(link *AuthLink) error {
+				if link.UsedAt != nil {
+					return errUsed
+				}
+				now := time.Now()
+				link.UsedAt = &now
+				link.ExpiresAt = now.Add(time.Hour)
+				return nil
+			}
+
+			require.NoError(t, s.UpdateAuthLink("nonce-1", use))
+			assert.ErrorIs(t, s.UpdateAuthLink("nonce-1", use), errUsed, "links are only used once")
+			require.NoError(t, s.UpdateAuthLink("nonce-2", use))
+
+			// An update that fails saves nothing
+			require.ErrorIs(t, s.UpdateAuthLink("nonce-3", func(link *AuthLink) error {
+				link.ExpiresAt = time.Now().Add(time.Hour)
+				return errUsed
+			}), errUsed)
+			require.NoError(t, s.UpdateAuthLink("nonce-3", func(link *AuthLink) error {
+				assert.Empty(t, link.Session)
+				assert.Nil(t, link.UsedAt)
+				link.ExpiresAt = time.Now().Add(-time.Second)
+				return nil
+			}))
+
+			// Expired links are purged on the next update
+			assert.ErrorIs(t, s.UpdateAuthLink("nonce-3", func(link *AuthLink) error {
+				assert.True(t, link.ExpiresAt.IsZero())
+				return errUsed
+			}), errUsed)
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := s.GetCredential("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+
+			require.NoError(t, s.SaveCredential(&Credential{
+				Domain:       "test.auth0.com",
+				ClientID:     "client",
+				ClientSecret: "s3cr3t",
+				ConsentedBy:  7,
+			}))
+
+			got, err := s.GetCredential("test.auth0.com")
+			require.NoError(t, err)
+			assert.Equal(t, "client", got.ClientID)
+			assert.Equal(t, "s3cr3t", got.ClientSecret)
+			assert.Equal(t, int64(7), got.ConsentedBy)
+			assert.False(t, got.CreatedAt.IsZero())
+
+			require.NoError(t, s.DeleteCredential("test.auth0.com"))
+			_, err = s.GetCredential("test.auth0.com")
+			assert.ErrorIs(t, err, ErrNotFound)
+		})
+	}
+}
+
+func TestBoltStoreEncryptsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewBoltStore(path, testEnvelope(t, 1, 1))
+	require.NoError(t, err)
+
+	require.NoError(t, s.SaveRegistration(&Registration{Domain: "test.auth0.com", ChatID: 42}))
+	require.NoError(t, s.SaveSnapshot(&Snapshot{Domain: "test.auth0.com", Data: json.RawMessage(`{"auth_token":"tw1l10"}`)}))
+	require.NoError(t, s.SaveCredential(&Credential{Domain: "test.auth0.com", ClientID: "client", ClientSecret: "s3cr3t"}))
+	require.NoError(t, s.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "s3cr3t")
+	assert.NotContains(t, string(data), "tw1l10")
+	assert.NotContains(t, string(data), `"chat_id"`)
+
+	// Without the master key the records cannot be read
+	s, err = NewBoltStore(path, testEnvelope(t, 2, 2))
+	require.NoError(t, err)
+	_, err = s.GetCredential("test.auth0.com")
+	assert.ErrorContains(t, err, "unknown master key version 1")
+	require.NoError(t, s.Close())
+}
+
+func TestBoltStoreReencrypt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewBoltStore(path, testEnvelope(t, 1, 1))
+	require.NoError(t, err)
+	require.NoError(t, s.SaveRegistration(&Registration{Domain: "test.auth0.com", ChatID: 42}))
+	require.NoError(t, s.SaveCredential(&Credential{Domain: "test.auth0.com", ClientID: "client", ClientSecret: "s3cr3t"}))
+
+	// A record written before the store was encrypted
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(chatSettingsBucket).Put([]byte("42"), []byte(`{"chat_id":42,"silent":true}`))
+	})
+	require.NoError(t, err)
+	settings, err := s.GetChatSettings(42)
+	require.NoError(t, err)
+	assert.True(t, settings.Silent)
+	require.NoError(t, s.Close())
+
+	// Rotate the master key, keeping the previous one until the records are re-encrypted
+	s, err = NewBoltStore(path, testEnvelope(t, 2, 1, 2))
+	require.NoError(t, err)
+	updated, err := s.Reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 3, updated)
+	updated, err = s.Reencrypt()
+	require.NoError(t, err)
+	assert.Zero(t, updated)
+	require.NoError(t, s.Close())
+
+	s, err = NewBoltStore(path, testEnvelope(t, 2, 2))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	reg, err := s.GetRegistration("test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), reg.ChatID)
+	credential, err := s.GetCredential("test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", credential.ClientSecret)
+	settings, err = s.GetChatSettings(42)
+	require.NoError(t, err)
+	assert.True(t, settings.Silent)
+}
+
+func TestBoltStoreWithoutEncryptionKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	_, err := NewBoltStore(path, nil)
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired, "new stores are encrypted")
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	// A store written before encryption keeps working until a master key is set
+	db, err := bolt.Open(path, 0o600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	s, err := NewBoltStore(path, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.SaveRegistration(&Registration{Domain: "test.auth0.com", ChatID: 42}))
+	updated, err := s.Reencrypt()
+	require.NoError(t, err)
+	assert.Zero(t, updated)
+	require.NoError(t, s.Close())
+
+	s, err = NewBoltStore(path, testEnvelope(t, 1, 1))
+	require.NoError(t, err)
+	updated, err = s.Reencrypt()
+	require.NoError(t, err)
+	assert.Equal(t, 1, updated)
+	require.NoError(t, s.Close())
+
+	// Once encrypted, the store needs its master key
+	_, err = NewBoltStore(path, nil)
+	assert.ErrorIs(t, err, ErrEncryptionKeyRequired)
+}
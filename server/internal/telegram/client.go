@@ -1,24 +1,46 @@
 package telegram
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
 	"github.com/go-resty/resty/v2"
 	"go.uber.org/zap"
+	"sync"
 	"time"
 )
 
 type SendMessageOptions struct {
+	// Type selects the retention of the message, config.MessageTypeCommand when empty
+	Type string
+	// ExpireIn overrides the retention when set
 	ExpireIn time.Duration
+	// DisableNotification delivers the message silently
+	DisableNotification bool
+	// ThreadID sends the message into a forum topic, the General topic when zero
+	ThreadID int64
+}
+
+// APIError is a request rejected by the Telegram API
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram API error: %s", e.Body)
 }
 
 type SendMessageRequest struct {
-	ChatID             int64               `json:"chat_id"`
-	Text               string              `json:"text"`
-	MessageID          int64               `json:"message_id,omitempty"`
-	ParseMode          string              `json:"parse_mode,omitempty"`
-	LinkPreviewOptions *LinkPreviewOptions `json:"link_preview_options,omitempty"`
-	ReplyMarkup        *ReplyMarkup        `json:"reply_markup,omitempty"`
+	ChatID              int64               `json:"chat_id"`
+	Text                string              `json:"text"`
+	MessageID           int64               `json:"message_id,omitempty"`
+	ParseMode           string              `json:"parse_mode,omitempty"`
+	LinkPreviewOptions  *LinkPreviewOptions `json:"link_preview_options,omitempty"`
+	ReplyMarkup         *ReplyMarkup        `json:"reply_markup,omitempty"`
+	DisableNotification bool                `json:"disable_notification,omitempty"`
+	MessageThreadID     int64               `json:"message_thread_id,omitempty"`
 }
 
 type LinkPreviewOptions struct {
@@ -40,42 +62,88 @@ type ReplyMarkup struct {
 }
 
 type InlineKeyboardButton struct {
-	Text         string `json:"text"`
-	URL          string `json:"url,omitempty"`
-	CallbackData string `json:"callback_data,omitempty"`
+	Text         string    `json:"text"`
+	URL          string    `json:"url,omitempty"`
+	LoginURL     *LoginURL `json:"login_url,omitempty"`
+	CallbackData string    `json:"callback_data,omitempty"`
+}
+
+// LoginURL opens a URL with the Telegram login data of the user pressing the button appended.
+// The URL's domain must be linked to the bot with /setdomain in BotFather.
+type LoginURL struct {
+	URL                string `json:"url"`
+	RequestWriteAccess bool   `json:"request_write_access,omitempty"`
+}
+
+type GetUpdatesRequest struct {
+	Offset         int64    `json:"offset,omitempty"`
+	Timeout        int      `json:"timeout"`
+	AllowedUpdates []string `json:"allowed_updates,omitempty"`
+}
+
+type DeleteWebhookRequest struct {
+	DropPendingUpdates bool `json:"drop_pending_updates"`
 }
 
 type Client struct {
 	token  string
 	client *resty.Client
-	logger *zap.Logger
+	// pollClient has no request timeout, long-polling requests are bounded by their context
+	pollClient *resty.Client
+	deletions  *DeletionQueue
+	logger     *zap.Logger
+
+	// username caches the bot's username once getMe succeeded
+	usernameMu sync.Mutex
+	username   string
 }
 
-func NewClient(token string) *Client {
+// apiURL is the Telegram Bot API server
+const apiURL = "https://api.telegram.org"
+
+// NewClient creates a Telegram client. Sent messages are scheduled on deletions, when it is nil
+// messages are kept.
+func NewClient(token string, deletions *DeletionQueue) *Client {
+	return NewClientWithURL(apiURL, token, deletions)
+}
+
+// NewClientWithURL creates a Telegram client for the Bot API server at serverURL, e.g. a local Bot API server
+func NewClientWithURL(serverURL, token string, deletions *DeletionQueue) *Client {
 	logger, _ := zap.NewProduction()
 
 	client := resty.New().
-		SetBaseURL(fmt.Sprintf("https://api.telegram.org/bot%s", token)).
+		SetBaseURL(fmt.Sprintf("%s/bot%s", serverURL, token)).
 		SetTimeout(10 * time.Second).
 		SetRetryCount(3).
 		SetRetryWaitTime(100 * time.Millisecond).
 		SetRetryMaxWaitTime(2000 * time.Millisecond)
 
+	pollClient := resty.New().
+		SetBaseURL(fmt.Sprintf("%s/bot%s", serverURL, token))
+
 	return &Client{
-		token:  token,
-		client: client,
-		logger: logger,
+		token:      token,
+		client:     client,
+		pollClient: pollClient,
+		deletions:  deletions,
+		logger:     logger,
 	}
 }
 
-// postMessage handles both sending and editing a message, sets the expiration time.
+// postMessage handles both sending and editing a message. Sent messages are scheduled for deletion, an edited
+// message keeps the deletion scheduled when it was sent.
 func (c *Client) postMessage(endpoint string, req SendMessageRequest, options ...SendMessageOptions) error {
 	defaultOptions := SendMessageOptions{
-		ExpireIn: 5,
+		Type: config.MessageTypeCommand,
 	}
 	if len(options) > 0 {
 		defaultOptions = options[0]
 	}
+	if defaultOptions.Type == "" {
+		defaultOptions.Type = config.MessageTypeCommand
+	}
+	req.DisableNotification = defaultOptions.DisableNotification
+	req.MessageThreadID = defaultOptions.ThreadID
 
 	resp, err := c.client.R().
 		SetBody(req).
@@ -92,7 +160,7 @@ func (c *Client) postMessage(endpoint string, req SendMessageRequest, options ..
 	// Simplified structure to parse the Telegram API response
 	type TelegramMessageResponse struct {
 		Result struct {
-			MessageID int `json:"message_id"`
+			MessageID int64 `json:"message_id"`
 			Chat      struct {
 				ID int64 `json:"id"`
 			} `json:"chat"`
@@ -105,11 +173,10 @@ func (c *Client) postMessage(endpoint string, req SendMessageRequest, options ..
 		return fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	// Schedule message deletion after the specified expiration time
-	if defaultOptions.ExpireIn > 0 {
-		time.AfterFunc(defaultOptions.ExpireIn*time.Minute, func() {
-			_ = c.DeleteMessage(messageResponse.Result.Chat.ID, messageResponse.Result.MessageID) // Ignoring errors
-		})
+	// Schedule message deletion once its retention expires
+	if c.deletions != nil && endpoint == "sendMessage" {
+		c.deletions.Schedule(messageResponse.Result.Chat.ID, messageResponse.Result.MessageID,
+			defaultOptions.Type, defaultOptions.ExpireIn)
 	}
 
 	return nil
@@ -134,6 +201,25 @@ func (c *Client) SendMessage(chatID int64, text string, markup ...*ReplyMarkup)
 	return c.postMessage("sendMessage", req)
 }
 
+// SendMessageWithOptions sends a message with a message type or expiration. The markup parameter is optional.
+func (c *Client) SendMessageWithOptions(chatID int64, text string, options SendMessageOptions, markup ...*ReplyMarkup) error {
+	req := SendMessageRequest{
+		ChatID: chatID,
+		Text:   text,
+		LinkPreviewOptions: &LinkPreviewOptions{
+			IsDisabled: true,
+		},
+		ParseMode: "HTML",
+	}
+
+	// Add markup if provided
+	if len(markup) > 0 && markup[0] != nil {
+		req.ReplyMarkup = markup[0]
+	}
+
+	return c.postMessage("sendMessage", req, options)
+}
+
 // EditMessageText edits a message sent by us. Can be used to remove keyboards.
 func (c *Client) EditMessageText(chatID int64, messageID int64, text string, markup ...*ReplyMarkup) error {
 	req := SendMessageRequest{
@@ -170,10 +256,359 @@ func (c *Client) DeleteMessage(chatID int64, messageID int) error {
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("telegram API error: %s", string(resp.Body()))
+		return &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
 	}
 
 	c.logger.Debug("Message deleted", zap.Int64("chat_id", chatID), zap.Int("message_id", messageID))
 
 	return nil
 }
+
+// DeleteWebhook removes the webhook, which Telegram requires before updates can be fetched with getUpdates
+func (c *Client) DeleteWebhook(dropPendingUpdates bool) error {
+	resp, err := c.client.R().
+		SetBody(DeleteWebhookRequest{DropPendingUpdates: dropPendingUpdates}).
+		Post("/deleteWebhook")
+
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	return nil
+}
+
+// GetUpdates waits up to timeout for updates with an ID of at least offset. Updates are returned undecoded.
+func (c *Client) GetUpdates(ctx context.Context, offset int64, timeout time.Duration, allowedUpdates []string) ([]json.RawMessage, error) {
+	req := GetUpdatesRequest{
+		Offset:         offset,
+		Timeout:        int(timeout.Seconds()),
+		AllowedUpdates: allowedUpdates,
+	}
+
+	resp, err := c.pollClient.R().
+		SetContext(ctx).
+		SetBody(req).
+		Post("/getUpdates")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get updates: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	var updatesResponse struct {
+		Result []json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &updatesResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return updatesResponse.Result, nil
+}
+
+// PollUpdates removes the webhook and passes every update to handle until ctx is cancelled.
+// Handled updates are confirmed to Telegram through the offset, so they are not delivered again after a restart.
+func (c *Client) PollUpdates(ctx context.Context, timeout time.Duration, allowedUpdates []string, handle func(update json.RawMessage)) error {
+	if err := c.DeleteWebhook(false); err != nil {
+		return err
+	}
+
+	var offset int64
+	for {
+		updates, err := c.GetUpdates(ctx, offset, timeout, allowedUpdates)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			c.logger.Error("Failed to get updates", zap.Error(err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(3 * time.Second):
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			var header struct {
+				UpdateID int64 `json:"update_id"`
+			}
+			if err := json.Unmarshal(update, &header); err != nil {
+				c.logger.Error("Failed to parse update ID", zap.Error(err))
+				continue
+			}
+			offset = header.UpdateID + 1
+			handle(update)
+		}
+	}
+
+	// Confirm the updates handled since the last request
+	if offset > 0 {
+		confirmCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := c.GetUpdates(confirmCtx, offset, 0, allowedUpdates); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type SetWebhookRequest struct {
+	URL            string   `json:"url"`
+	SecretToken    string   `json:"secret_token,omitempty"`
+	AllowedUpdates []string `json:"allowed_updates"`
+	MaxConnections int      `json:"max_connections,omitempty"`
+}
+
+type WebhookInfo struct {
+	URL                string   `json:"url"`
+	PendingUpdateCount int      `json:"pending_update_count"`
+	LastErrorDate      int64    `json:"last_error_date,omitempty"`
+	LastErrorMessage   string   `json:"last_error_message,omitempty"`
+	MaxConnections     int      `json:"max_connections,omitempty"`
+	AllowedUpdates     []string `json:"allowed_updates,omitempty"`
+}
+
+type BotCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+type SetMyCommandsRequest struct {
+	Commands []BotCommand `json:"commands"`
+}
+
+// SetWebhook registers the URL Telegram delivers updates to
+func (c *Client) SetWebhook(req SetWebhookRequest) error {
+	resp, err := c.client.R().
+		SetBody(req).
+		Post("/setWebhook")
+
+	if err != nil {
+		return fmt.Errorf("failed to set webhook: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	return nil
+}
+
+// GetWebhookInfo returns the current webhook registration and its delivery status
+func (c *Client) GetWebhookInfo() (*WebhookInfo, error) {
+	resp, err := c.client.R().
+		Get("/getWebhookInfo")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook info: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	var infoResponse struct {
+		Result WebhookInfo `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &infoResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &infoResponse.Result, nil
+}
+
+// SetMyCommands publishes the command menu shown to users
+func (c *Client) SetMyCommands(commands []BotCommand) error {
+	resp, err := c.client.R().
+		SetBody(SetMyCommandsRequest{Commands: commands}).
+		Post("/setMyCommands")
+
+	if err != nil {
+		return fmt.Errorf("failed to set commands: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	return nil
+}
+
+// GetMyCommands returns the published command menu
+func (c *Client) GetMyCommands() ([]BotCommand, error) {
+	resp, err := c.client.R().
+		Get("/getMyCommands")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get commands: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	var commandsResponse struct {
+		Result []BotCommand `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &commandsResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return commandsResponse.Result, nil
+}
+
+// User is a Telegram user or bot
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username"`
+}
+
+// GetMe returns the bot's own user
+func (c *Client) GetMe() (*User, error) {
+	resp, err := c.client.R().
+		Get("/getMe")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bot user: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("telegram API error: %s", string(resp.Body()))
+	}
+
+	var meResponse struct {
+		Result User `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &meResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &meResponse.Result, nil
+}
+
+// Username returns the bot's username, it is looked up once and then cached
+func (c *Client) Username() (string, error) {
+	c.usernameMu.Lock()
+	defer c.usernameMu.Unlock()
+
+	if c.username != "" {
+		return c.username, nil
+	}
+
+	me, err := c.GetMe()
+	if err != nil {
+		return "", err
+	}
+	c.username = me.Username
+	return c.username, nil
+}
+
+// Chat member statuses returned by getChatMember
+const (
+	ChatMemberCreator       = "creator"
+	ChatMemberAdministrator = "administrator"
+)
+
+// ChatMember is a user's membership in a chat
+type ChatMember struct {
+	Status string `json:"status"`
+	User   User   `json:"user"`
+}
+
+// IsAdmin reports whether the member owns or administers the chat
+func (m *ChatMember) IsAdmin() bool {
+	return m.Status == ChatMemberCreator || m.Status == ChatMemberAdministrator
+}
+
+type GetChatMemberRequest struct {
+	ChatID int64 `json:"chat_id"`
+	UserID int64 `json:"user_id"`
+}
+
+// GetChatMember returns a user's membership in a chat
+func (c *Client) GetChatMember(chatID, userID int64) (*ChatMember, error) {
+	resp, err := c.client.R().
+		SetBody(GetChatMemberRequest{ChatID: chatID, UserID: userID}).
+		Post("/getChatMember")
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chat member: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	var memberResponse struct {
+		Result ChatMember `json:"result"`
+	}
+	if err := json.Unmarshal(resp.Body(), &memberResponse); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	return &memberResponse.Result, nil
+}
+
+type AnswerCallbackQueryRequest struct {
+	CallbackQueryID string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+	ShowAlert       bool   `json:"show_alert,omitempty"`
+}
+
+// AnswerCallbackQuery stops the loading indicator of a pressed button. A non-empty text is shown as a toast,
+// or as an alert the user has to dismiss when alert is set.
+func (c *Client) AnswerCallbackQuery(callbackQueryID, text string, alert bool) error {
+	resp, err := c.client.R().
+		SetBody(AnswerCallbackQueryRequest{
+			CallbackQueryID: callbackQueryID,
+			Text:            text,
+			ShowAlert:       alert,
+		}).
+		Post("/answerCallbackQuery")
+
+	if err != nil {
+		return fmt.Errorf("failed to answer callback query: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	return nil
+}
+
+type EditMessageReplyMarkupRequest struct {
+	ChatID      int64        `json:"chat_id"`
+	MessageID   int64        `json:"message_id"`
+	ReplyMarkup *ReplyMarkup `json:"reply_markup,omitempty"`
+}
+
+// EditMessageReplyMarkup replaces the buttons of a message, a nil markup removes them
+func (c *Client) EditMessageReplyMarkup(chatID, messageID int64, markup *ReplyMarkup) error {
+	resp, err := c.client.R().
+		SetBody(EditMessageReplyMarkupRequest{
+			ChatID:      chatID,
+			MessageID:   messageID,
+			ReplyMarkup: markup,
+		}).
+		Post("/editMessageReplyMarkup")
+
+	if err != nil {
+		return fmt.Errorf("failed to edit reply markup: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return &APIError{StatusCode: resp.StatusCode(), Body: string(resp.Body())}
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package telegram
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestOnlySentMessagesAreScheduledForDeletion(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"ok":true,"result":{"message_id":5,"chat":{"id":42}}}`))
+	}))
+	t.Cleanup(server.Close)
+
+	st := store.NewMemoryStore()
+	queue, err := NewDeletionQueue("token", st, RetentionPolicy{Default: time.Hour}, zap.NewNop())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = queue.Close(context.Background()) })
+	client := NewClientWithURL(server.URL, "token", queue)
+
+	require.NoError(t, client.EditMessageText(42, 5, "edited"))
+	deletions, err := st.ListDeletions()
+	require.NoError(t, err)
+	assert.Empty(t, deletions, "editing a message does not schedule it")
+
+	require.NoError(t, client.SendMessage(42, "sent"))
+	deletions, err = st.ListDeletions()
+	require.NoError(t, err)
+	require.Len(t, deletions, 1)
+	deleteAt := deletions[0].DeleteAt
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, client.EditMessageText(42, 5, "edited"))
+	deletions, err = st.ListDeletions()
+	require.NoError(t, err)
+	require.Len(t, deletions, 1)
+	assert.Equal(t, deleteAt, deletions[0].DeleteAt, "the deletion scheduled at send is kept")
+}
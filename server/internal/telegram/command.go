@@ -0,0 +1,20 @@
+package telegram
+
+import "strings"
+
+// ParseCommand splits a message into its command and arguments. Commands in groups may carry the bot's
+// username, e.g. "/start@OTPusBot", the command is only returned when it is addressed to username.
+// An empty username accepts any suffix.
+func ParseCommand(text, username string) (command string, args string, ok bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", "", false
+	}
+
+	command, args, _ = strings.Cut(text, " ")
+	command, target, addressed := strings.Cut(command, "@")
+	if addressed && username != "" && !strings.EqualFold(target, username) {
+		return "", "", false
+	}
+
+	return command, strings.TrimSpace(args), true
+}
@@ -0,0 +1,35 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		username string
+		command  string
+		args     string
+		ok       bool
+	}{
+		{name: "Plain command", text: "/start", username: "OTPusBot", command: "/start", ok: true},
+		{name: "Addressed to the bot", text: "/start@OTPusBot", username: "OTPusBot", command: "/start", ok: true},
+		{name: "Username is case insensitive", text: "/settings@otpusbot", username: "OTPusBot", command: "/settings", ok: true},
+		{name: "Arguments", text: "/start@OTPusBot  staging ", username: "OTPusBot", command: "/start", args: "staging", ok: true},
+		{name: "Addressed to another bot", text: "/start@OtherBot", username: "OTPusBot", ok: false},
+		{name: "Unknown username", text: "/start@OtherBot", username: "", command: "/start", ok: true},
+		{name: "Not a command", text: "hello /start", username: "OTPusBot", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, args, ok := ParseCommand(tt.text, tt.username)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.command, command)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
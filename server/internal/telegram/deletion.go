@@ -0,0 +1,237 @@
+package telegram
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// deletionMaxAttempts is how often a failing deletion is tried before it is dropped
+	deletionMaxAttempts = 8
+	// deletionRetryDelay is the wait before the first retry, doubled on every further attempt
+	deletionRetryDelay = 30 * time.Second
+)
+
+// RetentionPolicy decides how long sent messages are kept. A chat setting takes precedence over the
+// message type setting, which takes precedence over the default. Zero keeps messages forever.
+type RetentionPolicy struct {
+	Default time.Duration
+	ByType  map[string]time.Duration
+	ByChat  map[int64]time.Duration
+	// ChatRetention returns the retention a chat chose itself, it takes precedence over ByChat
+	ChatRetention func(chatID int64) (time.Duration, bool)
+}
+
+// Retention returns how long a message of the given type is kept in a chat
+func (p RetentionPolicy) Retention(chatID int64, messageType string) time.Duration {
+	if p.ChatRetention != nil {
+		if retention, ok := p.ChatRetention(chatID); ok {
+			return retention
+		}
+	}
+	if retention, ok := p.ByChat[chatID]; ok {
+		return retention
+	}
+	if retention, ok := p.ByType[messageType]; ok {
+		return retention
+	}
+	return p.Default
+}
+
+// DeletionStore persists the pending deletions
+type DeletionStore interface {
+	SaveDeletion(deletion *store.Deletion) error
+	ListDeletions() ([]*store.Deletion, error)
+	DeleteDeletion(chatID, messageID int64) error
+}
+
+// DeletionQueue deletes sent messages once their retention expires. Pending deletions are persisted, so they
+// survive restarts, and a single worker performs them, retrying when Telegram fails.
+type DeletionQueue struct {
+	client *Client
+	store  DeletionStore
+	policy RetentionPolicy
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	pending map[string]*store.Deletion
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewDeletionQueue loads the pending deletions and starts the worker
+func NewDeletionQueue(token string, st DeletionStore, policy RetentionPolicy, logger *zap.Logger) (*DeletionQueue, error) {
+	q := &DeletionQueue{
+		client:  NewClient(token, nil),
+		store:   st,
+		policy:  policy,
+		logger:  logger,
+		pending: make(map[string]*store.Deletion),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	deletions, err := st.ListDeletions()
+	if err != nil {
+		return nil, err
+	}
+	for _, deletion := range deletions {
+		q.pending[deletion.Key()] = deletion
+	}
+	logger.Info("Loaded pending message deletions", zap.Int("count", len(deletions)))
+
+	go q.run()
+	return q, nil
+}
+
+// Schedule deletes a sent message once its retention expires. expireIn overrides the retention policy when set.
+func (q *DeletionQueue) Schedule(chatID, messageID int64, messageType string, expireIn time.Duration) {
+	if expireIn <= 0 {
+		expireIn = q.policy.Retention(chatID, messageType)
+	}
+	if expireIn <= 0 {
+		return
+	}
+
+	deletion := &store.Deletion{
+		ChatID:    chatID,
+		MessageID: messageID,
+		DeleteAt:  time.Now().Add(expireIn).UTC(),
+	}
+
+	// A deletion that cannot be persisted is still performed unless the server restarts
+	if err := q.store.SaveDeletion(deletion); err != nil {
+		q.logger.Error("Failed to persist message deletion",
+			zap.Error(err),
+			zap.Int64("chat_id", chatID),
+			zap.Int64("message_id", messageID))
+	}
+
+	q.mu.Lock()
+	q.pending[deletion.Key()] = deletion
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the worker after deleting the messages that are already due. Later deletions stay persisted
+// for the next start.
+func (q *DeletionQueue) Close(ctx context.Context) error {
+	q.closing.Do(func() { close(q.stop) })
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *DeletionQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.deleteDue()
+
+		select {
+		case <-time.After(q.nextWait()):
+		case <-q.wake:
+		case <-q.stop:
+			q.deleteDue()
+			return
+		}
+	}
+}
+
+// nextWait returns the time until the next deletion is due
+func (q *DeletionQueue) nextWait() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	wait := time.Hour
+	for _, deletion := range q.pending {
+		if until := time.Until(deletion.DeleteAt); until < wait {
+			wait = until
+		}
+	}
+	return max(wait, 0)
+}
+
+// deleteDue performs the deletions that are due, oldest first
+func (q *DeletionQueue) deleteDue() {
+	q.mu.Lock()
+	var due []*store.Deletion
+	now := time.Now()
+	for _, deletion := range q.pending {
+		if !deletion.DeleteAt.After(now) {
+			due = append(due, deletion)
+		}
+	}
+	q.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].DeleteAt.Before(due[j].DeleteAt) })
+	for _, deletion := range due {
+		q.delete(deletion)
+	}
+}
+
+func (q *DeletionQueue) delete(deletion *store.Deletion) {
+	err := q.client.DeleteMessage(deletion.ChatID, int(deletion.MessageID))
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// The message was scheduled again while it was being deleted
+	if q.pending[deletion.Key()] != deletion {
+		return
+	}
+
+	if err != nil && !isPermanentDeleteError(err) && deletion.Attempts+1 < deletionMaxAttempts {
+		deletion.Attempts++
+		deletion.DeleteAt = time.Now().Add(deletionRetryDelay << (deletion.Attempts - 1)).UTC()
+		q.logger.Warn("Failed to delete message, retrying",
+			zap.Error(err),
+			zap.Int64("chat_id", deletion.ChatID),
+			zap.Int64("message_id", deletion.MessageID),
+			zap.Int("attempts", deletion.Attempts),
+			zap.Time("retry_at", deletion.DeleteAt))
+		if err := q.store.SaveDeletion(deletion); err != nil {
+			q.logger.Error("Failed to persist message deletion", zap.Error(err))
+		}
+		return
+	}
+
+	if err != nil {
+		q.logger.Error("Giving up deleting message",
+			zap.Error(err),
+			zap.Int64("chat_id", deletion.ChatID),
+			zap.Int64("message_id", deletion.MessageID))
+	}
+
+	delete(q.pending, deletion.Key())
+	if err := q.store.DeleteDeletion(deletion.ChatID, deletion.MessageID); err != nil {
+		q.logger.Error("Failed to remove message deletion", zap.Error(err))
+	}
+}
+
+// isPermanentDeleteError reports errors retrying cannot fix, such as a message that was already
+// deleted, is too old to delete, or belongs to a chat the bot left
+func isPermanentDeleteError(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.StatusCode == 400 || apiErr.StatusCode == 403
+}
@@ -0,0 +1,64 @@
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	policy := RetentionPolicy{
+		Default: 5 * time.Minute,
+		ByType:  map[string]time.Duration{config.MessageTypeOTP: time.Minute},
+		ByChat:  map[int64]time.Duration{42: 0},
+	}
+
+	assert.Equal(t, 5*time.Minute, policy.Retention(1, config.MessageTypeCommand))
+	assert.Equal(t, time.Minute, policy.Retention(1, config.MessageTypeOTP))
+	assert.Equal(t, time.Duration(0), policy.Retention(42, config.MessageTypeOTP), "chat settings take precedence")
+}
+
+func TestDeletionQueuePersistence(t *testing.T) {
+	st := store.NewMemoryStore()
+	policy := RetentionPolicy{
+		Default: time.Hour,
+		ByChat:  map[int64]time.Duration{7: 0},
+	}
+
+	queue, err := NewDeletionQueue("token", st, policy, zap.NewNop())
+	require.NoError(t, err)
+
+	queue.Schedule(42, 1, config.MessageTypeCommand, 0)
+	queue.Schedule(42, 2, config.MessageTypeOTP, 2*time.Hour)
+	queue.Schedule(7, 3, config.MessageTypeCommand, 0)
+	require.NoError(t, queue.Close(context.Background()))
+
+	// Deletions that are not due yet survive the shutdown, kept messages are not stored
+	deletions, err := st.ListDeletions()
+	require.NoError(t, err)
+	require.Len(t, deletions, 2)
+	assert.Equal(t, int64(1), deletions[0].MessageID)
+	assert.Equal(t, int64(2), deletions[1].MessageID)
+	assert.True(t, deletions[1].DeleteAt.After(deletions[0].DeleteAt))
+
+	// A new queue resumes them
+	queue, err = NewDeletionQueue("token", st, policy, zap.NewNop())
+	require.NoError(t, err)
+	assert.Len(t, queue.pending, 2)
+	require.NoError(t, queue.Close(context.Background()))
+}
+
+func TestIsPermanentDeleteError(t *testing.T) {
+	assert.True(t, isPermanentDeleteError(&APIError{StatusCode: 400, Body: "message to delete not found"}))
+	assert.True(t, isPermanentDeleteError(fmt.Errorf("wrapped: %w", &APIError{StatusCode: 403})))
+	assert.False(t, isPermanentDeleteError(&APIError{StatusCode: 429}))
+	assert.False(t, isPermanentDeleteError(&APIError{StatusCode: 502}))
+	assert.False(t, isPermanentDeleteError(fmt.Errorf("failed to delete message: connection reset")))
+}
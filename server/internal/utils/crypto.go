@@ -4,6 +4,8 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"strings"
 )
 
 // GenerateHMAC creates an HMAC signature for the given data using the provided secret
@@ -13,13 +15,41 @@ func GenerateHMAC(data, secret string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// ValidateHMAC checks if the provided token matches the expected HMAC signature
-func ValidateHMAC(data, token, secret string) bool {
-	expectedMAC := GenerateHMAC(data, secret)
-	return hmac.Equal([]byte(expectedMAC), []byte(token))
+// ValidateHMAC checks if the provided token matches the expected HMAC signature of any of the secrets
+func ValidateHMAC(data, token string, secrets ...string) bool {
+	for _, secret := range secrets {
+		expectedMAC := GenerateHMAC(data, secret)
+		if hmac.Equal([]byte(expectedMAC), []byte(token)) {
+			return true
+		}
+	}
+	return false
 }
 
-// GenerateAuth0DomainToken generates a bearer token for Auth0 domain and Chat Id validation
+// GenerateAuth0DomainToken generates a bearer token for Auth0 domain and Chat Id validation (v1 scheme)
 func GenerateAuth0DomainToken(value, secret string) string {
-	return GenerateHMAC(value, secret)
+	return GenerateHMAC(normalizeDomain(value), secret)
+}
+
+// DeriveWebhookKey derives the per-registration key the Actions use to sign webhook requests (v2 scheme)
+func DeriveWebhookKey(domain, chatID, secret string) string {
+	return GenerateHMAC(fmt.Sprintf("webhook-v2:%s:%s", normalizeDomain(domain), chatID), secret)
+}
+
+// SignWebhookPayload signs a webhook body together with its timestamp and nonce (v2 scheme)
+func SignWebhookPayload(timestamp, nonce string, body []byte, key string) string {
+	return GenerateHMAC(timestamp+"."+nonce+"."+string(body), key)
+}
+
+// ValidateWebhookSignature checks a v2 webhook signature
+func ValidateWebhookSignature(timestamp, nonce string, body []byte, signature, key string) bool {
+	expectedMAC := SignWebhookPayload(timestamp, nonce, body, key)
+	return hmac.Equal([]byte(expectedMAC), []byte(signature))
+}
+
+// normalizeDomain strips the scheme and trailing slash users often paste along with the domain
+func normalizeDomain(domain string) string {
+	domain = strings.TrimPrefix(domain, "https://")
+	domain = strings.TrimPrefix(domain, "http://")
+	return strings.TrimSuffix(domain, "/")
 }
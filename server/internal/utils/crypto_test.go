@@ -78,3 +78,18 @@ func TestGenerateAuth0DomainToken(t *testing.T) {
 		})
 	}
 }
+
+func TestWebhookSignature(t *testing.T) {
+	key := DeriveWebhookKey("test.auth0.com", "42", "test-secret")
+	body := []byte(`{"code":"123456"}`)
+	signature := SignWebhookPayload("1700000000", "nonce", body, key)
+
+	assert.True(t, ValidateWebhookSignature("1700000000", "nonce", body, signature, key))
+	assert.False(t, ValidateWebhookSignature("1700000001", "nonce", body, signature, key))
+	assert.False(t, ValidateWebhookSignature("1700000000", "other", body, signature, key))
+	assert.False(t, ValidateWebhookSignature("1700000000", "nonce", []byte(`{"code":"654321"}`), signature, key))
+
+	// Keys are bound to the registration
+	assert.NotEqual(t, key, DeriveWebhookKey("test.auth0.com", "43", "test-secret"))
+	assert.Equal(t, key, DeriveWebhookKey("https://test.auth0.com/", "42", "test-secret"))
+}
@@ -0,0 +1,253 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// EncryptionKeySize is the size of the AES-256 keys used to encrypt stored records
+const EncryptionKeySize = 32
+
+// Sizes of the standard AES-GCM nonce and authentication tag
+const (
+	gcmNonceSize = 12
+	gcmTagSize   = 16
+)
+
+// ParseEncryptionKey decodes a base64 or hex encoded AES-256 key
+func ParseEncryptionKey(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	for _, decode := range []func(string) ([]byte, error){
+		hex.DecodeString,
+		base64.StdEncoding.DecodeString,
+		base64.RawStdEncoding.DecodeString,
+		base64.URLEncoding.DecodeString,
+	} {
+		if key, err := decode(value); err == nil && len(key) == EncryptionKeySize {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("expected a base64 or hex encoded %d-byte key", EncryptionKeySize)
+}
+
+// Encrypt seals plaintext with AES-256-GCM, returning the random nonce followed by the ciphertext.
+// additionalData is authenticated but not encrypted, binding the ciphertext to the record it belongs to.
+func Encrypt(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt with the same key and additional data
+func Decrypt(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", EncryptionKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelopeFormat starts every sealed record. Records written before encryption are JSON and start with "{".
+const envelopeFormat byte = 0xe1
+
+// envelopeHeaderSize is the format byte followed by the big-endian version of the master key
+const envelopeHeaderSize = 5
+
+// MasterKey is a versioned key of the envelope encryption
+type MasterKey struct {
+	Version uint32
+	Key     []byte
+}
+
+// Envelope seals records with envelope encryption: each record is encrypted with its own random data key,
+// and the data key is encrypted (wrapped) with a master key. The version of that master key is kept with the
+// record, so after a rotation old records stay readable and only their data keys need to be wrapped again.
+type Envelope struct {
+	keys   map[uint32][]byte
+	active uint32
+}
+
+// NewEnvelope creates an envelope sealing new records with the key activeVersion. The other keys are only
+// used to open records sealed before a rotation.
+func NewEnvelope(keys []MasterKey, activeVersion uint32) (*Envelope, error) {
+	e := &Envelope{keys: make(map[uint32][]byte), active: activeVersion}
+	for _, key := range keys {
+		if len(key.Key) != EncryptionKeySize {
+			return nil, fmt.Errorf("master key %d must be %d bytes, got %d", key.Version, EncryptionKeySize, len(key.Key))
+		}
+		if _, ok := e.keys[key.Version]; ok {
+			return nil, fmt.Errorf("duplicate master key version %d", key.Version)
+		}
+		e.keys[key.Version] = key.Key
+	}
+
+	if _, ok := e.keys[activeVersion]; !ok {
+		return nil, fmt.Errorf("active master key version %d not found", activeVersion)
+	}
+	return e, nil
+}
+
+// ParseMasterKeys parses a comma separated list of version:key pairs, the keys base64 or hex encoded
+func ParseMasterKeys(spec string) ([]MasterKey, error) {
+	var keys []MasterKey
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		versionStr, keyStr, found := strings.Cut(pair, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid master key %q, expected version:key", versionStr)
+		}
+		version, err := strconv.ParseUint(versionStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key version %q", versionStr)
+		}
+		key, err := ParseEncryptionKey(keyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %d: %w", version, err)
+		}
+		keys = append(keys, MasterKey{Version: uint32(version), Key: key})
+	}
+	return keys, nil
+}
+
+// ActiveVersion returns the version of the master key new records are sealed with
+func (e *Envelope) ActiveVersion() uint32 {
+	return e.active
+}
+
+// IsSealed reports whether data was produced by Envelope.Seal
+func IsSealed(data []byte) bool {
+	return len(data) > envelopeHeaderSize && data[0] == envelopeFormat
+}
+
+// KeyVersion returns the version of the master key a sealed record was sealed with
+func KeyVersion(sealed []byte) (uint32, error) {
+	if !IsSealed(sealed) {
+		return 0, errors.New("data is not sealed")
+	}
+	return binary.BigEndian.Uint32(sealed[1:envelopeHeaderSize]), nil
+}
+
+// Seal encrypts plaintext under a new data key wrapped with the active master key. additionalData binds
+// the record to where it is stored, opening it with other additional data fails.
+func (e *Envelope) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	dataKey := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	payload, err := Encrypt(dataKey, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return e.wrap(dataKey, payload, additionalData)
+}
+
+// Open decrypts a record produced by Seal with the same additional data
+func (e *Envelope) Open(sealed, additionalData []byte) ([]byte, error) {
+	dataKey, payload, err := e.unwrap(sealed, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(dataKey, payload, additionalData)
+}
+
+// Rewrap wraps the data key of a sealed record with the active master key. The encrypted payload is kept
+// as it is. Records already sealed with the active key are returned unchanged.
+func (e *Envelope) Rewrap(sealed, additionalData []byte) ([]byte, error) {
+	if version, err := KeyVersion(sealed); err == nil && version == e.active {
+		return sealed, nil
+	}
+
+	dataKey, payload, err := e.unwrap(sealed, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return e.wrap(dataKey, payload, additionalData)
+}
+
+// wrap lays out a sealed record: the header, the wrapped data key and the payload. The header is
+// authenticated along with the data key, so the recorded version cannot be altered.
+func (e *Envelope) wrap(dataKey, payload, additionalData []byte) ([]byte, error) {
+	header := make([]byte, envelopeHeaderSize)
+	header[0] = envelopeFormat
+	binary.BigEndian.PutUint32(header[1:], e.active)
+
+	wrapped, err := Encrypt(e.keys[e.active], dataKey, append(slices.Clone(header), additionalData...))
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := make([]byte, 0, len(header)+len(wrapped)+len(payload))
+	sealed = append(sealed, header...)
+	sealed = append(sealed, wrapped...)
+	return append(sealed, payload...), nil
+}
+
+func (e *Envelope) unwrap(sealed, additionalData []byte) (dataKey, payload []byte, err error) {
+	version, err := KeyVersion(sealed)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := e.keys[version]
+	if !ok {
+		return nil, nil, fmt.Errorf("sealed with unknown master key version %d", version)
+	}
+
+	wrappedSize := wrappedKeySize()
+	if len(sealed) < envelopeHeaderSize+wrappedSize {
+		return nil, nil, errors.New("sealed data too short")
+	}
+	header := sealed[:envelopeHeaderSize]
+	wrapped := sealed[envelopeHeaderSize : envelopeHeaderSize+wrappedSize]
+
+	dataKey, err = Decrypt(key, wrapped, append(slices.Clone(header), additionalData...))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, sealed[envelopeHeaderSize+wrappedSize:], nil
+}
+
+// wrappedKeySize is the size of a data key encrypted by Encrypt: nonce, key and authentication tag
+func wrappedKeySize() int {
+	return gcmNonceSize + EncryptionKeySize + gcmTagSize
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, EncryptionKeySize)
+
+	ciphertext, err := Encrypt(key, []byte("client-secret"), []byte("test.auth0.com"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(ciphertext), "client-secret")
+
+	plaintext, err := Decrypt(key, ciphertext, []byte("test.auth0.com"))
+	require.NoError(t, err)
+	assert.Equal(t, "client-secret", string(plaintext))
+
+	// The ciphertext is bound to its additional data and key
+	_, err = Decrypt(key, ciphertext, []byte("other.auth0.com"))
+	assert.Error(t, err)
+	_, err = Decrypt(bytes.Repeat([]byte{8}, EncryptionKeySize), ciphertext, []byte("test.auth0.com"))
+	assert.Error(t, err)
+
+	// Every encryption uses a new nonce
+	again, err := Encrypt(key, []byte("client-secret"), []byte("test.auth0.com"))
+	require.NoError(t, err)
+	assert.NotEqual(t, ciphertext, again)
+}
+
+func TestEncryptRejectsInvalidKeys(t *testing.T) {
+	_, err := Encrypt([]byte("short"), []byte("secret"), nil)
+	assert.Error(t, err)
+	_, err = Decrypt(bytes.Repeat([]byte{7}, EncryptionKeySize), []byte("short"), nil)
+	assert.Error(t, err)
+}
+
+func TestParseEncryptionKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, EncryptionKeySize)
+
+	for _, encoded := range []string{
+		hex.EncodeToString(key),
+		base64.StdEncoding.EncodeToString(key),
+		base64.URLEncoding.EncodeToString(key) + "\n",
+	} {
+		parsed, err := ParseEncryptionKey(encoded)
+		require.NoError(t, err, encoded)
+		assert.Equal(t, key, parsed)
+	}
+
+	_, err := ParseEncryptionKey(base64.StdEncoding.EncodeToString(key[:16]))
+	assert.Error(t, err)
+}
+
+func testEnvelope(t *testing.T, active uint32, versions ...uint32) *Envelope {
+	var keys []MasterKey
+	for _, version := range versions {
+		keys = append(keys, MasterKey{Version: version, Key: bytes.Repeat([]byte{byte(version)}, EncryptionKeySize)})
+	}
+	envelope, err := NewEnvelope(keys, active)
+	require.NoError(t, err)
+	return envelope
+}
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	envelope := testEnvelope(t, 1, 1)
+
+	sealed, err := envelope.Seal([]byte(`{"client_secret":"s3cr3t"}`), []byte("credentials/test.auth0.com"))
+	require.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, string(sealed), "s3cr3t")
+
+	version, err := KeyVersion(sealed)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), version)
+
+	plaintext, err := envelope.Open(sealed, []byte("credentials/test.auth0.com"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"client_secret":"s3cr3t"}`, string(plaintext))
+
+	// Records cannot be moved to another key
+	_, err = envelope.Open(sealed, []byte("credentials/other.auth0.com"))
+	assert.Error(t, err)
+
+	// Nor can the recorded key version be altered
+	tampered := bytes.Clone(sealed)
+	tampered[4] = 2
+	_, err = testEnvelope(t, 1, 1, 2).Open(tampered, []byte("credentials/test.auth0.com"))
+	assert.Error(t, err)
+
+	assert.False(t, IsSealed([]byte(`{"domain":"test.auth0.com"}`)))
+}
+
+func TestEnvelopeRewrap(t *testing.T) {
+	aad := []byte("snapshots/test.auth0.com")
+	sealed, err := testEnvelope(t, 1, 1).Seal([]byte("snapshot"), aad)
+	require.NoError(t, err)
+
+	// After the rotation, records sealed with the previous key are still readable
+	rotated := testEnvelope(t, 2, 1, 2)
+	plaintext, err := rotated.Open(sealed, aad)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot", string(plaintext))
+
+	rewrapped, err := rotated.Rewrap(sealed, aad)
+	require.NoError(t, err)
+	version, err := KeyVersion(rewrapped)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(2), version)
+	// Only the data key was wrapped again, the payload is unchanged
+	assert.Equal(t, sealed[len(sealed)-len("snapshot")-gcmNonceSize-gcmTagSize:],
+		rewrapped[len(rewrapped)-len("snapshot")-gcmNonceSize-gcmTagSize:])
+
+	again, err := rotated.Rewrap(rewrapped, aad)
+	require.NoError(t, err)
+	assert.Equal(t, rewrapped, again)
+
+	// Once the previous key is dropped, only the rewrapped record can be opened
+	current := testEnvelope(t, 2, 2)
+	_, err = current.Open(sealed, aad)
+	assert.ErrorContains(t, err, "unknown master key version 1")
+	plaintext, err = current.Open(rewrapped, aad)
+	require.NoError(t, err)
+	assert.Equal(t, "snapshot", string(plaintext))
+}
+
+func TestNewEnvelopeValidatesKeys(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, EncryptionKeySize)
+
+	_, err := NewEnvelope([]MasterKey{{Version: 1, Key: key}}, 2)
+	assert.Error(t, err)
+	_, err = NewEnvelope([]MasterKey{{Version: 1, Key: key}, {Version: 1, Key: key}}, 1)
+	assert.Error(t, err)
+	_, err = NewEnvelope([]MasterKey{{Version: 1, Key: key[:16]}}, 1)
+	assert.Error(t, err)
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, EncryptionKeySize)
+
+	keys, err := ParseMasterKeys("1:" + hex.EncodeToString(key) + ", 2:" + base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, err)
+	assert.Equal(t, []MasterKey{{Version: 1, Key: key}, {Version: 2, Key: key}}, keys)
+
+	for _, spec := range []string{"1", "x:" + hex.EncodeToString(key), "1:short"} {
+		_, err := ParseMasterKeys(spec)
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HMACKey is a secret of the HMAC keyring
+type HMACKey struct {
+	ID      string
+	Secret  string
+	Retired bool
+}
+
+// Keyring holds the HMAC secrets. New signatures use the active key, while signatures made with any
+// non-retired key are still accepted, so rotating the active key does not break existing links and Actions.
+type Keyring struct {
+	keys   []HMACKey
+	active HMACKey
+}
+
+// NewKeyring creates a keyring signing with the key activeID
+func NewKeyring(keys []HMACKey, activeID string) (*Keyring, error) {
+	k := &Keyring{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" || key.Secret == "" {
+			return nil, fmt.Errorf("HMAC keys need an ID and a secret")
+		}
+		if seen[key.ID] {
+			return nil, fmt.Errorf("duplicate HMAC key ID %q", key.ID)
+		}
+		seen[key.ID] = true
+		k.keys = append(k.keys, key)
+
+		if key.ID == activeID {
+			k.active = key
+		}
+	}
+
+	if k.active.ID == "" {
+		return nil, fmt.Errorf("active HMAC key %q not found", activeID)
+	}
+	if k.active.Retired {
+		return nil, fmt.Errorf("active HMAC key %q is retired", activeID)
+	}
+	return k, nil
+}
+
+// ParseHMACKeys parses a comma separated list of id:secret pairs
+func ParseHMACKeys(spec string) ([]HMACKey, error) {
+	var keys []HMACKey
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(pair, ":")
+		if !found || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid HMAC key %q, expected id:secret", id)
+		}
+		keys = append(keys, HMACKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+// Active returns the key used for new signatures
+func (k *Keyring) Active() HMACKey {
+	return k.active
+}
+
+// Key returns the non-retired key with the given ID
+func (k *Keyring) Key(id string) (HMACKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == id && !key.Retired {
+			return key, true
+		}
+	}
+	return HMACKey{}, false
+}
+
+// Secrets returns the secrets accepted for verification, the active one first
+func (k *Keyring) Secrets() []string {
+	secrets := []string{k.active.Secret}
+	for _, key := range k.keys {
+		if key.ID != k.active.ID && !key.Retired {
+			secrets = append(secrets, key.Secret)
+		}
+	}
+	return secrets
+}
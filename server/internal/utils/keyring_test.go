@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	keys := []HMACKey{
+		{ID: "old", Secret: "old-secret", Retired: true},
+		{ID: "current", Secret: "current-secret"},
+		{ID: "next", Secret: "next-secret"},
+	}
+
+	keyring, err := NewKeyring(keys, "next")
+	require.NoError(t, err)
+
+	assert.Equal(t, "next", keyring.Active().ID)
+	assert.Equal(t, []string{"next-secret", "current-secret"}, keyring.Secrets())
+
+	_, ok := keyring.Key("current")
+	assert.True(t, ok)
+	_, ok = keyring.Key("old")
+	assert.False(t, ok, "retired keys are not accepted")
+
+	// Signatures of the previous key stay valid until it is retired
+	token := GenerateHMAC("data", "current-secret")
+	assert.True(t, ValidateHMAC("data", token, keyring.Secrets()...))
+	assert.False(t, ValidateHMAC("data", GenerateHMAC("data", "old-secret"), keyring.Secrets()...))
+}
+
+func TestNewKeyringErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []HMACKey
+		activeID string
+	}{
+		{
+			name:     "Unknown active key",
+			keys:     []HMACKey{{ID: "a", Secret: "s"}},
+			activeID: "b",
+		},
+		{
+			name:     "Retired active key",
+			keys:     []HMACKey{{ID: "a", Secret: "s", Retired: true}},
+			activeID: "a",
+		},
+		{
+			name:     "Duplicate ID",
+			keys:     []HMACKey{{ID: "a", Secret: "s"}, {ID: "a", Secret: "t"}},
+			activeID: "a",
+		},
+		{
+			name:     "Empty secret",
+			keys:     []HMACKey{{ID: "a"}},
+			activeID: "a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyring(tt.keys, tt.activeID)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseHMACKeys(t *testing.T) {
+	keys, err := ParseHMACKeys("k1:secret-1, k2:secret:with:colons,")
+	require.NoError(t, err)
+	assert.Equal(t, []HMACKey{
+		{ID: "k1", Secret: "secret-1"},
+		{ID: "k2", Secret: "secret:with:colons"},
+	}, keys)
+
+	keys, err = ParseHMACKeys("")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	_, err = ParseHMACKeys("missing-secret")
+	assert.Error(t, err)
+}
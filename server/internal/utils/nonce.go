@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNonceUsed is returned for a nonce that was already used within the cache ttl
+	ErrNonceUsed = errors.New("nonce already used")
+	// ErrNonceCacheFull is returned when the cache holds maxSize nonces that have not expired yet
+	ErrNonceCacheFull = errors.New("nonce cache is full")
+)
+
+type nonceEntry struct {
+	nonce     string
+	expiresAt time.Time
+}
+
+// NonceCache remembers recently used nonces to reject replayed requests. It holds at most maxSize
+// nonces; since every nonce lives for the same ttl, the oldest one is always the first to expire.
+// Nonces are never dropped before they expire, a full cache refuses new ones instead.
+type NonceCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	seen    map[string]time.Time
+	order   []nonceEntry
+}
+
+// NewNonceCache creates a cache keeping nonces for ttl, bounded to maxSize entries
+func NewNonceCache(ttl time.Duration, maxSize int) *NonceCache {
+	return &NonceCache{
+		ttl:     ttl,
+		maxSize: maxSize,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Use records a nonce. It returns ErrNonceUsed for a nonce already used within ttl, and ErrNonceCacheFull
+// when maxSize nonces are still live, so a flood of requests cannot evict a nonce and allow its replay.
+func (c *NonceCache) Use(nonce string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	// Drop expired nonces
+	for len(c.order) > 0 && now.After(c.order[0].expiresAt) {
+		delete(c.seen, c.order[0].nonce)
+		c.order = c.order[1:]
+	}
+
+	if expiresAt, ok := c.seen[nonce]; ok && now.Before(expiresAt) {
+		return ErrNonceUsed
+	}
+	if len(c.order) >= c.maxSize {
+		return ErrNonceCacheFull
+	}
+
+	expiresAt := now.Add(c.ttl)
+	c.seen[nonce] = expiresAt
+	c.order = append(c.order, nonceEntry{nonce: nonce, expiresAt: expiresAt})
+	return nil
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNonceCache(t *testing.T) {
+	cache := NewNonceCache(time.Minute, 2)
+
+	assert.NoError(t, cache.Use("a"))
+	assert.ErrorIs(t, cache.Use("a"), ErrNonceUsed)
+	assert.NoError(t, cache.Use("b"))
+}
+
+func TestNonceCacheFullOfLiveNoncesRejectsNewOnes(t *testing.T) {
+	cache := NewNonceCache(time.Minute, 2)
+
+	assert.NoError(t, cache.Use("a"))
+	assert.NoError(t, cache.Use("b"))
+
+	// Filling the cache must not evict "a", so it still cannot be replayed
+	assert.ErrorIs(t, cache.Use("c"), ErrNonceCacheFull)
+	assert.ErrorIs(t, cache.Use("a"), ErrNonceUsed)
+}
+
+func TestNonceCacheExpiry(t *testing.T) {
+	cache := NewNonceCache(time.Millisecond, 1)
+
+	assert.NoError(t, cache.Use("a"))
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, cache.Use("a"))
+	assert.ErrorIs(t, cache.Use("b"), ErrNonceCacheFull)
+}
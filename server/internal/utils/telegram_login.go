@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// telegramLoginFields are the fields Telegram appends to login URLs, besides the hash
+var telegramLoginFields = []string{"id", "first_name", "last_name", "username", "photo_url", "auth_date"}
+
+// ValidateTelegramLogin checks the login data Telegram appends to a login URL and returns the user ID.
+// Other query parameters are ignored, logins older than maxAge are rejected.
+func ValidateTelegramLogin(query url.Values, botToken string, maxAge time.Duration) (int64, error) {
+	hash := query.Get("hash")
+	if hash == "" {
+		return 0, errors.New("missing Telegram login data")
+	}
+
+	var fields []string
+	for _, field := range telegramLoginFields {
+		if query.Has(field) {
+			fields = append(fields, field+"="+query.Get(field))
+		}
+	}
+	sort.Strings(fields)
+
+	secret := sha256.Sum256([]byte(botToken))
+	h := hmac.New(sha256.New, secret[:])
+	h.Write([]byte(strings.Join(fields, "\n")))
+	if !hmac.Equal([]byte(hex.EncodeToString(h.Sum(nil))), []byte(hash)) {
+		return 0, errors.New("invalid Telegram login hash")
+	}
+
+	authDate, err := strconv.ParseInt(query.Get("auth_date"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid auth_date: %w", err)
+	}
+	if time.Since(time.Unix(authDate, 0)) > maxAge {
+		return 0, errors.New("telegram login expired")
+	}
+
+	userID, err := strconv.ParseInt(query.Get("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid user ID: %w", err)
+	}
+	return userID, nil
+}
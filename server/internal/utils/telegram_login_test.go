@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signTelegramLogin(dataCheckString, botToken string) string {
+	secret := sha256.Sum256([]byte(botToken))
+	h := hmac.New(sha256.New, secret[:])
+	h.Write([]byte(dataCheckString))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestValidateTelegramLogin(t *testing.T) {
+	botToken := "123456:bot-token"
+	authDate := strconv.FormatInt(time.Now().Unix(), 10)
+
+	query := url.Values{}
+	query.Set("chat_id", "-1001")
+	query.Set("signature", "link-signature")
+	query.Set("id", "42")
+	query.Set("first_name", "Ada")
+	query.Set("username", "ada")
+	query.Set("auth_date", authDate)
+	query.Set("hash", signTelegramLogin("auth_date="+authDate+"\nfirst_name=Ada\nid=42\nusername=ada", botToken))
+
+	userID, err := ValidateTelegramLogin(query, botToken, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), userID)
+
+	_, err = ValidateTelegramLogin(query, "other-token", time.Minute)
+	assert.Error(t, err, "signed by another bot")
+
+	tampered := url.Values{}
+	for key, values := range query {
+		tampered[key] = values
+	}
+	tampered.Set("id", "43")
+	_, err = ValidateTelegramLogin(tampered, botToken, time.Minute)
+	assert.Error(t, err, "tampered user ID")
+
+	_, err = ValidateTelegramLogin(url.Values{"id": {"42"}}, botToken, time.Minute)
+	assert.Error(t, err, "missing hash")
+
+	oldDate := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	expired := url.Values{}
+	expired.Set("id", "42")
+	expired.Set("auth_date", oldDate)
+	expired.Set("hash", signTelegramLogin("auth_date="+oldDate+"\nid=42", botToken))
+	_, err = ValidateTelegramLogin(expired, botToken, time.Minute)
+	assert.Error(t, err, "expired login")
+}
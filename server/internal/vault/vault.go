@@ -0,0 +1,166 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+)
+
+// tokenRenewMargin is how long before it expires a cached token is renewed, so a token handed out
+// is not about to expire during the operation using it
+const tokenRenewMargin = 5 * time.Minute
+
+var (
+	// ErrDisabled is returned when storing credentials is not enabled
+	ErrDisabled = errors.New("credential vault is disabled")
+	// ErrNoCredentials is returned for tenants whose credentials were not stored
+	ErrNoCredentials = errors.New("no stored credentials for tenant")
+)
+
+// tokenClient requests Management API tokens, implemented by *auth0.Auth0Client
+type tokenClient interface {
+	GetClientCredentialsToken(ctx context.Context, domain, clientID, clientSecret string) (*auth0.TokenResponse, error)
+}
+
+// Vault keeps the client credentials users agreed to store and hands out Management API tokens obtained
+// with them, so maintenance can run without the user entering the credentials again. The credentials are
+// encrypted at rest by the store like every other record.
+type Vault struct {
+	store   store.Store
+	enabled bool
+	client  tokenClient
+	now     func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken // Keyed by domain
+}
+
+type cachedToken struct {
+	mu          sync.Mutex // Held while renewing, so concurrent callers share one token request
+	clientID    string
+	accessToken string
+	expiresAt   time.Time
+}
+
+// New creates a vault. A disabled vault stores no credentials.
+func New(st store.Store, enabled bool, client *auth0.Auth0Client) *Vault {
+	return &Vault{
+		store:   st,
+		enabled: enabled,
+		client:  client,
+		now:     time.Now,
+		tokens:  make(map[string]*cachedToken),
+	}
+}
+
+// Enabled reports whether credentials can be stored
+func (v *Vault) Enabled() bool {
+	return v != nil && v.enabled
+}
+
+// Save stores the credentials of a tenant, replacing those stored before.
+// userID is the Telegram user who consented to storing them.
+func (v *Vault) Save(domain, clientID, clientSecret string, userID int64) error {
+	if !v.Enabled() {
+		return ErrDisabled
+	}
+
+	err := v.store.SaveCredential(&store.Credential{
+		Domain:       domain,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		ConsentedBy:  userID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save credential: %w", err)
+	}
+
+	v.dropToken(domain)
+	return nil
+}
+
+// Has reports whether credentials are stored for a tenant
+func (v *Vault) Has(domain string) bool {
+	if !v.Enabled() {
+		return false
+	}
+	_, err := v.store.GetCredential(domain)
+	return err == nil
+}
+
+// Forget deletes the stored credentials of a tenant and its cached token
+func (v *Vault) Forget(domain string) error {
+	v.dropToken(domain)
+	if err := v.store.DeleteCredential(domain); err != nil {
+		return fmt.Errorf("failed to delete credential: %w", err)
+	}
+	return nil
+}
+
+// Token returns a Management API token for a tenant with stored credentials. The token is cached and
+// renewed once it is within tokenRenewMargin of expiring.
+func (v *Vault) Token(ctx context.Context, domain string) (string, error) {
+	if !v.Enabled() {
+		return "", ErrDisabled
+	}
+
+	// The stored credential is authoritative, a tenant forgotten through the store loses its token
+	credential, err := v.store.GetCredential(domain)
+	if errors.Is(err, store.ErrNotFound) {
+		v.dropToken(domain)
+		return "", ErrNoCredentials
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read credential: %w", err)
+	}
+
+	token := v.cachedToken(domain)
+	token.mu.Lock()
+	defer token.mu.Unlock()
+
+	if token.clientID == credential.ClientID && v.now().Before(token.expiresAt.Add(-tokenRenewMargin)) {
+		return token.accessToken, nil
+	}
+
+	response, err := v.client.GetClientCredentialsToken(ctx, domain, credential.ClientID, credential.ClientSecret)
+	if err != nil {
+		return "", err
+	}
+
+	token.clientID = credential.ClientID
+	token.accessToken = response.AccessToken
+	token.expiresAt = v.now().Add(time.Duration(response.ExpiresIn) * time.Second)
+	return token.accessToken, nil
+}
+
+// Invalidate drops the cached token of a tenant, e.g. after Auth0 rejected it, so the next call renews it
+func (v *Vault) Invalidate(domain string) {
+	v.dropToken(domain)
+}
+
+func (v *Vault) cachedToken(domain string) *cachedToken {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	token, ok := v.tokens[domain]
+	if !ok {
+		token = &cachedToken{}
+		v.tokens[domain] = token
+	}
+	return token
+}
+
+func (v *Vault) dropToken(domain string) {
+	if v == nil {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.tokens, domain)
+}
@@ -0,0 +1,103 @@
+package vault
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTokenClient struct {
+	calls   int
+	secrets []string
+}
+
+func (f *fakeTokenClient) GetClientCredentialsToken(_ context.Context, _, _,
+	clientSecret string) (*auth0.TokenResponse, error) {
+	f.calls++
+	f.secrets = append(f.secrets, clientSecret)
+	return &auth0.TokenResponse{AccessToken: fmt.Sprintf("token-%d", f.calls), ExpiresIn: 3600}, nil
+}
+
+func testVault(t *testing.T) (*Vault, *fakeTokenClient, *time.Time) {
+	client := &fakeTokenClient{}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	v := New(store.NewMemoryStore(), true, nil)
+	v.client = client
+	v.now = func() time.Time { return now }
+	return v, client, &now
+}
+
+func TestSaveStoresTheCredential(t *testing.T) {
+	v, _, _ := testVault(t)
+
+	require.NoError(t, v.Save("test.auth0.com", "client", "s3cr3t", 42))
+	assert.True(t, v.Has("test.auth0.com"))
+
+	credential, err := v.store.GetCredential("test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "client", credential.ClientID)
+	assert.Equal(t, int64(42), credential.ConsentedBy)
+	assert.Equal(t, "s3cr3t", credential.ClientSecret)
+}
+
+func TestTokenIsCachedUntilShortlyBeforeExpiry(t *testing.T) {
+	v, client, now := testVault(t)
+	ctx := context.Background()
+	require.NoError(t, v.Save("test.auth0.com", "client", "s3cr3t", 42))
+
+	token, err := v.Token(ctx, "test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+	assert.Equal(t, []string{"s3cr3t"}, client.secrets)
+
+	*now = now.Add(time.Hour - tokenRenewMargin - time.Second)
+	token, err = v.Token(ctx, "test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	*now = now.Add(time.Second)
+	token, err = v.Token(ctx, "test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+
+	v.Invalidate("test.auth0.com")
+	token, err = v.Token(ctx, "test.auth0.com")
+	require.NoError(t, err)
+	assert.Equal(t, "token-3", token)
+}
+
+func TestTokenWithoutCredentials(t *testing.T) {
+	v, client, _ := testVault(t)
+	ctx := context.Background()
+
+	_, err := v.Token(ctx, "test.auth0.com")
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	require.NoError(t, v.Save("test.auth0.com", "client", "s3cr3t", 42))
+	_, err = v.Token(ctx, "test.auth0.com")
+	require.NoError(t, err)
+
+	// Forgetting the credentials also drops the cached token
+	require.NoError(t, v.Forget("test.auth0.com"))
+	assert.False(t, v.Has("test.auth0.com"))
+	_, err = v.Token(ctx, "test.auth0.com")
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestDisabledVault(t *testing.T) {
+	v := New(store.NewMemoryStore(), false, nil)
+
+	assert.False(t, v.Enabled())
+	assert.ErrorIs(t, v.Save("test.auth0.com", "client", "s3cr3t", 42), ErrDisabled)
+	assert.False(t, v.Has("test.auth0.com"))
+	_, err := v.Token(context.Background(), "test.auth0.com")
+	assert.ErrorIs(t, err, ErrDisabled)
+}
@@ -6,14 +6,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
+	"github.com/ambravo/a0-OTPus-prime/server/internal/api/handlers"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/api/routes"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/auth0"
 	"github.com/ambravo/a0-OTPus-prime/server/internal/config"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/otp"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/store"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/telegram"
+	"github.com/ambravo/a0-OTPus-prime/server/internal/vault"
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -37,6 +45,48 @@ func main() {
 		logger.Fatal("Failed to load configuration", zap.Error(err))
 	}
 
+	// Open the registration store, its records are encrypted with the master key
+	st, err := store.NewBoltStore(cfg.StorePath, cfg.Encryption)
+	if errors.Is(err, store.ErrEncryptionKeyRequired) {
+		logger.Fatal("Set ENCRYPTION_KEY to a 32-byte key encoded in base64 or hex, generated with "+
+			"`openssl rand -base64 32`, or ENCRYPTION_KEY_FILE to the path of a file holding it",
+			zap.Error(err), zap.String("path", cfg.StorePath))
+	}
+	if err != nil {
+		logger.Fatal("Failed to open store", zap.Error(err), zap.String("path", cfg.StorePath))
+	}
+	defer st.Close()
+	if cfg.Encryption == nil {
+		logger.Warn("No ENCRYPTION_KEY set, the store written before encryption is used in plaintext. " +
+			"Set ENCRYPTION_KEY to encrypt it on the next start")
+	}
+
+	// Seal records written before encryption and move those of a rotated master key to the current one
+	reencrypted, err := st.Reencrypt()
+	if err != nil {
+		logger.Fatal("Failed to re-encrypt the store", zap.Error(err))
+	}
+	if reencrypted > 0 {
+		logger.Info("Store re-encrypted",
+			zap.Int("records", reencrypted),
+			zap.Uint32("key_version", cfg.Encryption.ActiveVersion()))
+	}
+
+	// Start the message deletion worker, it resumes the deletions pending from previous runs
+	deletions, err := telegram.NewDeletionQueue(cfg.TelegramToken, st, telegram.RetentionPolicy{
+		Default: cfg.MessageRetention,
+		ByType:  cfg.MessageRetentionByType,
+		ByChat:  cfg.MessageRetentionByChat,
+		// Chats can choose their own retention with /settings
+		ChatRetention: handlers.ChatRetention(st),
+	}, logger)
+	if err != nil {
+		logger.Fatal("Failed to load pending message deletions", zap.Error(err))
+	}
+
+	// Register the webhook and command menu with Telegram
+	registerTelegramBot(telegram.NewClient(cfg.TelegramToken, nil), cfg, logger)
+
 	// Set Gin mode
 	if os.Getenv("GIN_MODE") != "debug" {
 		gin.SetMode(gin.ReleaseMode)
@@ -46,13 +96,35 @@ func main() {
 	router := gin.New()
 	router.Use(gin.Recovery())
 
+	// Cancelled at shutdown, stopping Telegram polling and the Auth0 work still in flight
+	appCtx, stopApp := context.WithCancel(context.Background())
+	defer stopApp()
+
+	// Setup plans waiting for confirmation in Telegram
+	plans := handlers.NewPendingPlans(5 * time.Minute)
+
+	// Device authorizations being polled, restarting setup in a chat cancels its poll
+	deviceFlows := handlers.NewDeviceFlows(appCtx)
+
+	// Client credentials users agreed to store at setup, disabled unless CREDENTIAL_VAULT is set
+	credentials := vault.New(st, cfg.CredentialVault, auth0.NewAuth0Client())
+
+	// Report tenants whose configuration was changed outside the bot, with a button to repair them
+	driftDone := make(chan struct{})
+	go func() {
+		defer close(driftDone)
+		handlers.NewDriftReconciler(cfg, st, credentials, deletions, logger).Run(appCtx)
+	}()
+
 	// Setup routes
-	routes.SetupRoutes(router, cfg, logger)
+	routes.SetupRoutes(appCtx, router, cfg, st, otp.NewBuffer(cfg.OTPBufferTTL), plans, deviceFlows, credentials, deletions,
+		logger)
 
-	// Create server
+	// Create server, request contexts are cancelled at shutdown as well as when the client disconnects
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.BotPort),
-		Handler: router,
+		Addr:        fmt.Sprintf(":%d", cfg.BotPort),
+		Handler:     router,
+		BaseContext: func(net.Listener) context.Context { return appCtx },
 	}
 
 	// Server startup in a goroutine
@@ -65,6 +137,19 @@ func main() {
 		}
 	}()
 
+	// Receive Telegram updates through long-polling when the webhook cannot reach the bot
+	pollDone := make(chan struct{})
+	if cfg.TelegramUpdateMode == config.UpdateModePolling {
+		go func() {
+			defer close(pollDone)
+			if err := handlers.PollTelegramUpdates(appCtx, cfg, st, plans, deviceFlows, credentials, deletions, logger); err != nil {
+				logger.Error("Telegram polling stopped", zap.Error(err))
+			}
+		}()
+	} else {
+		close(pollDone)
+	}
+
 	// Wait for interrupt signal to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -75,9 +160,104 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
+	stopApp()
 	if err := srv.Shutdown(ctx); err != nil {
 		logger.Fatal("Server forced to shutdown", zap.Error(err))
 	}
 
+	select {
+	case <-pollDone:
+	case <-ctx.Done():
+		logger.Warn("Telegram updates still being handled at shutdown")
+	}
+
+	select {
+	case <-driftDone:
+	case <-ctx.Done():
+		logger.Warn("Drift check still running at shutdown")
+	}
+
+	// Delete the messages already due, the rest stay persisted for the next start
+	if err := deletions.Close(ctx); err != nil {
+		logger.Warn("Message deletions still running at shutdown", zap.Error(err))
+	}
+
 	logger.Info("Server exited properly")
 }
+
+// registerTelegramBot publishes the command menu and, in webhook mode, points the webhook at this server.
+// Failures are logged rather than fatal, so a Telegram outage does not prevent the server from starting.
+func registerTelegramBot(client *telegram.Client, cfg *config.Config, logger *zap.Logger) {
+	if err := client.SetMyCommands(handlers.TelegramCommands); err != nil {
+		logger.Error("Failed to set bot commands", zap.Error(err))
+	} else {
+		verifyBotCommands(client, logger)
+	}
+
+	// Polling mode deletes the webhook itself
+	if cfg.TelegramUpdateMode != config.UpdateModeWebhook {
+		return
+	}
+
+	webhook := telegram.SetWebhookRequest{
+		URL:            cfg.BaseURL + "/bot/updates",
+		SecretToken:    cfg.DefaultSecretToken,
+		AllowedUpdates: handlers.TelegramAllowedUpdates,
+		MaxConnections: cfg.TelegramWebhookMaxConnections,
+	}
+	if err := client.SetWebhook(webhook); err != nil {
+		logger.Error("Failed to set webhook", zap.Error(err), zap.String("url", webhook.URL))
+		return
+	}
+
+	verifyWebhook(client, webhook, logger)
+}
+
+// verifyWebhook compares the registered webhook with the expected one and reports delivery errors
+func verifyWebhook(client *telegram.Client, expected telegram.SetWebhookRequest, logger *zap.Logger) {
+	info, err := client.GetWebhookInfo()
+	if err != nil {
+		logger.Error("Failed to get webhook info", zap.Error(err))
+		return
+	}
+
+	if info.URL != expected.URL {
+		logger.Error("Webhook URL mismatch", zap.String("expected", expected.URL), zap.String("registered", info.URL))
+	}
+	if info.MaxConnections != expected.MaxConnections {
+		logger.Warn("Webhook max connections mismatch",
+			zap.Int("expected", expected.MaxConnections),
+			zap.Int("registered", info.MaxConnections))
+	}
+	if !slices.Equal(info.AllowedUpdates, expected.AllowedUpdates) {
+		logger.Warn("Webhook allowed updates mismatch",
+			zap.Strings("expected", expected.AllowedUpdates),
+			zap.Strings("registered", info.AllowedUpdates))
+	}
+
+	if info.LastErrorMessage != "" {
+		logger.Error("Telegram reported a webhook delivery error",
+			zap.String("error", info.LastErrorMessage),
+			zap.Time("at", time.Unix(info.LastErrorDate, 0)),
+			zap.Int("pending_updates", info.PendingUpdateCount))
+	} else if info.PendingUpdateCount > 0 {
+		logger.Info("Webhook has pending updates", zap.Int("pending_updates", info.PendingUpdateCount))
+	}
+
+	logger.Info("Webhook registered", zap.String("url", info.URL))
+}
+
+// verifyBotCommands checks that the published command menu matches the bot commands
+func verifyBotCommands(client *telegram.Client, logger *zap.Logger) {
+	commands, err := client.GetMyCommands()
+	if err != nil {
+		logger.Error("Failed to get bot commands", zap.Error(err))
+		return
+	}
+
+	if !slices.Equal(commands, handlers.TelegramCommands) {
+		logger.Error("Bot commands mismatch",
+			zap.Any("expected", handlers.TelegramCommands),
+			zap.Any("registered", commands))
+	}
+}